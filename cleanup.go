@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/homeassistant"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+	"github.com/spf13/cobra"
+)
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Remove the retained discovery configs of all GPUs and exit",
+	Long: "Connect to the configured MQTT broker, enumerate the GPUs and publish an empty retained payload " +
+		"to every discovery config topic of their entities and the host device under the discovery prefix, " +
+		"e.g. to clear orphaned entities after changing the prefix, the node ID or the device ID strategy.",
+	Run: runCleanup,
+}
+
+func init() {
+	cleanupCmd.Flags().String("prefix", homeassistant.DefaultDiscoveryPrefix, "Discovery prefix to remove the configs from")
+	rootCmd.AddCommand(cleanupCmd)
+}
+
+func runCleanup(cmd *cobra.Command, args []string) {
+	cleanupCfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	resolveHostname(cleanupCfg)
+	nvidia.SetDeviceIDStrategy(cleanupCfg.DeviceIDStrategy)
+	prefix, _ := cmd.Flags().GetString("prefix")
+
+	// Orphaned configs are retained, only a retained empty payload clears them on the broker
+	cleanupCfg.MQTTRetain = true
+	cleanupCfg.DiscoveryRetain = true
+
+	if err := nvidia.Init(); err != nil {
+		log.Fatal("Failed to initialize NVIDIA management library:", err)
+	}
+	defer nvidia.Shutdown()
+
+	// Excluded GPUs are cleaned up as well, they may have been monitored before
+	gpus, err := nvidia.GetGPUDevices()
+	if err != nil {
+		log.Fatal("Failed to get GPU devices:", err)
+	}
+
+	// A random suffix keeps a running service with a fixed client ID connected
+	client := mqtt.NewClient(mqttClientOptions(cleanupCfg, mqttClientID(cleanupCfg.MQTTClientID, true)))
+	if !cleanupCfg.DryRun {
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			log.Fatal("Failed to connect to MQTT broker:", token.Error())
+		}
+		defer client.Disconnect(250)
+	}
+
+	haManager := homeassistant.NewManager([]mqtt.Client{client}, cleanupCfg)
+	total := 0
+	for _, gpu := range gpus {
+		cleared, err := haManager.RemoveGPUSensors(gpu, prefix)
+		if err != nil {
+			log.Printf("Failed to remove sensors for GPU %s: %v", gpu.Name, err)
+			exitCode = 1
+		}
+		total += cleared
+	}
+	cleared, err := haManager.RemoveHostSensors(cleanupCfg.Hostname, prefix)
+	if err != nil {
+		log.Printf("Failed to remove host sensors: %v", err)
+		exitCode = 1
+	}
+	total += cleared
+
+	fmt.Printf("Cleared %d discovery topic(s) under %s/ for %d GPU(s)\n", total, prefix, len(gpus))
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -20,11 +21,29 @@ import (
 
 var (
 	mqttHost     string
+	mqttURL      string
 	mqttPort     int
 	mqttUsername string
 	mqttPassword string
+	keepAlive    int
+	retryPeriod  int
+	clientID     string
+	clientSuffix bool
 	tempDir      string
 	deviceID     string
+	maxAge       time.Duration
+	tempUnit     string
+	nameMapValue string
+	nodeID       string
+
+	// nameMap maps device IDs to hwmon-style temp{n}_input/temp{n}_label files
+	nameMap = map[string]hwmonName{}
+	// labelsWritten tracks which mapped devices already have their label file
+	labelsWritten = map[string]bool{}
+	// lastUpdates holds the poll time of the latest last_update sensor value per device
+	lastUpdates = map[string]time.Time{}
+	// pendingRetained holds retained temperatures whose poll time is not known yet
+	pendingRetained = map[string]float64{}
 
 	rootCmd = &cobra.Command{
 		Use:   "ha-gpu-ccd",
@@ -37,10 +56,19 @@ var (
 func init() {
 	rootCmd.PersistentFlags().StringVar(&mqttHost, "mqtt-host", "localhost", "MQTT broker host")
 	rootCmd.PersistentFlags().IntVar(&mqttPort, "mqtt-port", 1883, "MQTT broker port")
-	rootCmd.PersistentFlags().StringVar(&mqttUsername, "mqtt-username", "", "MQTT username")
+	rootCmd.PersistentFlags().StringVar(&mqttURL, "mqtt-url", "", "Full MQTT broker URL used instead of --mqtt-host/--mqtt-port, e.g. unix:///run/mosquitto.sock or ws://host:9001/mqtt")
+	rootCmd.PersistentFlags().StringVar(&mqttUsername, "mqtt-username", "", "MQTT username (%HOSTNAME% is replaced by the system hostname)")
 	rootCmd.PersistentFlags().StringVar(&mqttPassword, "mqtt-password", "", "MQTT password")
+	rootCmd.PersistentFlags().StringVar(&clientID, "mqtt-client-id", "", "MQTT client ID (default \"ha-gpu-ccd\" with a random suffix)")
+	rootCmd.PersistentFlags().BoolVar(&clientSuffix, "mqtt-client-id-suffix", true, "Append a random suffix to the MQTT client ID")
+	rootCmd.PersistentFlags().IntVar(&keepAlive, "mqtt-keepalive", 60, "MQTT keepalive interval in seconds (0 disables keepalive pings)")
+	rootCmd.PersistentFlags().IntVar(&retryPeriod, "mqtt-connect-retry-interval", 10, "Delay in seconds between attempts to connect to the MQTT broker")
 	rootCmd.PersistentFlags().StringVar(&tempDir, "temp-dir", "/tmp", "Directory to write temperature files")
+	rootCmd.PersistentFlags().StringVar(&nodeID, "node-id", "nvml-gpu", "Discovery node ID of the nvml-gpu-ha topics, must match discovery_node_id")
 	rootCmd.PersistentFlags().StringVar(&deviceID, "device-id", "", "Specific GPU device ID to monitor (leave empty to monitor all devices)")
+	rootCmd.PersistentFlags().StringVar(&nameMapValue, "name-map", "", "Map device IDs to hwmon temp{n}_input/temp{n}_label files: a file path or inline DEVICEID=N[:Label],...")
+	rootCmd.PersistentFlags().StringVar(&tempUnit, "temperature-unit", "C", "Unit of the published temperatures (C or F), must match temperature_unit of nvml-gpu-ha")
+	rootCmd.PersistentFlags().DurationVar(&maxAge, "max-age", 0, "Maximum age of temperature values to write, measured with the last_update sensor of nvml-gpu-ha (0 to disable)")
 }
 
 func main() {
@@ -51,8 +79,12 @@ func main() {
 
 func run(cmd *cobra.Command, args []string) {
 	log.Printf("Starting ha-gpu-ccd")
-	log.Printf("MQTT Broker: %s:%d", mqttHost, mqttPort)
+	mqttUsername = expandUsername(mqttUsername)
+	log.Printf("MQTT Broker: %s", brokerURL())
 	log.Printf("Temperature directory: %s", tempDir)
+	if maxAge > 0 {
+		log.Printf("Max age: %v (retained temperatures older than the last_update sensor allows are ignored)", maxAge)
+	}
 	log.Printf("MQTT Username: %s", func() string {
 		if mqttUsername != "" {
 			return mqttUsername
@@ -60,6 +92,27 @@ func run(cmd *cobra.Command, args []string) {
 		return "(none)"
 	}())
 
+	if keepAlive < 0 {
+		log.Fatalf("Invalid MQTT keepalive %d, must be 0 (disabled) or more", keepAlive)
+	}
+	if retryPeriod <= 0 {
+		log.Fatalf("Invalid MQTT connect retry interval %d, must be at least 1", retryPeriod)
+	}
+
+	tempUnit = strings.ToUpper(tempUnit)
+	if tempUnit != "C" && tempUnit != "F" {
+		log.Fatalf("Invalid temperature unit %q, must be C or F", tempUnit)
+	}
+
+	var err error
+	nameMap, err = parseNameMap(nameMapValue)
+	if err != nil {
+		log.Fatalf("Failed to parse name map: %v", err)
+	}
+	for id, name := range nameMap {
+		log.Printf("Name map: %s -> temp%d_input (%s)", id, name.Index, name.Label)
+	}
+
 	// Create temp directory if it doesn't exist
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
 		log.Fatalf("Failed to create temp directory %s: %v", tempDir, err)
@@ -82,28 +135,22 @@ func run(cmd *cobra.Command, args []string) {
 
 func setupMQTTClient() mqtt.Client {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", mqttHost, mqttPort))
+	opts.AddBroker(brokerURL())
 
-	// Generate random suffix for client ID to avoid conflicts
-	randomBytes := make([]byte, 3)
-	if _, err := rand.Read(randomBytes); err == nil {
-		clientID := fmt.Sprintf("ha-gpu-ccd-%s", hex.EncodeToString(randomBytes))
-		opts.SetClientID(clientID)
-	} else {
-		// Fallback to timestamp if random generation fails
-		clientID := fmt.Sprintf("ha-gpu-ccd-%d", time.Now().Unix())
-		opts.SetClientID(clientID)
-	}
+	id := mqttClientID(clientID, clientSuffix)
+	log.Printf("MQTT client ID: %s", id)
+	opts.SetClientID(id)
 
 	opts.SetUsername(mqttUsername)
 	opts.SetPassword(mqttPassword)
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(10 * time.Second)
-	opts.SetKeepAlive(60 * time.Second)
+	opts.SetConnectRetryInterval(time.Duration(retryPeriod) * time.Second)
+	// Protocol version 3 is left to paho, which tries MQTT 3.1.1 and falls back to 3.1
+	opts.SetKeepAlive(time.Duration(keepAlive) * time.Second)
 
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		log.Println("Connected to MQTT broker")
+		log.Printf("Connected to MQTT broker using %s", mqttProtocolName(client))
 
 		// Wait a moment for connection to stabilize
 		go func() {
@@ -137,37 +184,110 @@ func setupMQTTClient() mqtt.Client {
 	return client
 }
 
+// expandUsername replaces %HOSTNAME% in username by the system hostname, so that the same
+// command line works on every host of a broker with per-host usernames
+func expandUsername(username string) string {
+	if !strings.Contains(username, "%HOSTNAME%") {
+		return username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("Failed to get the system hostname for the MQTT username: %v", err)
+	}
+	return strings.ReplaceAll(username, "%HOSTNAME%", hostname)
+}
+
+// brokerURL returns --mqtt-url if set, otherwise the TCP URL of --mqtt-host and --mqtt-port
+func brokerURL() string {
+	if mqttURL != "" {
+		return mqttURL
+	}
+	return fmt.Sprintf("tcp://%s:%d", mqttHost, mqttPort)
+}
+
+// mqttClientID returns the client ID for base (default "ha-gpu-ccd"),
+// with a random suffix appended to avoid conflicts when randomSuffix is set
+func mqttClientID(base string, randomSuffix bool) string {
+	if base == "" {
+		base = "ha-gpu-ccd"
+	}
+	if !randomSuffix {
+		return base
+	}
+
+	randomBytes := make([]byte, 3)
+	if _, err := rand.Read(randomBytes); err == nil {
+		return fmt.Sprintf("%s-%s", base, hex.EncodeToString(randomBytes))
+	}
+	// Fallback to timestamp if random generation fails
+	return fmt.Sprintf("%s-%d", base, time.Now().Unix())
+}
+
+// mqttProtocolName returns the protocol version negotiated by a connected client
+func mqttProtocolName(client mqtt.Client) string {
+	options := client.OptionsReader()
+	switch options.ProtocolVersion() {
+	case 3:
+		return "MQTT 3.1"
+	case 4:
+		return "MQTT 3.1.1"
+	default:
+		return fmt.Sprintf("MQTT protocol %d", options.ProtocolVersion())
+	}
+}
+
 func subscribeToTemperatureTopics(client mqtt.Client) error {
-	var topic string
+	topics := map[string]byte{}
 
+	// Only the default state_topic_template layout of nvml-gpu-ha is understood
 	if deviceID != "" {
-		// Subscribe to specific device temperature topic
-		topic = fmt.Sprintf("homeassistant/sensor/nvml-gpu/%s_temperature/state", deviceID)
+		// Subscribe to specific device temperature topic, and its poll time for the max age
+		topics[fmt.Sprintf("homeassistant/sensor/%s/%s_temperature/state", nodeID, deviceID)] = 1
+		if maxAge > 0 {
+			topics[fmt.Sprintf("homeassistant/sensor/%s/%s_last_update/state", nodeID, deviceID)] = 1
+		}
 	} else {
 		// Subscribe to all GPU temperature topics using # wildcard
-		topic = "homeassistant/sensor/nvml-gpu/#"
+		topics[fmt.Sprintf("homeassistant/sensor/%s/#", nodeID)] = 1
 	}
 
 	// Wait for subscription with timeout
-	token := client.Subscribe(topic, 1, onTemperatureMessage)
+	token := client.SubscribeMultiple(topics, onTemperatureMessage)
 	if !token.WaitTimeout(10 * time.Second) {
-		return fmt.Errorf("timeout waiting for subscription to %s", topic)
+		return fmt.Errorf("timeout waiting for subscription to %s", topicList(topics))
 	}
 
 	if token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to %s: %v", topic, token.Error())
+		return fmt.Errorf("failed to subscribe to %s: %v", topicList(topics), token.Error())
 	}
 
-	log.Printf("Successfully subscribed to: %s", topic)
+	log.Printf("Successfully subscribed to: %s", topicList(topics))
 	return nil
 }
 
+// topicList joins the topics of a subscription for logs
+func topicList(topics map[string]byte) string {
+	list := make([]string, 0, len(topics))
+	for topic := range topics {
+		list = append(list, topic)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
 func onTemperatureMessage(client mqtt.Client, msg mqtt.Message) {
 	topic := msg.Topic()
 	payload := string(msg.Payload())
 
+	// The last_update sensor tells the poll time of the temperatures for the max age
+	// Topic format: homeassistant/sensor/{NODEID}/{DEVICEID}_last_update/state
+	if maxAge > 0 && strings.HasSuffix(topic, "_last_update/state") {
+		onLastUpdateMessage(topic, payload)
+		return
+	}
+
 	// Filter for temperature topics only
-	// Topic format: homeassistant/sensor/nvml-gpu/{DEVICEID}_temperature/state
+	// Topic format: homeassistant/sensor/{NODEID}/{DEVICEID}_temperature/state
 	if !strings.Contains(topic, "_temperature/state") {
 		// Ignore non-temperature topics
 		return
@@ -185,6 +305,11 @@ func onTemperatureMessage(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
+	// Memory temperature topics share the _temperature suffix, ignore them
+	if strings.HasSuffix(deviceSensor, "_memory_temperature") {
+		return
+	}
+
 	deviceID := strings.TrimSuffix(deviceSensor, "_temperature")
 
 	// Parse temperature from JSON payload
@@ -194,14 +319,92 @@ func onTemperatureMessage(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
-	log.Printf("Received temperature for device %s: %.1f°C", deviceID, temperature)
+	// sysfs temperatures are always Celsius
+	if tempUnit == "F" {
+		temperature = (temperature - 32) * 5 / 9
+	}
+
+	// Retained messages are replayed by the broker on subscribe and may be long out of
+	// date. Their age is the one of the last_update value, which may arrive after them.
+	if msg.Retained() {
+		if maxAge > 0 {
+			updated, ok := lastUpdates[deviceID]
+			if !ok {
+				log.Printf("Holding retained temperature for device %s: %.1f°C until its last_update arrives", deviceID, temperature)
+				pendingRetained[deviceID] = temperature
+				return
+			}
+			if age := time.Since(updated); age > maxAge {
+				log.Printf("Ignoring retained temperature for device %s: %.1f°C (%v old, max age %v)", deviceID, temperature, age.Round(time.Second), maxAge)
+				return
+			}
+		}
+		log.Printf("Received retained temperature for device %s: %.1f°C (may be stale)", deviceID, temperature)
+	} else {
+		// A held retained temperature is older than this one and must not overwrite it
+		delete(pendingRetained, deviceID)
+		log.Printf("Received temperature for device %s: %.1f°C", deviceID, temperature)
+	}
+
+	writeTemperature(deviceID, temperature)
+}
+
+// onLastUpdateMessage records the poll time of a device and writes its held retained
+// temperature once it is known to be recent enough
+func onLastUpdateMessage(topic, payload string) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 {
+		log.Printf("Invalid topic format: %s", topic)
+		return
+	}
+	deviceID := strings.TrimSuffix(parts[3], "_last_update")
+
+	var timestamp string
+	if err := json.Unmarshal([]byte(payload), &timestamp); err != nil {
+		log.Printf("Failed to parse last update from payload '%s': %v", payload, err)
+		return
+	}
+	updated, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		log.Printf("Failed to parse last update from payload '%s': %v", payload, err)
+		return
+	}
+	lastUpdates[deviceID] = updated
+
+	temperature, ok := pendingRetained[deviceID]
+	if !ok {
+		return
+	}
+	delete(pendingRetained, deviceID)
 
+	age := time.Since(updated)
+	if age > maxAge {
+		log.Printf("Ignoring retained temperature for device %s: %.1f°C (%v old, max age %v)", deviceID, temperature, age.Round(time.Second), maxAge)
+		return
+	}
+	log.Printf("Received retained temperature for device %s: %.1f°C (%v old)", deviceID, temperature, age.Round(time.Second))
+	writeTemperature(deviceID, temperature)
+}
+
+// writeTemperature writes the temperature of a device in Celsius to its sysfs-style file
+func writeTemperature(deviceID string, temperature float64) {
 	// Convert temperature to sysfs format (millidegrees)
 	// Example: 80.5°C -> 80500
 	tempMillidegrees := int(temperature * 1000)
 
-	// Write to temp file
+	// Write to temp file, using hwmon naming for mapped devices
 	tempFile := filepath.Join(tempDir, fmt.Sprintf("temp_%s", deviceID))
+	if name, ok := nameMap[deviceID]; ok {
+		tempFile = filepath.Join(tempDir, fmt.Sprintf("temp%d_input", name.Index))
+		if !labelsWritten[deviceID] {
+			labelFile := filepath.Join(tempDir, fmt.Sprintf("temp%d_label", name.Index))
+			if err := writeFileAtomic(labelFile, name.Label+"\n"); err != nil {
+				log.Printf("Failed to write label file %s: %v", labelFile, err)
+			} else {
+				labelsWritten[deviceID] = true
+			}
+		}
+	}
 	if err := writeTemperatureFile(tempFile, tempMillidegrees); err != nil {
 		log.Printf("Failed to write temperature file %s: %v", tempFile, err)
 		return
@@ -210,19 +413,46 @@ func onTemperatureMessage(client mqtt.Client, msg mqtt.Message) {
 	log.Printf("Updated %s: %d (%.1f°C)", tempFile, tempMillidegrees, temperature)
 }
 
+// writeTemperatureFile writes the temperature value in millidegrees to filename
 func writeTemperatureFile(filename string, tempMillidegrees int) error {
-	content := strconv.Itoa(tempMillidegrees)
+	return writeFileAtomic(filename, strconv.Itoa(tempMillidegrees))
+}
 
-	// Create or overwrite the file
-	file, err := os.Create(filename)
+// writeFileAtomic atomically replaces filename with content,
+// so readers never observe a truncated or empty file
+func writeFileAtomic(filename string, content string) error {
+	// Preserve the mode of an existing file, default to world-readable
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	// Write to a temp file in the same directory so the rename stays on one filesystem
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
 	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+		return fmt.Errorf("failed to create temp file: %v", err)
 	}
-	defer file.Close()
+	tmpName := file.Name()
+	defer os.Remove(tmpName) // No-op after a successful rename
 
-	// Write the temperature value
+	// Write the content
 	if _, err := file.WriteString(content); err != nil {
-		return fmt.Errorf("failed to write temperature: %v", err)
+		file.Close()
+		return fmt.Errorf("failed to write content: %v", err)
+	}
+
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to set file mode: %v", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %v", err)
+	}
+
+	// Atomically replace the target file
+	if err := os.Rename(tmpName, filename); err != nil {
+		return fmt.Errorf("failed to rename temp file: %v", err)
 	}
 
 	return nil
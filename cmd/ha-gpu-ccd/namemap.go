@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hwmonName describes the hwmon-style temp{n}_input/temp{n}_label pair for a device
+type hwmonName struct {
+	Index int
+	Label string
+}
+
+// parseNameMap parses a device name map given either as a file path or inline.
+// Entries have the form DEVICEID=N or DEVICEID=N:Label, separated by commas
+// (inline) or newlines (file). Lines starting with # are ignored.
+func parseNameMap(value string) (map[string]hwmonName, error) {
+	nameMap := make(map[string]hwmonName)
+	if value == "" {
+		return nameMap, nil
+	}
+
+	var entries []string
+	if data, err := os.ReadFile(value); err == nil {
+		entries = strings.Split(string(data), "\n")
+	} else {
+		entries = strings.Split(value, ",")
+	}
+
+	usedIndexes := make(map[int]string)
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, target, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid name map entry %q: expected DEVICEID=N[:Label]", entry)
+		}
+		id = strings.TrimSpace(id)
+
+		indexStr, label, _ := strings.Cut(target, ":")
+		index, err := strconv.Atoi(strings.TrimSpace(indexStr))
+		if err != nil || index < 1 {
+			return nil, fmt.Errorf("invalid hwmon index in name map entry %q: must be a positive integer", entry)
+		}
+
+		if other, exists := usedIndexes[index]; exists {
+			return nil, fmt.Errorf("hwmon index %d is mapped to both %s and %s", index, other, id)
+		}
+		usedIndexes[index] = id
+
+		label = strings.TrimSpace(label)
+		if label == "" {
+			label = id
+		}
+
+		nameMap[id] = hwmonName{Index: index, Label: label}
+	}
+
+	return nameMap, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+// csvHeader names the columns of the CSV log, one row per GPU and cycle. Temperatures
+// are always in Celsius, metrics that could not be read are left empty.
+var csvHeader = []string{
+	"timestamp", "device_id", "name",
+	"power_draw_w", "performance_level", "memory_usage_percent", "memory_used_bytes",
+	"gpu_utilization_percent", "memory_utilization_percent", "temperature_c", "memory_temperature_c",
+	"graphics_clock_mhz", "energy_joules", "throttle_reasons",
+}
+
+// csvLogger appends collected metrics to a CSV file, independently of MQTT
+type csvLogger struct {
+	mutex sync.Mutex
+	path  string
+	// maxSize is the size in bytes at which the file is rotated to path.1 (0 disables rotation)
+	maxSize int64
+}
+
+func newCSVLogger(path string, maxSizeMB int) *csvLogger {
+	return &csvLogger{path: path, maxSize: int64(maxSizeMB) * 1024 * 1024}
+}
+
+// write appends the metrics of gpu as a row, creating the file with a header row if needed
+func (l *csvLogger) write(gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.rotate(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open CSV output: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat CSV output: %v", err)
+	}
+
+	w := csv.NewWriter(file)
+	if info.Size() == 0 {
+		if err := w.Write(csvHeader); err != nil {
+			return fmt.Errorf("failed to write CSV header: %v", err)
+		}
+	}
+	if err := w.Write(csvRow(gpu, metrics)); err != nil {
+		return fmt.Errorf("failed to write CSV row: %v", err)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// rotate moves a file that reached the maximum size to path.1, replacing an older one
+func (l *csvLogger) rotate() error {
+	if l.maxSize <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(l.path)
+	if err != nil || info.Size() < l.maxSize {
+		return nil
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate CSV output: %v", err)
+	}
+	return nil
+}
+
+// csvRow formats the metrics of gpu in the column order of csvHeader
+func csvRow(gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) []string {
+	value := func(sensor string, formatted string) string {
+		if metrics.Failed[sensor] {
+			return ""
+		}
+		return formatted
+	}
+
+	memoryTemperature := ""
+	if gpu.HasMemoryTemperature {
+		memoryTemperature = value("memory_temperature", strconv.Itoa(metrics.MemoryTemperature))
+	}
+
+	return []string{
+		metrics.Timestamp.Format(time.RFC3339),
+		nvidia.GetDeviceID(gpu),
+		gpu.Name,
+		value("power_draw", strconv.FormatFloat(metrics.PowerDraw, 'f', 2, 64)),
+		value("performance_level", metrics.PerformanceLevel),
+		value("memory_usage", strconv.FormatFloat(metrics.MemoryUsage, 'f', 2, 64)),
+		value("memory_usage", strconv.FormatUint(metrics.MemoryUsed, 10)),
+		value("gpu_utilization", strconv.Itoa(metrics.GPUUtilization)),
+		value("gpu_utilization", strconv.Itoa(metrics.MemoryUtilization)),
+		value("temperature", strconv.Itoa(metrics.Temperature)),
+		memoryTemperature,
+		value("graphics_clock", strconv.Itoa(metrics.GraphicsClock)),
+		value("energy_consumption", strconv.FormatFloat(metrics.TotalEnergyJoules, 'f', 3, 64)),
+		value("throttle_reasons", strings.Join(nvidia.ThrottleReasonNames(metrics.ThrottleReasons), ",")),
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+	"github.com/spf13/cobra"
+)
+
+var dumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Read the metrics of all GPUs once, print them and exit",
+	Long: "Enumerate NVIDIA GPUs, read one round of metrics without connecting to MQTT and print them to stdout. " +
+		"With --json the output is a JSON array with the device info and metrics of every GPU, e.g. to pipe into jq. " +
+		"The exit code is non-zero if any GPU failed to report, its entry then carries the error.",
+	Run: runDump,
+}
+
+func init() {
+	dumpCmd.Flags().Bool("json", false, "Print a JSON array instead of one line per GPU")
+	rootCmd.AddCommand(dumpCmd)
+}
+
+// dumpEntry is the JSON of one GPU printed by the dump command
+type dumpEntry struct {
+	Index       int          `json:"index"`
+	Name        string       `json:"name"`
+	UUID        string       `json:"uuid"`
+	PCIBusID    string       `json:"pci_bus_id"`
+	DeviceID    string       `json:"device_id"`
+	MemoryBytes uint64       `json:"memory_total_bytes"`
+	Metrics     *dumpMetrics `json:"metrics,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// dumpMetrics is the JSON of the raw readings of a GPU. Temperatures are always in
+// Celsius, the metrics listed in Failed could not be read.
+type dumpMetrics struct {
+	Timestamp            time.Time `json:"timestamp"`
+	PowerDrawWatts       float64   `json:"power_draw_watts"`
+	PerformanceLevel     string    `json:"performance_level"`
+	PerformanceState     int       `json:"performance_state"`
+	MemoryUsagePercent   float64   `json:"memory_usage_percent"`
+	MemoryUsedBytes      uint64    `json:"memory_used_bytes"`
+	MemoryTotalBytes     uint64    `json:"memory_total_bytes"`
+	MemoryReservedBytes  uint64    `json:"memory_reserved_bytes"`
+	GPUUtilization       int       `json:"gpu_utilization_percent"`
+	MemoryUtilization    int       `json:"memory_utilization_percent"`
+	MemoryBandwidthUtil  float64   `json:"memory_bandwidth_utilization_percent"`
+	Temperature          int       `json:"temperature_celsius"`
+	MemoryTemperature    int       `json:"memory_temperature_celsius"`
+	GraphicsClock        int       `json:"graphics_clock_mhz"`
+	MaxGraphicsClock     int       `json:"max_graphics_clock_mhz"`
+	ApplicationsClock    int       `json:"applications_clock_mhz"`
+	VideoClock           int       `json:"video_clock_mhz"`
+	PCIeLinkGen          int       `json:"pcie_link_gen"`
+	MaxPCIeLinkGen       int       `json:"max_pcie_link_gen"`
+	PCIeLinkWidth        int       `json:"pcie_link_width"`
+	MaxPCIeLinkWidth     int       `json:"max_pcie_link_width"`
+	TotalEnergyJoules    float64   `json:"total_energy_joules"`
+	EncoderSessions      int       `json:"encoder_sessions"`
+	EncoderFPS           int       `json:"encoder_fps"`
+	ThrottleReasons      []string  `json:"throttle_reasons"`
+	ReliabilityThrottled bool      `json:"reliability_throttled"`
+	Failed               []string  `json:"failed,omitempty"`
+}
+
+func runDump(cmd *cobra.Command, args []string) {
+	dumpCfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	nvidia.SetDeviceIDStrategy(dumpCfg.DeviceIDStrategy)
+	nvidia.SetUtilizationSource(dumpCfg.UtilizationSource)
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	if err := nvidia.Init(); err != nil {
+		log.Fatal("Failed to initialize NVIDIA management library:", err)
+	}
+	defer nvidia.Shutdown()
+
+	gpus, err := nvidia.GetGPUDevices()
+	if err != nil {
+		log.Fatal("Failed to get GPU devices:", err)
+	}
+
+	timeout := time.Duration(dumpCfg.NVMLTimeout) * time.Second
+	entries := make([]dumpEntry, 0, len(gpus))
+	for _, gpu := range gpus {
+		entry := dumpEntry{
+			Index:       gpu.Index,
+			Name:        gpu.Name,
+			UUID:        gpu.UUID,
+			PCIBusID:    gpu.PCIBusID,
+			DeviceID:    nvidia.GetDeviceID(gpu),
+			MemoryBytes: gpu.Memory,
+		}
+
+		// A partial read still has valid metrics, but counts as a failure to report
+		metrics, err := nvidia.GetGPUMetrics(gpu, timeout)
+		var partial *nvidia.PartialMetricsError
+		if err == nil || errors.As(err, &partial) {
+			entry.Metrics = newDumpMetrics(metrics)
+		}
+		if err != nil {
+			entry.Error = err.Error()
+			exitCode = 1
+		}
+		entries = append(entries, entry)
+
+		if !asJSON {
+			if entry.Error != "" {
+				fmt.Printf("GPU %d %s (%s): error: %s\n", gpu.Index, gpu.Name, entry.DeviceID, entry.Error)
+			}
+			if entry.Metrics != nil {
+				fmt.Printf("GPU %d %s (%s): %+v\n", gpu.Index, gpu.Name, entry.DeviceID, metrics)
+			}
+		}
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			log.Fatal("Failed to encode metrics:", err)
+		}
+	}
+}
+
+// newDumpMetrics converts the readings of a GPU to their JSON
+func newDumpMetrics(metrics nvidia.GPUMetrics) *dumpMetrics {
+	failed := make([]string, 0, len(metrics.Failed))
+	for key := range metrics.Failed {
+		failed = append(failed, key)
+	}
+	sort.Strings(failed)
+
+	return &dumpMetrics{
+		Timestamp:            metrics.Timestamp,
+		PowerDrawWatts:       metrics.PowerDraw,
+		PerformanceLevel:     metrics.PerformanceLevel,
+		PerformanceState:     metrics.PerformanceState,
+		MemoryUsagePercent:   metrics.MemoryUsage,
+		MemoryUsedBytes:      metrics.MemoryUsed,
+		MemoryTotalBytes:     metrics.MemoryTotal,
+		MemoryReservedBytes:  metrics.MemoryReserved,
+		GPUUtilization:       metrics.GPUUtilization,
+		MemoryUtilization:    metrics.MemoryUtilization,
+		MemoryBandwidthUtil:  metrics.MemoryBandwidthUtil,
+		Temperature:          metrics.Temperature,
+		MemoryTemperature:    metrics.MemoryTemperature,
+		GraphicsClock:        metrics.GraphicsClock,
+		MaxGraphicsClock:     metrics.MaxGraphicsClock,
+		ApplicationsClock:    metrics.ApplicationsClock,
+		VideoClock:           metrics.VideoClock,
+		PCIeLinkGen:          metrics.PCIeLinkGen,
+		MaxPCIeLinkGen:       metrics.MaxPCIeLinkGen,
+		PCIeLinkWidth:        metrics.PCIeLinkWidth,
+		MaxPCIeLinkWidth:     metrics.MaxPCIeLinkWidth,
+		TotalEnergyJoules:    metrics.TotalEnergyJoules,
+		EncoderSessions:      metrics.EncoderSessions,
+		EncoderFPS:           metrics.EncoderFPS,
+		ThrottleReasons:      nvidia.ThrottleReasonNames(metrics.ThrottleReasons),
+		ReliabilityThrottled: metrics.ReliabilityThrottled,
+		Failed:               failed,
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/homeassistant"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+// gpuEvent is a state change of a GPU between two monitoring cycles
+type gpuEvent struct {
+	Timestamp string      `json:"timestamp"`
+	Event     string      `json:"event"`
+	From      interface{} `json:"from"`
+	To        interface{} `json:"to"`
+}
+
+// eventDetector keeps the previous metrics of every GPU to detect state changes
+type eventDetector struct {
+	mutex    sync.Mutex
+	previous map[string]nvidia.GPUMetrics
+}
+
+func newEventDetector() *eventDetector {
+	return &eventDetector{previous: make(map[string]nvidia.GPUMetrics)}
+}
+
+// detect returns the changes of metrics compared to the previous cycle of gpu.
+// The first cycle of a GPU only records its state.
+func (d *eventDetector) detect(gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) []gpuEvent {
+	deviceID := nvidia.GetDeviceID(gpu)
+
+	d.mutex.Lock()
+	previous, ok := d.previous[deviceID]
+	if ok {
+		// Failed reads keep the previous state instead of reporting a change
+		if metrics.Failed["performance_level"] {
+			metrics.PerformanceLevel = previous.PerformanceLevel
+		}
+		if metrics.Failed["throttle_reasons"] {
+			metrics.ThrottleReasons = previous.ThrottleReasons
+		}
+	}
+	d.previous[deviceID] = metrics
+	d.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	timestamp := metrics.Timestamp.Format(time.RFC3339Nano)
+	var events []gpuEvent
+	if previous.PerformanceLevel != metrics.PerformanceLevel {
+		events = append(events, gpuEvent{
+			Timestamp: timestamp,
+			Event:     "performance_level",
+			From:      previous.PerformanceLevel,
+			To:        metrics.PerformanceLevel,
+		})
+	}
+	if previous.ThrottleReasons != metrics.ThrottleReasons {
+		events = append(events, gpuEvent{
+			Timestamp: timestamp,
+			Event:     "throttle_reasons",
+			From:      nvidia.ThrottleReasonNames(previous.ThrottleReasons),
+			To:        nvidia.ThrottleReasonNames(metrics.ThrottleReasons),
+		})
+	}
+	return events
+}
+
+// reportEvents logs state changes of a GPU and publishes them to its events topic if enabled
+func reportEvents(clients []mqtt.Client, gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) {
+	for _, event := range events.detect(gpu, metrics) {
+		log.Printf("GPU %s (%s): %s changed from %s to %s",
+			gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID), event.Event, formatEventValue(event.From), formatEventValue(event.To))
+
+		// Events are only published over MQTT, the REST output has no events topic
+		if !cfg().PublishEvents || len(clients) == 0 {
+			continue
+		}
+
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to marshal event %s: %v", event.Event, err)
+			continue
+		}
+
+		topic := homeassistant.DiscoveryTopic(cfg(), "sensor", homeassistant.ObjectID(nvidia.GetDeviceID(gpu)), "events")
+		if cfg().DryRun {
+			log.Printf("[dry-run] %s: %s", topic, payload)
+			continue
+		}
+
+		// Events are never retained, a late subscriber must not see a stale transition
+		if err := homeassistant.Publish(clients, topic, 1, false, payload, cfg().PublishTimeout()); err != nil {
+			stats.publishFailuresTotal.Add(1)
+			log.Printf("Failed to publish event %s: %v", event.Event, err)
+		}
+	}
+}
+
+// formatEventValue formats an event value for the log
+func formatEventValue(value interface{}) string {
+	if names, ok := value.([]string); ok {
+		if len(names) == 0 {
+			return "none"
+		}
+		return strings.Join(names, ",")
+	}
+	return fmt.Sprint(value)
+}
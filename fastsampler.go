@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+// fastSampler reads the sampled metrics of every GPU between two monitoring cycles and
+// replaces the readings of the next cycle by their maximum or average, so short spikes
+// show up in the published values without publishing more often
+type fastSampler struct {
+	mutex   sync.Mutex
+	metrics []string // keys of the sampled metrics
+	average bool     // publish the average instead of the maximum
+	samples map[string][]float64
+}
+
+func newFastSampler(metrics []string, aggregation string) *fastSampler {
+	return &fastSampler{
+		metrics: metrics,
+		average: aggregation == "avg",
+		samples: make(map[string][]float64),
+	}
+}
+
+// sample reads the quick metrics of all GPUs and records the sampled ones. Failed reads
+// are not samples, the next monitoring cycle reports the failure.
+func (s *fastSampler) sample(gpus []nvidia.GPUDevice) {
+	timeout := time.Duration(cfg().NVMLTimeout) * time.Second
+
+	var wg sync.WaitGroup
+	for _, gpu := range gpus {
+		wg.Add(1)
+		go func(gpu nvidia.GPUDevice) {
+			defer wg.Done()
+
+			metrics, err := nvidia.GetQuickMetrics(gpu, timeout)
+			var partial *nvidia.PartialMetricsError
+			if err != nil && !errors.As(err, &partial) {
+				return
+			}
+			s.record(gpu, metrics)
+		}(gpu)
+	}
+	wg.Wait()
+}
+
+// record appends the sampled metrics of gpu that could be read
+func (s *fastSampler) record(gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deviceID := nvidia.GetDeviceID(gpu)
+	for _, key := range s.metrics {
+		if metrics.Failed[key] || !gpu.Supports(key) {
+			continue
+		}
+		s.samples[deviceID+"_"+key] = append(s.samples[deviceID+"_"+key], sampledValue(metrics, key))
+	}
+}
+
+// aggregate replaces the sampled metrics of a cycle's reading by the aggregate of the
+// samples since the previous cycle and the reading itself, and starts over
+func (s *fastSampler) aggregate(gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) nvidia.GPUMetrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deviceID := nvidia.GetDeviceID(gpu)
+	for _, key := range s.metrics {
+		samples := s.samples[deviceID+"_"+key]
+		delete(s.samples, deviceID+"_"+key)
+		if metrics.Failed[key] {
+			continue
+		}
+
+		samples = append(samples, sampledValue(metrics, key))
+		value := samples[0]
+		sum := 0.0
+		for _, sample := range samples {
+			value = max(value, sample)
+			sum += sample
+		}
+		if s.average {
+			value = sum / float64(len(samples))
+		}
+		setSampledValue(&metrics, key, value)
+	}
+	return metrics
+}
+
+// sampledValue returns the value of a sampled metric
+func sampledValue(metrics nvidia.GPUMetrics, key string) float64 {
+	switch key {
+	case "gpu_utilization":
+		return float64(metrics.GPUUtilization)
+	case "temperature":
+		return float64(metrics.Temperature)
+	default:
+		return metrics.PowerDraw
+	}
+}
+
+// setSampledValue replaces the value of a sampled metric
+func setSampledValue(metrics *nvidia.GPUMetrics, key string, value float64) {
+	switch key {
+	case "gpu_utilization":
+		metrics.GPUUtilization = int(math.Round(value))
+	case "temperature":
+		metrics.Temperature = int(math.Round(value))
+	default:
+		metrics.PowerDraw = value
+	}
+}
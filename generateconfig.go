@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var generateConfigCmd = &cobra.Command{
+	Use:   "generate-config [path]",
+	Short: "Write a commented default config file and exit",
+	Long:  "Write the default configuration with a comment for every key to path (default /etc/nvml-gpu-ha.conf)",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   runGenerateConfig,
+}
+
+func init() {
+	generateConfigCmd.Flags().Bool("force", false, "Overwrite an existing config file")
+	rootCmd.AddCommand(generateConfigCmd)
+}
+
+func runGenerateConfig(cmd *cobra.Command, args []string) {
+	path := "/etc/nvml-gpu-ha.conf"
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	force, _ := cmd.Flags().GetBool("force")
+	if _, err := os.Stat(path); err == nil && !force {
+		log.Fatalf("Config file %s already exists, use --force to overwrite it", path)
+	}
+
+	if err := config.DefaultConfig().SaveToFile(path); err != nil {
+		log.Fatal("Failed to write config file:", err)
+	}
+
+	fmt.Printf("Wrote default configuration to %s\n", path)
+}
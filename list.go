@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/homeassistant"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List available NVIDIA GPUs and exit",
+	Long:  "Enumerate NVIDIA GPUs with their index, name, UUID, PCI ID, device ID and VRAM without connecting to MQTT",
+	Run:   runList,
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
+
+func runList(cmd *cobra.Command, args []string) {
+	listCfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	resolveHostname(listCfg)
+	nvidia.SetDeviceIDStrategy(listCfg.DeviceIDStrategy)
+
+	if err := nvidia.Init(); err != nil {
+		log.Fatal("Failed to initialize NVIDIA management library:", err)
+	}
+	defer nvidia.Shutdown()
+
+	gpus, err := nvidia.GetGPUDevices()
+	if err != nil {
+		log.Fatal("Failed to get GPU devices:", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tNAME\tUUID\tPCI ID\tDEVICE ID\tVRAM\tDISPLAY NAME")
+	for _, gpu := range gpus {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%.1fGB\t%s\n",
+			gpu.Index,
+			gpu.Name,
+			gpu.UUID,
+			nvidia.GetShortPCIBusID(gpu.PCIBusID),
+			nvidia.GetDeviceID(gpu),
+			float64(gpu.Memory)/(1024*1024*1024),
+			homeassistant.DeviceName(listCfg, gpu, listCfg.Hostname))
+	}
+	w.Flush()
+}
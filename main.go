@@ -5,69 +5,164 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/grpcapi"
 	"github.com/pccr10001/nvml-gpu-ha/pkg/homeassistant"
 	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
 	"github.com/spf13/cobra"
 )
 
 var (
-	cfg             *config.Config
+	configRef       atomic.Pointer[config.Config] // read through cfg(), swapped as a whole on reload
 	monitoringMutex sync.Mutex
 	isMonitoring    bool
 	lastMonitorTime time.Time
+	failureMutex    sync.Mutex
+	failureCounts   = make(map[string]int)                // consecutive failed cycles per device ID
+	haManagerRef    atomic.Pointer[homeassistant.Manager] // lets the MQTT connect handler reach the manager
+	reconnected     = make(chan struct{}, 1)              // signals the main loop to republish discovery after a reconnect
+	smoother        *metricsSmoother
+	events          *eventDetector // nil unless event logging or publishing is enabled
+	csvOutput       *csvLogger     // nil unless csv_output is set
+	statsTracker    *windowStats   // nil unless stats_window is set
+	changes         *changeTracker // nil unless publish_on_change is set
+	sampler         *fastSampler   // nil unless sample_interval is shorter than the polling period
+	exitCode        int            // process exit code once the root command returns
+	busyMutex       sync.Mutex
+	busyStates      = make(map[string]bool)
+	grpcServer      *grpcapi.Server              // nil unless grpc_listen is set
+	restPublisher   *homeassistant.RESTPublisher // nil unless output is rest
 	rootCmd         = &cobra.Command{
-		Use:   "nvml-gpu-ha",
-		Short: "NVIDIA GPU monitoring for Home Assistant via MQTT",
-		Long:  "Monitor NVIDIA GPU metrics and send them to Home Assistant via MQTT with auto-discovery support",
-		Run:   run,
+		Use:     "nvml-gpu-ha",
+		Version: version,
+		Short:   "NVIDIA GPU monitoring for Home Assistant via MQTT",
+		Long:    "Monitor NVIDIA GPU metrics and send them to Home Assistant via MQTT with auto-discovery support",
+		Run:     run,
 	}
 )
 
+// version is the build version, set with -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// cfg returns the current configuration of the service
+func cfg() *config.Config {
+	return configRef.Load()
+}
+
 func init() {
+	homeassistant.Version = version
+
 	// Command line flags
 	rootCmd.PersistentFlags().String("config", "/etc/nvml-gpu-ha.conf", "Configuration file path")
 	rootCmd.PersistentFlags().String("hostname", "", "Hostname prefix for GPU names (default: system hostname)")
 	rootCmd.PersistentFlags().String("mqtt-host", "localhost", "MQTT broker host")
 	rootCmd.PersistentFlags().Int("mqtt-port", 1883, "MQTT broker port")
-	rootCmd.PersistentFlags().String("mqtt-username", "", "MQTT username")
+	rootCmd.PersistentFlags().String("mqtt-url", "", "Full MQTT broker URL used instead of --mqtt-host/--mqtt-port, e.g. unix:///run/mosquitto.sock or ws://host:9001/mqtt")
+	rootCmd.PersistentFlags().StringSlice("mqtt-hosts", nil, "Comma-separated list of MQTT brokers for failover (host or host:port)")
+	rootCmd.PersistentFlags().String("mqtt-username", "", "MQTT username (%HOSTNAME% is replaced by the hostname)")
 	rootCmd.PersistentFlags().String("mqtt-password", "", "MQTT password")
 	rootCmd.PersistentFlags().Bool("mqtt-lwt-enable", true, "Enable MQTT Last Will and Testament")
+	rootCmd.PersistentFlags().String("output", "mqtt", "Where states are sent: mqtt or rest (Home Assistant REST API)")
+	rootCmd.PersistentFlags().String("ha-url", "", "Home Assistant URL for --output rest, e.g. http://homeassistant.local:8123")
+	rootCmd.PersistentFlags().String("ha-token", "", "Home Assistant long-lived access token for --output rest")
+	rootCmd.PersistentFlags().String("mqtt-client-id", "", "MQTT client ID (default \"nvml-gpu-ha\" with a random suffix)")
+	rootCmd.PersistentFlags().Bool("mqtt-client-id-suffix", true, "Append a random suffix to the MQTT client ID")
+	rootCmd.PersistentFlags().Int("mqtt-keepalive", 30, "MQTT keepalive interval in seconds (0 disables keepalive pings)")
+	rootCmd.PersistentFlags().Int("mqtt-connect-retry-interval", 10, "Delay in seconds between attempts to connect to the MQTT broker")
+	rootCmd.PersistentFlags().String("availability-topic", config.DefaultAvailabilityTopic, "Availability topic for the Last Will and the discovery configs")
+	rootCmd.PersistentFlags().String("payload-available", "online", "Availability payload while the service is running")
+	rootCmd.PersistentFlags().String("payload-not-available", "offline", "Availability payload for the Last Will")
 	rootCmd.PersistentFlags().Bool("mqtt-retain", true, "Retain MQTT messages")
+	rootCmd.PersistentFlags().Bool("discovery-retain", true, "Retain discovery configs (requires --mqtt-retain)")
+	rootCmd.PersistentFlags().Bool("state-retain", true, "Retain sensor states (requires --mqtt-retain)")
+	rootCmd.PersistentFlags().Bool("availability-retain", true, "Retain availability payloads and the Last Will (requires --mqtt-retain)")
+	rootCmd.PersistentFlags().Int("discovery-qos", 1, "MQTT QoS (0-2) of the discovery configs")
+	rootCmd.PersistentFlags().Int("state-qos", 1, "MQTT QoS (0-2) of the sensor states")
+	rootCmd.PersistentFlags().Int("discovery-concurrency", 0, "Publish at most N discovery messages per broker at a time (0 for no limit)")
 	rootCmd.PersistentFlags().Int("polling-period", 30, "GPU polling period in seconds")
+	rootCmd.PersistentFlags().Int("mqtt-publish-timeout", 5, "Timeout in seconds for the broker to confirm a publish")
+	rootCmd.PersistentFlags().Int("nvml-timeout", 10, "Timeout in seconds for reading metrics from a GPU")
+	rootCmd.PersistentFlags().Int("nvml-init-attempts", 5, "Number of NVML initialization attempts while waiting for the NVIDIA driver")
+	rootCmd.PersistentFlags().Int("nvml-init-interval", 5, "Initial delay in seconds between NVML initialization attempts, doubled after each attempt")
+	rootCmd.PersistentFlags().Int("watchdog-periods", 0, "Exit when no monitoring cycle finished for N polling periods (0 disables the watchdog)")
+	rootCmd.PersistentFlags().Int("unavailable-after-failures", 3, "Consecutive failed cycles after which a GPU is marked unavailable")
+	rootCmd.PersistentFlags().Int("max-concurrent-polls", 0, "Read at most N GPUs at the same time per cycle (0 reads all at once)")
+	rootCmd.PersistentFlags().String("utilization-source", "instant", "GPU utilization source: instant, samples or process")
+	rootCmd.PersistentFlags().Int("sample-interval", 0, "Sample metrics every N seconds between polls (0 reads them once per polling period)")
+	rootCmd.PersistentFlags().String("sample-aggregation", "max", "Published value of the samples between two polls: max or avg")
+	rootCmd.PersistentFlags().StringSlice("sampled-metrics", []string{"gpu_utilization"}, "Metrics sampled every --sample-interval: gpu_utilization, temperature, power_draw")
+	rootCmd.PersistentFlags().Int("utilization-samples", 1, "Number of samples to average GPU utilization over (1 disables smoothing)")
+	rootCmd.PersistentFlags().Bool("smooth-temperature", false, "Also average temperature over the utilization sample window")
+	rootCmd.PersistentFlags().Int("busy-threshold", 10, "GPU utilization percentage at which the GPU is reported as busy")
+	rootCmd.PersistentFlags().Int("busy-off-threshold", -1, "GPU utilization percentage below which the GPU is no longer busy (-1 uses --busy-threshold)")
+	rootCmd.PersistentFlags().Int("default-precision", -1, "Round numeric sensors to this many decimals (-1 keeps the built-in rounding)")
+	rootCmd.PersistentFlags().StringToInt("sensor-precision", nil, "Per-sensor decimals, e.g. power_draw=0,temperature=0,memory_usage=1")
+	rootCmd.PersistentFlags().StringToString("device-names", nil, "Device name overrides by UUID, short UUID or index, e.g. 0=\"Render GPU\"")
+	rootCmd.PersistentFlags().String("memory-usage-unit", "%", "Unit of the VRAM usage sensor: %, B, MiB or GiB")
+	rootCmd.PersistentFlags().String("temperature-unit", "C", "Unit of published temperatures: C or F")
+	rootCmd.PersistentFlags().String("device-id-strategy", "pci", "Device ID format in topics: pci, uuid (follows the card across slots) or pci_uuid")
+	rootCmd.PersistentFlags().String("state-topic-template", config.DefaultStateTopicTemplate, "Go template for sensor and binary sensor state topics with the fields .Component, .NodeID, .DeviceID and .Sensor")
+	rootCmd.PersistentFlags().String("discovery-node-id", config.DefaultDiscoveryNodeID, "Node ID segment of the discovery topics, e.g. per tenant on a shared broker")
+	rootCmd.PersistentFlags().String("device-name-template", "", "Go template for Home Assistant device names, e.g. '{{.Hostname}}-gpu{{.Index}}'")
+	rootCmd.PersistentFlags().StringSlice("include-uuids", nil, "Only monitor GPUs with these UUIDs (full or short 8-character form)")
+	rootCmd.PersistentFlags().StringSlice("exclude-uuids", nil, "Do not monitor GPUs with these UUIDs (full or short 8-character form)")
+	rootCmd.PersistentFlags().IntSlice("include-indexes", nil, "Only monitor GPUs with these NVML indexes")
+	rootCmd.PersistentFlags().IntSlice("exclude-indexes", nil, "Do not monitor GPUs with these NVML indexes")
+	rootCmd.PersistentFlags().StringSlice("enabled-sensors", nil, "Only publish these sensors, by key (e.g. power_draw,temperature)")
+	rootCmd.PersistentFlags().StringSlice("disabled-sensors", nil, "Do not publish these sensors, by key (e.g. performance_level)")
+	rootCmd.PersistentFlags().String("stats-window", "", "Publish min/max/avg temperature and power draw over a window such as 1h, or daily")
+	rootCmd.PersistentFlags().String("via-device", "", "Identifier of the Home Assistant device to nest GPUs under (\"host\" for the host-level device)")
+	rootCmd.PersistentFlags().StringSlice("host-connections", nil, "Connections of the host-level device as type:value, e.g. mac:00:11:22:33:44:55")
+	rootCmd.PersistentFlags().String("hostname-pattern", "", "Regular expression replaced in the hostname before it is used in device names")
+	rootCmd.PersistentFlags().String("hostname-replacement", "", "Replacement for hostname pattern matches ($1 refers to the first group)")
+	rootCmd.PersistentFlags().Bool("publish-on-change", false, "Only publish sensor values that changed since the last cycle")
+	rootCmd.PersistentFlags().Int("publish-max-interval", 300, "With --publish-on-change, republish unchanged values after N seconds (0 never does)")
+	rootCmd.PersistentFlags().Bool("force-update", true, "Let Home Assistant record every received state, even an unchanged one")
+	rootCmd.PersistentFlags().String("csv-output", "", "Append the metrics of every GPU and cycle to this CSV file")
+	rootCmd.PersistentFlags().Int("csv-max-size", 100, "Rotate the CSV file once it reaches this size in MiB (0 never rotates)")
+	rootCmd.PersistentFlags().String("metrics-listen", "", "Address to serve service metrics on /metrics, e.g. :9400 (empty to disable)")
+	rootCmd.PersistentFlags().String("grpc-listen", "", "Address of the gRPC metrics API streaming every cycle, e.g. :9401 (empty to disable)")
+	rootCmd.PersistentFlags().Int("rediscovery-interval", 0, "Republish discovery configs every N seconds (0 to disable)")
+	rootCmd.PersistentFlags().Bool("rediscover-on-reconnect", true, "Republish discovery configs after every reconnect to the MQTT broker")
+	rootCmd.PersistentFlags().Bool("log-events", false, "Log performance level and throttle reason changes")
+	rootCmd.PersistentFlags().Bool("publish-events", false, "Also publish state changes to each GPU's events topic")
+	rootCmd.PersistentFlags().Bool("fan-control", false, "Expose fan speed controls in Home Assistant (requires root)")
+	rootCmd.PersistentFlags().Bool("cleanup-on-exit", false, "Remove Home Assistant entities for all GPUs on shutdown")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Log MQTT topics and payloads instead of publishing them")
+	rootCmd.Flags().Bool("once", false, "Run a single monitoring cycle and exit (non-zero exit code if any GPU failed)")
+	rootCmd.Flags().Bool("no-initial-poll", false, "Wait for the first polling period before publishing metrics instead of publishing right after startup")
 }
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
+	os.Exit(exitCode)
 }
 
 func run(cmd *cobra.Command, args []string) {
-	var err error
-	cfg, err = config.LoadConfig(cmd)
+	loaded, err := config.LoadConfig(cmd)
 	if err != nil {
 		log.Fatal("Failed to load configuration:", err)
 	}
+	resolveHostname(loaded)
+	configRef.Store(loaded)
 
-	// If hostname is not provided, use system hostname
-	if cfg.Hostname == "" {
-		if hostname, err := os.Hostname(); err == nil {
-			cfg.Hostname = hostname
-		} else {
-			log.Printf("Warning: Failed to get system hostname, using 'localhost': %v", err)
-			cfg.Hostname = "localhost"
-		}
-	}
+	nvidia.SetDeviceIDStrategy(cfg().DeviceIDStrategy)
+	nvidia.SetUtilizationSource(cfg().UtilizationSource)
 
 	// Display configuration source
 	configFile, _ := cmd.Flags().GetString("config")
@@ -78,21 +173,61 @@ func run(cmd *cobra.Command, args []string) {
 	}
 
 	// Display key configuration values (without sensitive data)
-	log.Printf("Hostname: %s", cfg.Hostname)
-	log.Printf("MQTT Broker: %s:%d", cfg.MQTTHost, cfg.MQTTPort)
-	log.Printf("MQTT Username: %s", func() string {
-		if cfg.MQTTUsername != "" {
-			return cfg.MQTTUsername
-		} else {
-			return "(none)"
+	log.Printf("Version: %s", version)
+	log.Printf("Hostname: %s", cfg().Hostname)
+	if cfg().RESTOutput() {
+		log.Printf("Output: Home Assistant REST API at %s", cfg().HAURL)
+	} else {
+		log.Printf("MQTT Broker(s): %s", strings.Join(cfg().MQTTBrokers(), ", "))
+		for _, broker := range cfg().MirrorBrokers {
+			log.Printf("MQTT Mirror Broker: %s", broker.URL)
 		}
-	}())
-	log.Printf("Polling Period: %d seconds", cfg.PollingPeriod)
-	log.Printf("MQTT LWT Enabled: %v", cfg.MQTTLWTEnable)
-	log.Printf("MQTT Retain: %v", cfg.MQTTRetain)
+		log.Printf("MQTT Username: %s", func() string {
+			if cfg().MQTTUsername != "" {
+				return cfg().Username()
+			} else {
+				return "(none)"
+			}
+		}())
+	}
+	log.Printf("Polling Period: %d seconds", cfg().PollingPeriod)
+	log.Printf("NVML Timeout: %d seconds", cfg().NVMLTimeout)
+	if cfg().UtilizationSource != nvidia.UtilizationSourceInstant {
+		log.Printf("Utilization Source: %s", cfg().UtilizationSource)
+	}
+	if cfg().FastSampling() {
+		log.Printf("Fast Sampling: %s every %d seconds, publishing the %s", strings.Join(cfg().SampledMetrics, ", "), cfg().SampleInterval, cfg().SampleAggregation)
+		sampler = newFastSampler(cfg().SampledMetrics, cfg().SampleAggregation)
+	}
+	if cfg().UtilizationSamples > 1 {
+		log.Printf("Utilization Smoothing: %d samples (temperature: %v)", cfg().UtilizationSamples, cfg().SmoothTemperature)
+	}
+	smoother = newMetricsSmoother(cfg().UtilizationSamples, cfg().SmoothTemperature)
+	if cfg().LogEvents || cfg().PublishEvents {
+		log.Printf("State Change Events: logged (published: %v)", cfg().PublishEvents)
+		events = newEventDetector()
+	}
+	if cfg().StatsWindow != "" {
+		log.Printf("Min/Max/Avg Window: %s", cfg().StatsWindow)
+		statsTracker = newWindowStats(cfg().StatsWindowDuration())
+	}
+	if cfg().PublishOnChange {
+		log.Printf("Publish On Change: enabled (heartbeat every %d seconds)", cfg().PublishMaxInterval)
+		changes = newChangeTracker(time.Duration(cfg().PublishMaxInterval) * time.Second)
+	}
+	if cfg().CSVOutput != "" {
+		log.Printf("CSV Output: %s (rotated at %d MiB)", cfg().CSVOutput, cfg().CSVMaxSize)
+		csvOutput = newCSVLogger(cfg().CSVOutput, cfg().CSVMaxSize)
+	}
+	log.Printf("MQTT LWT Enabled: %v", cfg().MQTTLWTEnable)
+	log.Printf("MQTT Retain: discovery %v, states %v, availability %v", cfg().RetainDiscovery(), cfg().RetainState(), cfg().RetainAvailability())
+	if cfg().DryRun {
+		log.Printf("Dry Run: enabled (nothing will be published to MQTT)")
+	}
 
-	// Initialize NVIDIA management library
-	if err := nvidia.Init(); err != nil {
+	// Initialize NVIDIA management library and get GPU information
+	gpus, err := initNVML()
+	if err != nil {
 		log.Fatal("Failed to initialize NVIDIA management library:", err)
 	}
 	defer nvidia.Shutdown()
@@ -105,33 +240,69 @@ func run(cmd *cobra.Command, args []string) {
 		log.Printf("NVIDIA Driver Version: %s", driverVersion)
 	}
 
-	// Get GPU information
-	gpus, err := nvidia.GetGPUDevices()
-	if err != nil {
-		log.Fatal("Failed to get GPU devices:", err)
+	log.Printf("Found %d NVIDIA GPU(s)", len(gpus))
+	for _, gpu := range gpus {
+		shortPCIID := nvidia.GetShortPCIBusID(gpu.PCIBusID)
+		log.Printf("GPU %d: %s (%s, %.1fGB)", gpu.Index, gpu.Name, shortPCIID, float64(gpu.Memory)/(1024*1024*1024))
+		if unsupported := gpu.UnsupportedSensors(); len(unsupported) > 0 {
+			log.Printf("GPU %d: not registering unsupported sensors: %s", gpu.Index, strings.Join(unsupported, ", "))
+		}
 	}
 
+	gpus = filterGPUs(gpus)
 	if len(gpus) == 0 {
-		log.Fatal("No NVIDIA GPUs found")
+		log.Fatal("All NVIDIA GPUs are excluded by the configuration")
 	}
-
-	log.Printf("Found %d NVIDIA GPU(s)", len(gpus))
-	for i, gpu := range gpus {
-		shortPCIID := nvidia.GetShortPCIBusID(gpu.PCIBusID)
-		log.Printf("GPU %d: %s (%s, %.1fGB)", i, gpu.Name, shortPCIID, float64(gpu.Memory)/(1024*1024*1024))
+	for _, key := range homeassistant.UnknownSensorOverrides(cfg(), gpus) {
+		log.Printf("Warning: ignoring sensor_overrides for %q, no sensor of the GPUs or the host has this key", key)
 	}
 
-	// Setup MQTT client
-	mqttClient := setupMQTTClient()
-	defer mqttClient.Disconnect(250)
+	// Without a broker there is no discovery, availability topic or command entity, so there
+	// are no MQTT clients and the discovery manager stays nil
+	var mqttClients []mqtt.Client
+	var haManager *homeassistant.Manager
+	if cfg().RESTOutput() {
+		restPublisher = homeassistant.NewRESTPublisher(cfg())
+		for _, gpu := range gpus {
+			if err := restPublisher.RegisterGPU(gpu, cfg().Hostname); err != nil {
+				log.Printf("Failed to post static sensors for GPU %s: %v", gpu.Name, err)
+			}
+		}
+		restPublisher.RegisterHost(cfg().Hostname)
+	} else {
+		// Setup MQTT clients, the main broker first
+		mqttClients = setupMQTTClients()
+		defer func() {
+			for _, client := range mqttClients {
+				client.Disconnect(250)
+			}
+		}()
 
-	// Setup Home Assistant discovery
-	haManager := homeassistant.NewManager(mqttClient, cfg)
+		// Setup Home Assistant discovery
+		haManager = homeassistant.NewManager(mqttClients, cfg())
+		haManagerRef.Store(haManager)
 
-	// Register all GPU sensors with Home Assistant
-	for _, gpu := range gpus {
-		if err := haManager.RegisterGPUSensors(gpu, cfg.Hostname); err != nil {
-			log.Printf("Failed to register sensors for GPU %s: %v", gpu.Name, err)
+		// Register all GPU sensors with Home Assistant
+		registerDiscovery(haManager, gpus)
+	}
+
+	// A single cycle for cron jobs, systemd timers and smoke tests
+	if once, _ := cmd.Flags().GetBool("once"); once {
+		if failed := monitorGPUs(mqttClients, gpus, false); failed > 0 {
+			log.Printf("Failed to get metrics for %d of %d GPU(s)", failed, len(gpus))
+			exitCode = 1
+		}
+		return
+	}
+
+	if cfg().MetricsListen != "" {
+		startMetricsServer(cfg().MetricsListen)
+	}
+	if cfg().GRPCListen != "" {
+		grpcServer = grpcapi.NewServer()
+		grpcServer.SetDevices(gpus)
+		if err := grpcServer.Serve(cfg().GRPCListen); err != nil {
+			log.Fatal("Failed to start the gRPC server:", err)
 		}
 	}
 
@@ -147,127 +318,605 @@ func run(cmd *cobra.Command, args []string) {
 		cancel()
 	}()
 
+	// A hung driver most likely stalls the first cycle, so the watchdog already covers it
+	if cfg().WatchdogPeriods > 0 {
+		log.Printf("Watchdog: exiting if no cycle finishes for %d polling periods", cfg().WatchdogPeriods)
+		startWatchdog()
+	}
+
+	// Publish right away instead of leaving the sensors empty for the first polling period.
+	// No cycle ran yet, so neither the in-progress nor the too-soon check skips this one, and
+	// the ticker only starts afterwards so its first cycle is a full period later.
+	if noInitialPoll, _ := cmd.Flags().GetBool("no-initial-poll"); !noInitialPoll {
+		monitorGPUs(mqttClients, gpus, false)
+	}
+
 	// Main monitoring loop
-	ticker := time.NewTicker(time.Duration(cfg.PollingPeriod) * time.Second)
+	ticker := time.NewTicker(time.Duration(cfg().PollingPeriod) * time.Second)
 	defer ticker.Stop()
 
-	log.Printf("Starting GPU monitoring loop (polling every %d seconds)", cfg.PollingPeriod)
+	log.Printf("Starting GPU monitoring loop (polling every %d seconds)", cfg().PollingPeriod)
+
+	// SIGHUP reloads the configuration
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	// SIGUSR1 triggers an immediate cycle that logs the full metrics for debugging
+	dumpChan := make(chan os.Signal, 1)
+	if len(dumpSignals) > 0 {
+		signal.Notify(dumpChan, dumpSignals...)
+	}
+
+	// Periodically republish discovery configs in case the broker lost retained messages
+	var rediscoveryChan <-chan time.Time
+	if cfg().RediscoveryInterval > 0 && haManager != nil {
+		log.Printf("Republishing discovery configs every %d seconds", cfg().RediscoveryInterval)
+		rediscoveryTicker := time.NewTicker(time.Duration(cfg().RediscoveryInterval) * time.Second)
+		defer rediscoveryTicker.Stop()
+		rediscoveryChan = rediscoveryTicker.C
+	}
+
+	// Samples between the cycles are read on this goroutine as well, so they share the GPU
+	// handles with the cycles; samples due while a cycle runs are skipped
+	var sampleChan <-chan time.Time
+	if sampler != nil {
+		sampleTicker := time.NewTicker(time.Duration(cfg().SampleInterval) * time.Second)
+		defer sampleTicker.Stop()
+		sampleChan = sampleTicker.C
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Shutting down...")
+			if cfg().CleanupOnExit && haManager != nil {
+				log.Println("Removing Home Assistant entities...")
+				for _, gpu := range gpus {
+					if _, err := haManager.RemoveGPUSensors(gpu, homeassistant.DefaultDiscoveryPrefix); err != nil {
+						log.Printf("Failed to remove sensors for GPU %s: %v", gpu.Name, err)
+					}
+				}
+				if _, err := haManager.RemoveHostSensors(cfg().Hostname, homeassistant.DefaultDiscoveryPrefix); err != nil {
+					log.Printf("Failed to remove host sensors: %v", err)
+				}
+			}
 			return
+		case <-rediscoveryChan:
+			log.Println("Republishing discovery configs...")
+			registerDiscovery(haManager, gpus)
+		case <-reconnected:
+			log.Println("Connected to MQTT broker, republishing discovery configs...")
+			registerDiscovery(haManager, gpus)
+		case <-reloadChan:
+			reloadConfig(cmd, ticker, haManager, gpus)
 		case <-ticker.C:
-			monitorGPUs(mqttClient, gpus)
+			monitorGPUs(mqttClients, gpus, false)
+		case <-sampleChan:
+			sampler.sample(gpus)
+		case <-dumpChan:
+			log.Println("Received SIGUSR1, running a monitoring cycle and dumping metrics...")
+			monitorGPUs(mqttClients, gpus, true)
 		}
 	}
 }
 
-func setupMQTTClient() mqtt.Client {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", cfg.MQTTHost, cfg.MQTTPort))
+// maxNVMLInitInterval caps the backoff between NVML initialization attempts
+const maxNVMLInitInterval = time.Minute
 
-	// Generate random suffix for client ID to avoid conflicts
-	randomBytes := make([]byte, 3)
-	if _, err := rand.Read(randomBytes); err == nil {
-		clientID := fmt.Sprintf("nvml-gpu-ha-%s", hex.EncodeToString(randomBytes))
-		opts.SetClientID(clientID)
-	} else {
-		// Fallback to timestamp if random generation fails
-		clientID := fmt.Sprintf("nvml-gpu-ha-%d", time.Now().Unix())
-		opts.SetClientID(clientID)
+// initNVML initializes NVML and enumerates the GPUs, retrying with exponential
+// backoff while the NVIDIA driver is not loaded yet (e.g. early during boot)
+func initNVML() ([]nvidia.GPUDevice, error) {
+	interval := time.Duration(cfg().NVMLInitInterval) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		gpus, err := initNVMLOnce()
+		if err == nil {
+			return gpus, nil
+		}
+		if attempt >= cfg().NVMLInitAttempts {
+			return nil, err
+		}
+
+		log.Printf("Waiting for NVIDIA driver (attempt %d/%d failed: %v), retrying in %v",
+			attempt, cfg().NVMLInitAttempts, err, interval)
+		time.Sleep(interval)
+		if interval *= 2; interval > maxNVMLInitInterval {
+			interval = maxNVMLInitInterval
+		}
+	}
+}
+
+// initNVMLOnce initializes NVML and returns the GPUs, shutting NVML down again on failure
+func initNVMLOnce() ([]nvidia.GPUDevice, error) {
+	if err := nvidia.Init(); err != nil {
+		return nil, err
+	}
+
+	gpus, err := nvidia.GetGPUDevices()
+	if err != nil {
+		nvidia.Shutdown()
+		return nil, fmt.Errorf("failed to get GPU devices: %v", err)
+	}
+	if len(gpus) == 0 {
+		nvidia.Shutdown()
+		return nil, fmt.Errorf("no NVIDIA GPUs found")
+	}
+
+	return gpus, nil
+}
+
+// resolveHostname falls back to the system hostname if none is configured and applies
+// the hostname pattern
+func resolveHostname(c *config.Config) {
+	if c.Hostname == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			c.Hostname = hostname
+		} else {
+			log.Printf("Warning: Failed to get system hostname, using 'localhost': %v", err)
+			c.Hostname = "localhost"
+		}
+	}
+	c.Hostname = c.RewriteHostname(c.Hostname)
+}
+
+// filterGPUs applies the include/exclude configuration and logs the result
+func filterGPUs(gpus []nvidia.GPUDevice) []nvidia.GPUDevice {
+	hasIncludes := len(cfg().IncludeUUIDs) > 0 || len(cfg().IncludeIndexes) > 0
+
+	var selected []nvidia.GPUDevice
+	for _, gpu := range gpus {
+		included := !hasIncludes || matchesGPU(gpu, cfg().IncludeUUIDs, cfg().IncludeIndexes)
+		excluded := matchesGPU(gpu, cfg().ExcludeUUIDs, cfg().ExcludeIndexes)
+
+		if included && !excluded {
+			log.Printf("GPU %d: %s (%s) included", gpu.Index, gpu.Name, gpu.UUID)
+			selected = append(selected, gpu)
+		} else {
+			log.Printf("GPU %d: %s (%s) excluded", gpu.Index, gpu.Name, gpu.UUID)
+		}
 	}
 
-	opts.SetUsername(cfg.MQTTUsername)
-	opts.SetPassword(cfg.MQTTPassword)
+	return selected
+}
+
+// matchesGPU reports whether gpu matches any of the UUIDs (full or short form) or indexes
+func matchesGPU(gpu nvidia.GPUDevice, uuids []string, indexes []int) bool {
+	for _, uuid := range uuids {
+		if strings.EqualFold(uuid, gpu.UUID) || strings.EqualFold(uuid, nvidia.GetShortUUID(gpu.UUID)) {
+			return true
+		}
+	}
+	for _, index := range indexes {
+		if index == gpu.Index {
+			return true
+		}
+	}
+	return false
+}
+
+// setupMQTTClients connects to the main broker and returns its client followed by the
+// clients of the mirror brokers. Only the main broker has to be reachable on startup, the
+// mirror brokers keep connecting in the background and are skipped until they are connected.
+func setupMQTTClients() []mqtt.Client {
+	clientID := mqttClientID(cfg().MQTTClientID, cfg().MQTTClientIDSuffix)
+	log.Printf("MQTT client ID: %s", clientID)
+
+	client := newMQTTClient(mqttClientOptions(cfg(), clientID), "MQTT broker")
+	clients := []mqtt.Client{client}
+	for _, broker := range cfg().MirrorBrokers {
+		opts, err := mirrorClientOptions(cfg(), broker, clientID)
+		if err != nil {
+			log.Fatal("Failed to configure mirror broker:", err)
+		}
+		clients = append(clients, newMQTTClient(opts, "mirror MQTT broker "+broker.URL))
+	}
+
+	// In dry-run mode nothing is published, so a reachable broker is not required
+	if cfg().DryRun {
+		log.Println("Dry run: skipping connection to MQTT broker")
+		return clients
+	}
+
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatal("Failed to connect to MQTT broker:", token.Error())
+	}
+	// With connect retry the token only completes once connected, so it is not waited for
+	for _, mirror := range clients[1:] {
+		mirror.Connect()
+	}
+
+	return clients
+}
+
+// newMQTTClient creates a client that publishes the availability and restores the command
+// subscriptions whenever it connects. name is the broker in connection logs.
+func newMQTTClient(opts *mqtt.ClientOptions, name string) mqtt.Client {
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(10 * time.Second)
+	opts.SetConnectRetryInterval(time.Duration(cfg().MQTTConnectRetryInterval) * time.Second)
+	// Command handlers publish states and call NVML, which may block. With ordered delivery
+	// they would run on the paho router and stall every other incoming message.
+	opts.SetOrderMatters(false)
+	// Protocol version 3 is left to paho, which tries MQTT 3.1.1 and falls back to 3.1
 
-	if cfg.MQTTLWTEnable {
-		opts.SetWill("homeassistant/sensor/nvml-gpu-ha/availability", "offline", 1, cfg.MQTTRetain)
+	if cfg().MQTTLWTEnable {
+		opts.SetWill(cfg().AvailabilityTopic, cfg().PayloadNotAvailable, 1, cfg().RetainAvailability())
 	}
 
+	var connectedBefore atomic.Bool
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		log.Println("Connected to MQTT broker")
-		if cfg.MQTTLWTEnable {
-			client.Publish("homeassistant/sensor/nvml-gpu-ha/availability", 1, cfg.MQTTRetain, "online")
+		log.Printf("Connected to %s using %s", name, mqttProtocolName(client))
+		firstConnect := !connectedBefore.Swap(true)
+		if cfg().MQTTLWTEnable {
+			// A non-retained "online" would leave a payload retained earlier on the broker
+			if !cfg().RetainAvailability() {
+				client.Publish(cfg().AvailabilityTopic, 1, true, "")
+			}
+			client.Publish(cfg().AvailabilityTopic, 1, cfg().RetainAvailability(), cfg().PayloadAvailable)
+		}
+
+		// The broker may have lost the states while disconnected, so all are published again
+		if changes != nil {
+			changes.reset()
+		}
+
+		// A restarted broker may have lost the retained discovery configs, and a mirror broker
+		// connecting late never got them. The main loop republishes them, since it owns the
+		// GPU handles; the first connect of the main broker has no manager yet.
+		if (cfg().RediscoverOnReconnect || firstConnect) && haManagerRef.Load() != nil {
+			select {
+			case reconnected <- struct{}{}:
+			default:
+			}
+		}
+
+		// Subscriptions do not survive a reconnect with a clean session
+		if haManager := haManagerRef.Load(); haManager != nil {
+			haManager.Resubscribe(client)
 		}
 	})
 
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		log.Printf("Connection lost to MQTT broker: %v", err)
+		log.Printf("Connection lost to %s: %v", name, err)
 	})
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal("Failed to connect to MQTT broker:", token.Error())
+	return mqtt.NewClient(opts)
+}
+
+// mqttClientOptions returns the broker and credential options of c shared by the
+// service and the test-mqtt command
+func mqttClientOptions(c *config.Config, clientID string) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	// paho tries the brokers in order and fails over between them on reconnect
+	for _, broker := range c.MQTTBrokers() {
+		opts.AddBroker(broker)
 	}
+	opts.SetClientID(clientID)
+	opts.SetUsername(c.Username())
+	opts.SetPassword(c.MQTTPassword)
+	opts.SetKeepAlive(time.Duration(c.MQTTKeepAlive) * time.Second)
+	return opts
+}
+
+// registerDiscovery publishes the discovery configs of all GPUs and the host device.
+// Publishing them again is idempotent, so this is also used to restore lost configs.
+func registerDiscovery(haManager *homeassistant.Manager, gpus []nvidia.GPUDevice) {
+	for _, gpu := range gpus {
+		if err := haManager.RegisterGPUSensors(gpu, cfg().Hostname); err != nil {
+			log.Printf("Failed to register sensors for GPU %s: %v", gpu.Name, err)
+		}
+		if err := haManager.PublishGPUAvailability(gpu, !isGPUUnavailable(gpu)); err != nil {
+			log.Printf("Failed to publish availability of GPU %s: %v", gpu.Name, err)
+		}
+	}
+	if err := haManager.RegisterHostSensors(cfg().Hostname); err != nil {
+		log.Printf("Failed to register host sensors: %v", err)
+	}
+}
+
+// mqttClientID returns the client ID for base (default "nvml-gpu-ha"),
+// with a random suffix appended to avoid conflicts when randomSuffix is set
+func mqttClientID(base string, randomSuffix bool) string {
+	if base == "" {
+		base = "nvml-gpu-ha"
+	}
+	if !randomSuffix {
+		return base
+	}
+
+	randomBytes := make([]byte, 3)
+	if _, err := rand.Read(randomBytes); err == nil {
+		return fmt.Sprintf("%s-%s", base, hex.EncodeToString(randomBytes))
+	}
+	// Fallback to timestamp if random generation fails
+	return fmt.Sprintf("%s-%d", base, time.Now().Unix())
+}
 
-	return client
+// mqttProtocolName returns the protocol version negotiated by a connected client
+func mqttProtocolName(client mqtt.Client) string {
+	options := client.OptionsReader()
+	switch options.ProtocolVersion() {
+	case 3:
+		return "MQTT 3.1"
+	case 4:
+		return "MQTT 3.1.1"
+	default:
+		return fmt.Sprintf("MQTT protocol %d", options.ProtocolVersion())
+	}
 }
 
-func monitorGPUs(client mqtt.Client, gpus []nvidia.GPUDevice) {
+// monitorGPUs runs one monitoring cycle and returns the number of GPUs whose metrics failed.
+// A manual dump cycle bypasses the too-soon check and logs the full metrics of every GPU.
+func monitorGPUs(clients []mqtt.Client, gpus []nvidia.GPUDevice, dump bool) int {
 	// Prevent overlapping monitoring requests
 	monitoringMutex.Lock()
 	defer monitoringMutex.Unlock()
 
 	if isMonitoring {
 		log.Printf("Previous monitoring request still in progress, skipping this cycle")
-		return
+		stats.skippedCyclesTotal.Add(1)
+		return 0
 	}
 
 	// Check if enough time has passed since last monitoring
-	if time.Since(lastMonitorTime) < time.Duration(cfg.PollingPeriod/2)*time.Second {
+	if !dump && time.Since(lastMonitorTime) < time.Duration(cfg().PollingPeriod/2)*time.Second {
 		log.Printf("Too soon since last monitoring, skipping this cycle")
-		return
+		stats.skippedCyclesTotal.Add(1)
+		return 0
 	}
 
 	isMonitoring = true
 	defer func() {
 		isMonitoring = false
-		lastMonitorTime = time.Now()
+		// A manual dump must not make the next regular cycle too soon
+		if !dump {
+			lastMonitorTime = time.Now()
+		}
+		lastCycleEnd.Store(time.Now().UnixNano())
 	}()
 
 	log.Printf("Starting GPU monitoring cycle...")
 	startTime := time.Now()
 
+	// Aggregates over the GPUs that reported successfully this cycle
+	var totalsMutex sync.Mutex
+	var totalPowerDraw float64
+	var failed int
+	var results []grpcapi.Result
+
+	// Limits the GPUs read at the same time, spreading the NVML load over the cycle
+	concurrency := cfg().MaxConcurrentPolls
+	if concurrency <= 0 || concurrency > len(gpus) {
+		concurrency = len(gpus)
+	}
+	slots := make(chan struct{}, concurrency)
+
 	var wg sync.WaitGroup
-	for _, gpu := range gpus {
+	for i := range gpus {
 		wg.Add(1)
-		go func(gpu nvidia.GPUDevice) {
+		go func(i int) {
 			defer wg.Done()
 
-			metrics, err := nvidia.GetGPUMetrics(gpu)
+			// Only the NVML read holds a slot, publishing does not touch NVML.
+			// A lost GPU that was reset gets a new handle, which later cycles use as well.
+			slots <- struct{}{}
+			metrics, err := readGPUMetrics(&gpus[i])
+			<-slots
+			gpu := gpus[i]
+
+			// A partial read still publishes every metric that could be read
+			var partial *nvidia.PartialMetricsError
+			if errors.As(err, &partial) {
+				stats.nvmlErrorsTotal.Add(1)
+				log.Printf("Partial metrics for GPU %s (%s): %v", gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID), err)
+				totalsMutex.Lock()
+				failed++
+				totalsMutex.Unlock()
+				err = nil
+			}
+
+			// The gRPC API gets the raw readings, like the CSV output
+			if grpcServer != nil {
+				totalsMutex.Lock()
+				results = append(results, grpcapi.Result{Device: gpu, Metrics: metrics, Err: err})
+				totalsMutex.Unlock()
+			}
+
+			failures := recordMetricsResult(gpu, err)
+			updateGPUAvailability(gpu, failures)
 			if err != nil {
-				log.Printf("Failed to get metrics for GPU %s: %v", gpu.Name, err)
+				stats.nvmlErrorsTotal.Add(1)
+				log.Printf("Failed to get metrics for GPU %s (%s), failing for %d consecutive cycle(s): %v",
+					gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID), failures, err)
+				totalsMutex.Lock()
+				failed++
+				totalsMutex.Unlock()
 				return
 			}
 
-			publishMetrics(client, gpu, metrics)
-		}(gpu)
+			if dump {
+				log.Printf("GPU %s (%s) metrics: %+v", gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID), metrics)
+			}
+
+			if !metrics.Failed["power_draw"] {
+				totalsMutex.Lock()
+				totalPowerDraw += metrics.PowerDraw
+				totalsMutex.Unlock()
+			}
+
+			if events != nil {
+				reportEvents(clients, gpu, metrics)
+			}
+
+			// Raw readings, written whether or not publishing to MQTT succeeds
+			if csvOutput != nil {
+				if err := csvOutput.write(gpu, metrics); err != nil {
+					log.Printf("Failed to write CSV output for GPU %s: %v", gpu.Name, err)
+				}
+			}
+
+			// Statistics use the raw readings, so peaks are not averaged away
+			if statsTracker != nil {
+				statsTracker.add(gpu, metrics)
+			}
+
+			// Peaks or averages of the samples between the cycles replace the cycle's reading
+			if sampler != nil {
+				metrics = sampler.aggregate(gpu, metrics)
+			}
+
+			metrics = smoother.smooth(gpu, metrics)
+			publishMetrics(clients, gpu, metrics)
+		}(i)
 	}
 
 	wg.Wait()
+	publishHostMetrics(clients, len(gpus), totalPowerDraw)
+	if !cfg().RetainAvailability() {
+		refreshAvailability(gpus)
+	}
+	if grpcServer != nil {
+		grpcServer.PublishCycle(startTime, results)
+	}
+
 	duration := time.Since(startTime)
+	stats.cyclesTotal.Add(1)
+	stats.lastCycleDuration.Store(int64(duration))
 	log.Printf("GPU monitoring cycle completed in %v", duration)
+	return failed
 }
 
-func publishMetrics(client mqtt.Client, gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) {
+// recordMetricsResult tracks consecutive metric failures for a GPU and returns the current count
+func recordMetricsResult(gpu nvidia.GPUDevice, err error) int {
+	failureMutex.Lock()
+	defer failureMutex.Unlock()
+
+	deviceID := nvidia.GetDeviceID(gpu)
+	if err == nil {
+		if failureCounts[deviceID] > 0 {
+			log.Printf("GPU %s recovered after %d failed cycle(s)", gpu.Name, failureCounts[deviceID])
+		}
+		delete(failureCounts, deviceID)
+		return 0
+	}
+
+	failureCounts[deviceID]++
+	return failureCounts[deviceID]
+}
+
+// updateBusyState returns whether a GPU is busy. It turns busy at busy_threshold and only
+// turns idle again below busy_off_threshold, so utilization hovering around a single
+// threshold does not make the binary sensor flap.
+func updateBusyState(gpu nvidia.GPUDevice, utilization int) bool {
+	busyMutex.Lock()
+	defer busyMutex.Unlock()
+
+	offThreshold := cfg().BusyOffThreshold
+	if offThreshold < 0 {
+		offThreshold = cfg().BusyThreshold
+	}
+
+	deviceID := nvidia.GetDeviceID(gpu)
+	busy := busyStates[deviceID]
+	if utilization >= cfg().BusyThreshold {
+		busy = true
+	} else if utilization < offThreshold {
+		busy = false
+	}
+	busyStates[deviceID] = busy
+	return busy
+}
+
+func publishMetrics(clients []mqtt.Client, gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) {
 	// Publish individual sensor values
 	sensors := map[string]interface{}{
-		"power_draw":        metrics.PowerDraw,
-		"performance_level": metrics.PerformanceLevel,
-		"memory_usage":      metrics.MemoryUsage,
-		"gpu_utilization":   metrics.GPUUtilization,
-		"temperature":       metrics.Temperature,
+		"power_draw":         metrics.PowerDraw,
+		"performance_level":  metrics.PerformanceLevel,
+		"memory_usage":       cfg().ConvertMemoryUsage(metrics.MemoryUsed, metrics.MemoryTotal),
+		"gpu_utilization":    metrics.GPUUtilization,
+		"temperature":        cfg().ConvertTemperature(metrics.Temperature),
+		"energy_consumption": metrics.TotalEnergyJoules / 3.6e6, // Convert J to kWh
+		"last_update":        metrics.Timestamp.Format(time.RFC3339),
+		"graphics_clock":     metrics.GraphicsClock,
+		"max_graphics_clock": metrics.MaxGraphicsClock,
+		"applications_clock": metrics.ApplicationsClock,
+		"video_clock":        metrics.VideoClock,
+
+		"pcie_link_gen":       metrics.PCIeLinkGen,
+		"max_pcie_link_gen":   metrics.MaxPCIeLinkGen,
+		"pcie_link_width":     metrics.PCIeLinkWidth,
+		"max_pcie_link_width": metrics.MaxPCIeLinkWidth,
+
+		"memory_bandwidth_util": metrics.MemoryBandwidthUtil,
+	}
+	if metrics.PerformanceState >= 0 {
+		sensors["performance_state_num"] = metrics.PerformanceState
+	}
+	if gpu.HasMemoryTemperature {
+		sensors["memory_temperature"] = cfg().ConvertTemperature(metrics.MemoryTemperature)
+	}
+	if gpu.HasBAR1 && metrics.Bar1Total > 0 {
+		sensors["bar1_usage"] = float64(metrics.Bar1Used) / float64(metrics.Bar1Total) * 100.0
+	}
+	if gpu.HasMemoryInfoV2 {
+		sensors["memory_reserved"] = float64(metrics.MemoryReserved) / (1024 * 1024)
+	}
+	if gpu.HasThrottleReasons {
+		sensors["throttle_reasons"] = "none"
+		if names := nvidia.ThrottleReasonNames(metrics.ThrottleReasons); len(names) > 0 {
+			sensors["throttle_reasons"] = strings.Join(names, ",")
+		}
+	}
+	if gpu.HasEncoderStats {
+		sensors["encoder_sessions"] = metrics.EncoderSessions
+		sensors["encoder_fps"] = metrics.EncoderFPS
+	}
+	if gpu.HasComputeMode {
+		sensors["compute_mode"] = metrics.ComputeMode
+	}
+	if gpu.HasPersistenceMode {
+		sensors["persistence_mode"] = "Disabled"
+		if metrics.PersistenceMode {
+			sensors["persistence_mode"] = "Enabled"
+		}
+	}
+	if len(gpu.NvLinks) > 0 {
+		sensors["nvlink_throughput"] = metrics.NvLinkThroughput
+		sensors["nvlink_state"] = metrics.NvLinkActiveLinks
+		sensors["nvlink_errors"] = metrics.NvLinkErrors
+	}
+	if gpu.HasClockOffsets {
+		sensors["clock_offset_core"] = metrics.CoreClockOffset
+		sensors["clock_offset_memory"] = metrics.MemoryClockOffset
+	}
+	if statsTracker != nil {
+		aggregates := statsTracker.aggregates(gpu)
+		if temperature, ok := aggregates["temperature"]; ok {
+			sensors["temperature_min"] = cfg().ConvertTemperature(int(temperature.min))
+			sensors["temperature_max"] = cfg().ConvertTemperature(int(temperature.max))
+			sensors["temperature_avg"] = cfg().ConvertTemperature(int(math.Round(temperature.avg)))
+		}
+		if power, ok := aggregates["power_draw"]; ok {
+			sensors["power_draw_min"] = power.min
+			sensors["power_draw_max"] = power.max
+			sensors["power_draw_avg"] = power.avg
+		}
 	}
 
 	deviceID := nvidia.GetDeviceID(gpu)
 
 	for sensor, value := range sensors {
-		topic := fmt.Sprintf("homeassistant/sensor/nvml-gpu/%s_%s/state", deviceID, sensor)
+		if !cfg().SensorEnabled(sensor) || !gpu.Supports(sensor) || metrics.Failed[sensor] {
+			continue
+		}
+		if restPublisher != nil {
+			if err := restPublisher.PublishState(deviceID, sensor, value); err != nil {
+				stats.publishFailuresTotal.Add(1)
+				log.Printf("Failed to publish %s data: %v", sensor, err)
+			}
+			continue
+		}
+		topic := homeassistant.StateTopic(cfg(), deviceID, sensor)
 
 		payload, err := json.Marshal(value)
 		if err != nil {
@@ -275,11 +924,103 @@ func publishMetrics(client mqtt.Client, gpu nvidia.GPUDevice, metrics nvidia.GPU
 			continue
 		}
 
-		token := client.Publish(topic, 1, cfg.MQTTRetain, payload)
-		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
-			log.Printf("Failed to publish %s data: %v", sensor, token.Error())
+		if err := publishChangedState(clients, topic, payload); err != nil {
+			stats.publishFailuresTotal.Add(1)
+			log.Printf("Failed to publish %s data: %v", sensor, err)
+		}
+	}
+
+	// Binary sensors: busy derived from utilization, throttling decoded from the throttle reasons
+	binarySensors := make(map[string]bool)
+	if !metrics.Failed["gpu_utilization"] {
+		binarySensors["busy"] = updateBusyState(gpu, metrics.GPUUtilization)
+	}
+	if gpu.HasThrottleReasons {
+		binarySensors["throttle_thermal"] = metrics.ThrottleReasons&nvidia.ThrottleReasonsThermal != 0
+		binarySensors["throttle_power"] = metrics.ThrottleReasons&nvidia.ThrottleReasonsPower != 0
+	}
+	if gpu.HasReliabilityViolations {
+		binarySensors["throttle_reliability"] = metrics.ReliabilityThrottled
+	}
+
+	for sensor, on := range binarySensors {
+		if !cfg().SensorEnabled(sensor) || !gpu.Supports(sensor) || metrics.Failed[sensor] {
+			continue
+		}
+		if restPublisher != nil {
+			if err := restPublisher.PublishState(deviceID, sensor, on); err != nil {
+				stats.publishFailuresTotal.Add(1)
+				log.Printf("Failed to publish %s state: %v", sensor, err)
+			}
+			continue
+		}
+		topic := homeassistant.BinarySensorStateTopic(cfg(), deviceID, sensor)
+
+		payload := "OFF"
+		if on {
+			payload = "ON"
+		}
+		if err := publishChangedState(clients, topic, []byte(payload)); err != nil {
+			stats.publishFailuresTotal.Add(1)
+			log.Printf("Failed to publish %s state: %v", sensor, err)
 		}
 	}
 
 	log.Printf("Published metrics for GPU: %s", gpu.Name)
 }
+
+// publishHostMetrics publishes the aggregate sensors of the host-level device
+func publishHostMetrics(clients []mqtt.Client, gpuCount int, totalPowerDraw float64) {
+	sensors := map[string]interface{}{
+		"gpu_count":        gpuCount,
+		"total_power_draw": totalPowerDraw,
+	}
+
+	// Versions change on driver updates, which HA automations can notify about
+	if driverVersion, err := nvidia.GetDriverVersion(); err == nil {
+		sensors["driver_version"] = driverVersion
+	}
+	if nvmlVersion, err := nvidia.GetNVMLVersion(); err == nil {
+		sensors["nvml_version"] = nvmlVersion
+	}
+
+	deviceID := homeassistant.HostDeviceID(cfg().Hostname)
+
+	for sensor, value := range sensors {
+		if !cfg().SensorEnabled(sensor) {
+			continue
+		}
+		if restPublisher != nil {
+			if err := restPublisher.PublishState(deviceID, sensor, value); err != nil {
+				stats.publishFailuresTotal.Add(1)
+				log.Printf("Failed to publish %s data: %v", sensor, err)
+			}
+			continue
+		}
+		topic := homeassistant.StateTopic(cfg(), deviceID, sensor)
+
+		payload, err := json.Marshal(value)
+		if err != nil {
+			log.Printf("Failed to marshal sensor data for %s: %v", sensor, err)
+			continue
+		}
+
+		if err := publishState(clients, topic, payload); err != nil {
+			stats.publishFailuresTotal.Add(1)
+			log.Printf("Failed to publish %s data: %v", sensor, err)
+		}
+	}
+}
+
+// publishState publishes a state payload to all brokers, or only logs it in dry-run mode
+func publishState(clients []mqtt.Client, topic string, payload []byte) error {
+	if cfg().DryRun {
+		log.Printf("[dry-run] %s: %s", topic, payload)
+		return nil
+	}
+
+	if err := homeassistant.Publish(clients, topic, byte(cfg().StateQoS), cfg().RetainState(), payload, cfg().PublishTimeout()); err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", topic, err)
+	}
+	return nil
+}
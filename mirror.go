@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+)
+
+// mirrorClientOptions returns the options of a mirror broker with its own credentials and
+// TLS settings. The client ID, keepalive and Last Will are the same as for the main broker.
+func mirrorClientOptions(c *config.Config, broker config.MirrorBroker, clientID string) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker.URL)
+	opts.SetClientID(clientID)
+	opts.SetUsername(c.MirrorUsername(broker))
+	opts.SetPassword(broker.Password)
+	opts.SetKeepAlive(time.Duration(c.MQTTKeepAlive) * time.Second)
+
+	if broker.CAFile != "" || broker.CertFile != "" || broker.InsecureSkipVerify {
+		tlsConfig, err := mirrorTLSConfig(broker)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, nil
+}
+
+// mirrorTLSConfig loads the CA and client certificate of a mirror broker
+func mirrorTLSConfig(broker config.MirrorBroker) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: broker.InsecureSkipVerify}
+
+	if broker.CAFile != "" {
+		pem, err := os.ReadFile(broker.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file of %s: %v", broker.URL, err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA file %s of %s", broker.CAFile, broker.URL)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if broker.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(broker.CertFile, broker.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate of %s: %v", broker.URL, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
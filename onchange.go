@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// publishedState is the last payload published to a state topic
+type publishedState struct {
+	payload   []byte
+	timestamp time.Time
+}
+
+// changeTracker remembers the published state payloads to skip unchanged values
+type changeTracker struct {
+	mutex sync.Mutex
+	// maxInterval republishes unchanged values after this long as a heartbeat (0 never does)
+	maxInterval time.Duration
+	published   map[string]publishedState
+}
+
+func newChangeTracker(maxInterval time.Duration) *changeTracker {
+	return &changeTracker{
+		maxInterval: maxInterval,
+		published:   make(map[string]publishedState),
+	}
+}
+
+// changed reports whether payload differs from the last one published to topic, or the
+// heartbeat interval elapsed since then
+func (t *changeTracker) changed(topic string, payload []byte) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	previous, ok := t.published[topic]
+	if !ok || !bytes.Equal(previous.payload, payload) {
+		return true
+	}
+	return t.maxInterval > 0 && time.Since(previous.timestamp) >= t.maxInterval
+}
+
+// record stores payload as the last one published to topic
+func (t *changeTracker) record(topic string, payload []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.published[topic] = publishedState{payload: payload, timestamp: time.Now()}
+}
+
+// reset forgets all published payloads, so every value is published again in the next cycle
+func (t *changeTracker) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.published = make(map[string]publishedState)
+}
+
+// publishChangedState publishes a state payload unless publish_on_change is enabled and the
+// topic already holds the same payload. Failed publishes are not recorded, so they are retried.
+func publishChangedState(clients []mqtt.Client, topic string, payload []byte) error {
+	if changes == nil {
+		return publishState(clients, topic, payload)
+	}
+	if !changes.changed(topic, payload) {
+		stats.unchangedTotal.Add(1)
+		return nil
+	}
+	if err := publishState(clients, topic, payload); err != nil {
+		return err
+	}
+	changes.record(topic, payload)
+	return nil
+}
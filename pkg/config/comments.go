@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+)
+
+// fieldDoc documents a config field in generated config files
+type fieldDoc struct {
+	comment string
+	// example is written commented out when the field has no value (e.g. empty lists)
+	example string
+}
+
+// fieldDocs maps TOML keys to their documentation. New config fields should be added here.
+var fieldDocs = map[string]fieldDoc{
+	"hostname":              {comment: "Hostname prefix for GPU names (empty uses the system hostname)"},
+	"mqtt_host":             {comment: "MQTT broker host"},
+	"mqtt_port":             {comment: "MQTT broker port"},
+	"mqtt_username":         {comment: "MQTT username (empty for anonymous access), %HOSTNAME% is replaced by the hostname"},
+	"mqtt_password":         {comment: "MQTT password"},
+	"output":                {comment: "Where states are sent: \"mqtt\" (with discovery) or \"rest\" (Home Assistant REST API, without a broker)"},
+	"ha_url":                {comment: "Home Assistant URL for output = \"rest\", e.g. \"http://homeassistant.local:8123\""},
+	"ha_token":              {comment: "Home Assistant long-lived access token for output = \"rest\""},
+	"mqtt_lwt_enable":       {comment: "Publish an availability topic with a Last Will and Testament"},
+	"mqtt_retain":           {comment: "Retain discovery configs and states on the broker"},
+	"discovery_retain":      {comment: "Retain discovery configs (requires mqtt_retain)"},
+	"state_retain":          {comment: "Retain sensor states, disable to keep changing values off the broker (requires mqtt_retain)"},
+	"discovery_qos":         {comment: "MQTT QoS (0-2) of the discovery configs"},
+	"state_qos":             {comment: "MQTT QoS (0-2) of the sensor states, e.g. 0 for throughput on a constrained broker"},
+	"discovery_concurrency": {comment: "Publish at most N discovery messages per broker at a time, to avoid flooding a small broker at startup (0 for no limit)"},
+	"availability_retain":   {comment: "Retain availability payloads and the Last Will, disable to rely on the Last Will alone (requires mqtt_retain)"},
+	"availability_topic":    {comment: "Availability topic of the Last Will, declared by every discovery config"},
+	"payload_available":     {comment: "Availability payload published while the service is running"},
+	"payload_not_available": {comment: "Availability payload for the Last Will, published when the service goes away"},
+	"polling_period":        {comment: "GPU polling period in seconds"},
+	"dry_run":               {comment: "Log topics and payloads instead of publishing them (no broker connection)"},
+	"nvml_timeout_seconds":  {comment: "Timeout in seconds for reading metrics from a GPU"},
+	"nvml_init_attempts":    {comment: "NVML initialization attempts while the NVIDIA driver is still loading at boot"},
+	"nvml_init_interval":    {comment: "Initial delay in seconds between NVML initialization attempts, doubled after each attempt"},
+	"watchdog_periods":      {comment: "Exit with a non-zero code when no monitoring cycle finished for N polling periods, so systemd or Docker restarts a hung service (0 disables it)"},
+	"max_concurrent_polls":  {comment: "Read at most N GPUs at the same time per cycle, to spread the NVML load on hosts with many GPUs (0 reads all at once)"},
+	"utilization_source":    {comment: "GPU utilization source: \"instant\" (current value), \"samples\" (average of the driver samples since the last poll) or \"process\" (summed per-process utilization)"},
+	"sample_interval":       {comment: "Sample the sampled_metrics every N seconds between polls, so short spikes are not missed (0 reads them once per polling period)"},
+	"sample_aggregation":    {comment: "Published value of the samples between two polls: \"max\" (peaks) or \"avg\""},
+	"sampled_metrics":       {comment: "Metrics sampled every sample_interval: gpu_utilization, temperature, power_draw"},
+	"utilization_samples":   {comment: "Moving average over the last N polls for GPU utilization (1 = no smoothing)"},
+	"smooth_temperature":    {comment: "Also average temperature over the utilization sample window"},
+	"busy_threshold":        {comment: "GPU utilization percentage at which the \"GPU Busy\" binary sensor turns on"},
+	"busy_off_threshold":    {comment: "GPU utilization percentage below which \"GPU Busy\" turns off again, for hysteresis (-1 uses busy_threshold)"},
+	"metrics_listen":        {comment: "Address to serve service metrics on /metrics, e.g. \":9400\" (empty disables it)"},
+	"grpc_listen":           {comment: "Address of the gRPC metrics API, e.g. \":9401\" (empty disables it)"},
+	"device_name_template":  {comment: "Go template for Home Assistant device names, e.g. \"{{.Hostname}}-gpu{{.Index}}\"\nFields: .Hostname .Index .Name .Model .PCIID .UUID .VRAMGB (empty uses the default format)"},
+	"device_names":          {comment: "Device name overrides keyed by full UUID, short 8-character UUID or NVML index", example: `{ "0" = "Render GPU", "gpu1a2b3" = "Training GPU" }`},
+	"include_uuids":         {comment: "Only monitor GPUs with these UUIDs (full or short 8-character form)", example: `["GPU-1a2b3c4d-0000-0000-0000-000000000000"]`},
+	"exclude_uuids":         {comment: "Do not monitor GPUs with these UUIDs (full or short 8-character form)", example: `["gpu1a2b3"]`},
+	"include_indexes":       {comment: "Only monitor GPUs with these NVML indexes", example: "[0, 2]"},
+	"exclude_indexes":       {comment: "Do not monitor GPUs with these NVML indexes", example: "[1]"},
+	"enabled_sensors":       {comment: "Only publish these sensors, by key (empty publishes all)", example: `["power_draw", "temperature", "gpu_utilization", "busy"]`},
+	"disabled_sensors":      {comment: "Do not publish these sensors, by key; they are removed from Home Assistant on startup", example: `["performance_level"]`},
+	"cleanup_on_exit":       {comment: "Remove the Home Assistant entities of all GPUs on shutdown (e.g. when decommissioning)"},
+	"mqtt_client_id":        {comment: "Base MQTT client ID to identify this host in broker logs (empty uses \"nvml-gpu-ha\")"},
+	"mqtt_client_id_suffix": {comment: "Append a random suffix to the client ID; IDs must be unique per broker when disabled"},
+	"default_precision":     {comment: "Round numeric sensors to this many decimals (-1 keeps the built-in rounding)"},
+	"sensor_precision":      {comment: "Per-sensor decimals, overriding default_precision", example: "{ power_draw = 0, temperature = 0, memory_usage = 1 }"},
+	"sensor_overrides":      {comment: "Per-sensor icon, device_class and unit replacing the built-in ones", example: `{ temperature = { icon = "mdi:thermometer-high" } }`},
+	"log_events":            {comment: "Log performance level and throttle reason changes between cycles"},
+	"publish_events":        {comment: "Also publish state changes to homeassistant/sensor/nvml-gpu/{DEVICEID}/events (implies log_events)"},
+	"rediscovery_interval":  {comment: "Republish discovery configs every N seconds, e.g. 3600, to restore them after the broker lost retained messages (0 disables it)"},
+	"fan_control":           {comment: "Allow setting GPU fan speeds from Home Assistant (requires root)"},
+	"mqtt_url":              {comment: "Full broker URL used instead of mqtt_host/mqtt_port, e.g. \"unix:///run/mosquitto.sock\" or \"ws://host:9001/mqtt\"", example: `"unix:///run/mosquitto.sock"`},
+	"state_topic_template":  {comment: "Go template for sensor and binary sensor state topics with the fields .Component, .NodeID, .DeviceID and .Sensor; discovery configs declare the same topic"},
+	"discovery_node_id":     {comment: "Node ID segment of all topics (homeassistant/<component>/<node_id>/...), e.g. per tenant on a shared broker (letters, digits, _ and -)"},
+	"device_id_strategy":    {comment: "Device ID in topics and unique IDs: \"pci\" (PCI ID and short UUID), \"uuid\" (follows the card across PCI slots) or \"pci_uuid\".\nChanging it creates new entities, remove the old ones first (see cleanup_on_exit)"},
+	"temperature_unit":      {comment: "Unit of published temperatures: \"C\" or \"F\" (ha-gpu-ccd needs the matching --temperature-unit)"},
+	"memory_usage_unit":     {comment: "Unit of the VRAM usage sensor: \"%\", or \"B\", \"MiB\" or \"GiB\" for the used VRAM as a data size"},
+	"csv_output":            {comment: "Append the metrics of every GPU and cycle to this CSV file, e.g. \"/var/log/nvml-gpu-ha.csv\" (empty disables it)"},
+	"csv_max_size":          {comment: "Rotate the CSV file to <csv_output>.1 once it reaches this size in MiB (0 never rotates)"},
+	"stats_window":          {comment: "Publish min/max/avg temperature and power draw over a rolling window such as \"1h\", or \"daily\" since local midnight (empty disables them)"},
+	"via_device":            {comment: "Identifier of the Home Assistant device to nest the GPU devices under, or \"host\" for the host-level device of this service (empty disables it)"},
+	"host_connections":      {comment: "Connections of the host-level device as \"type:value\", so Home Assistant merges it with the host from other integrations", example: `["mac:00:11:22:33:44:55"]`},
+	"hostname_pattern":      {comment: "Regular expression replaced by hostname_replacement in the hostname before it is used in device names,\ne.g. \"^gpu-(node-\\\\d+)\\\\..*$\" with \"$1\" or \"\\\\..*$\" with \"\" to strip the domain (empty disables it)"},
+	"hostname_replacement":  {comment: "Replacement for hostname_pattern matches, $1 etc. refer to the groups of the pattern"},
+	"publish_on_change":     {comment: "Only publish sensor values that changed since the last cycle, to reduce broker traffic and recorder writes"},
+	"publish_max_interval":  {comment: "With publish_on_change, republish unchanged values after this many seconds as a heartbeat (0 never does)"},
+	"force_update":          {comment: "Let Home Assistant record every received state, even an unchanged one (heartbeats then also create history rows)"},
+	"mqtt_hosts":            {comment: "Additional brokers for failover (\"host\", \"host:port\" or \"scheme://host:port\")", example: `["mqtt1.local", "mqtt2.local:1884"]`},
+	"mirror_brokers":        {comment: "Independent brokers that also receive every message, each with url, username, password and\nthe TLS settings ca_file, cert_file, key_file and insecure_skip_verify", example: `[{ url = "ssl://lab-broker:8883", username = "gpu", password = "secret", ca_file = "/etc/ssl/lab-ca.pem" }]`},
+
+	"mqtt_keepalive_seconds":              {comment: "MQTT keepalive interval in seconds, lower it for brokers behind load balancers that drop idle connections (0 disables it)"},
+	"mqtt_connect_retry_interval_seconds": {comment: "Delay in seconds between attempts to connect to the MQTT broker"},
+	"mqtt_publish_timeout_seconds":        {comment: "Timeout in seconds for the broker to confirm a publish, raise it on high-latency links"},
+	"rediscover_on_reconnect":             {comment: "Republish discovery configs after every reconnect to the broker, disable it for brokers that persist retained messages"},
+	"unavailable_after_failures":          {comment: "Consecutive failed cycles after which a GPU is marked unavailable (1 marks it on the first failure)"},
+}
+
+// writeCommented writes the config as TOML with a comment above every field.
+// Empty lists and maps are written as commented-out examples.
+func (c *Config) writeCommented(w io.Writer) error {
+	var body, tables bytes.Buffer
+
+	fmt.Fprintln(&body, "# NVML GPU Home Assistant Monitor Configuration File")
+	fmt.Fprintf(&body, "# Every key can also be set with an %s<KEY> environment variable\n", EnvPrefix)
+	fmt.Fprintln(&body, "# (mirror_brokers and sensor_overrides take an inline TOML value)")
+	fmt.Fprintln(&body)
+
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if key == "" {
+			continue
+		}
+		field := v.Field(i)
+		doc := fieldDocs[key]
+
+		out := &body
+		if field.Kind() == reflect.Map || (field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct) {
+			// Tables and arrays of tables have to follow all top-level keys
+			out = &tables
+		}
+
+		if doc.comment != "" {
+			fmt.Fprintf(out, "# %s\n", bytes.ReplaceAll([]byte(doc.comment), []byte("\n"), []byte("\n# ")))
+		}
+
+		if (field.Kind() == reflect.Slice || field.Kind() == reflect.Map) && field.Len() == 0 {
+			if doc.example != "" {
+				fmt.Fprintf(out, "# %s = %s\n", key, doc.example)
+			}
+			fmt.Fprintln(out)
+			continue
+		}
+
+		if err := toml.NewEncoder(out).Encode(map[string]interface{}{key: field.Interface()}); err != nil {
+			return fmt.Errorf("failed to encode %s: %v", key, err)
+		}
+		fmt.Fprintln(out)
+	}
+
+	if _, err := body.WriteTo(w); err != nil {
+		return err
+	}
+	_, err := tables.WriteTo(w)
+	return err
+}
@@ -2,13 +2,29 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/spf13/cobra"
 )
 
-// Config holds all configuration values
+// EnvPrefix is the prefix of environment variables overriding config fields
+const EnvPrefix = "NVML_GPU_HA_"
+
+// Config holds all configuration values.
+//
+// Every field can be overridden by an environment variable named EnvPrefix plus
+// its TOML key in upper case, e.g. NVML_GPU_HA_MQTT_HOST or NVML_GPU_HA_POLLING_PERIOD.
+// List fields take a comma-separated value, map fields comma-separated key=value pairs.
+// Lists and maps of tables (mirror_brokers, sensor_overrides) take an inline TOML value.
 type Config struct {
 	Hostname      string `toml:"hostname"`
 	MQTTHost      string `toml:"mqtt_host"`
@@ -18,6 +34,241 @@ type Config struct {
 	MQTTLWTEnable bool   `toml:"mqtt_lwt_enable"`
 	MQTTRetain    bool   `toml:"mqtt_retain"`
 	PollingPeriod int    `toml:"polling_period"`
+	DryRun        bool   `toml:"dry_run"`
+	NVMLTimeout   int    `toml:"nvml_timeout_seconds"`
+
+	// MQTTPublishTimeout is how long to wait in seconds for the broker to confirm a publish
+	MQTTPublishTimeout int `toml:"mqtt_publish_timeout_seconds"`
+
+	// Output selects where states are sent: "mqtt" (with discovery) or "rest", which posts
+	// them to the Home Assistant REST API at HAURL with the long-lived access token HAToken
+	Output  string `toml:"output"`
+	HAURL   string `toml:"ha_url"`
+	HAToken string `toml:"ha_token"`
+
+	// DiscoveryRetain retains the discovery configs, StateRetain the sensor states, e.g. off
+	// to keep the broker from storing constantly-changing values, and AvailabilityRetain the
+	// availability payloads and the Last Will. All only apply while mqtt_retain is enabled.
+	DiscoveryRetain    bool `toml:"discovery_retain"`
+	StateRetain        bool `toml:"state_retain"`
+	AvailabilityRetain bool `toml:"availability_retain"`
+
+	// DiscoveryQoS is the MQTT QoS of the discovery configs, StateQoS the one of the sensor
+	// states, e.g. 0 for throughput on a constrained broker. Availability stays at QoS 1.
+	DiscoveryQoS int `toml:"discovery_qos"`
+	StateQoS     int `toml:"state_qos"`
+
+	// DiscoveryConcurrency limits how many discovery messages await the confirmation of a
+	// broker at the same time, to spread the startup burst on a small broker (0 for no limit)
+	DiscoveryConcurrency int `toml:"discovery_concurrency"`
+
+	// Availability topic and payloads, used by the discovery configs, the Last Will
+	// and the availability publishes alike
+	AvailabilityTopic   string `toml:"availability_topic"`
+	PayloadAvailable    string `toml:"payload_available"`
+	PayloadNotAvailable string `toml:"payload_not_available"`
+
+	// NVML initialization is retried while the driver is not loaded yet, with the
+	// interval (seconds) doubling after each failed attempt
+	NVMLInitAttempts int `toml:"nvml_init_attempts"`
+	NVMLInitInterval int `toml:"nvml_init_interval"`
+
+	// MaxConcurrentPolls limits how many GPUs are read at the same time per cycle (0 reads all at once)
+	MaxConcurrentPolls int `toml:"max_concurrent_polls"`
+
+	// UnavailableAfterFailures is the number of consecutive failed cycles after which a GPU
+	// is marked unavailable in Home Assistant, so a single failed read raises no alarm
+	UnavailableAfterFailures int `toml:"unavailable_after_failures"`
+
+	// WatchdogPeriods exits the process when no monitoring cycle finished for this many
+	// polling periods, so that a service manager restarts it (0 disables the watchdog)
+	WatchdogPeriods int `toml:"watchdog_periods"`
+
+	// UtilizationSource selects how GPU utilization is read: "instant" (the driver's current
+	// value), "samples" (average of the driver samples since the previous poll) or "process"
+	// (summed utilization of the processes since the previous poll)
+	UtilizationSource string `toml:"utilization_source"`
+
+	// SampleInterval samples the SampledMetrics every this many seconds between two polls and
+	// publishes their SampleAggregation ("max" or "avg"), so short spikes are not missed
+	// (0 only reads them once per polling period)
+	SampleInterval    int      `toml:"sample_interval"`
+	SampleAggregation string   `toml:"sample_aggregation"`
+	SampledMetrics    []string `toml:"sampled_metrics"`
+
+	// UtilizationSamples is the moving-average window for GPU utilization (1 disables smoothing)
+	UtilizationSamples int  `toml:"utilization_samples"`
+	SmoothTemperature  bool `toml:"smooth_temperature"`
+
+	// BusyThreshold is the GPU utilization percentage at which the busy binary sensor turns on
+	BusyThreshold int `toml:"busy_threshold"`
+
+	// BusyOffThreshold is the utilization percentage below which the busy binary sensor turns
+	// off again. Values between both thresholds keep the previous state. -1 uses busy_threshold.
+	BusyOffThreshold int `toml:"busy_off_threshold"`
+
+	// MetricsListen is the address for the service's own /metrics endpoint (empty disables it)
+	MetricsListen string `toml:"metrics_listen"`
+
+	// GRPCListen is the address of the gRPC metrics API streaming every cycle (empty disables it)
+	GRPCListen string `toml:"grpc_listen"`
+
+	// DeviceNameTemplate is a Go template for HA device names, e.g. "{{.Hostname}}-gpu{{.Index}}".
+	// Fields: .Hostname, .Index, .Name, .Model, .PCIID, .UUID, .VRAMGB. Empty uses the default format.
+	DeviceNameTemplate string `toml:"device_name_template"`
+
+	// DeviceNames overrides the HA device name of specific GPUs, keyed by full UUID,
+	// short 8-character UUID or NVML index, e.g. "0" = "Render GPU"
+	DeviceNames map[string]string `toml:"device_names"`
+
+	// GPU selection by full UUID, short 8-character UUID or NVML index.
+	// When an include list is set only matching GPUs are monitored; excludes always win.
+	IncludeUUIDs   []string `toml:"include_uuids"`
+	ExcludeUUIDs   []string `toml:"exclude_uuids"`
+	IncludeIndexes []int    `toml:"include_indexes"`
+	ExcludeIndexes []int    `toml:"exclude_indexes"`
+
+	// Sensor selection by sensor key (e.g. "power_draw", "performance_level", "busy").
+	// When enabled_sensors is set only those sensors are published; disabled sensors always win.
+	EnabledSensors  []string `toml:"enabled_sensors"`
+	DisabledSensors []string `toml:"disabled_sensors"`
+
+	// CleanupOnExit removes the discovery configs of all GPUs on shutdown
+	CleanupOnExit bool `toml:"cleanup_on_exit"`
+
+	// MQTTClientID is the base client ID (empty uses "nvml-gpu-ha"); a random suffix
+	// is appended unless MQTTClientIDSuffix is disabled
+	MQTTClientID       string `toml:"mqtt_client_id"`
+	MQTTClientIDSuffix bool   `toml:"mqtt_client_id_suffix"`
+
+	// MQTTKeepAlive is the keepalive interval in seconds, lower it for brokers behind load
+	// balancers that drop idle connections (0 disables keepalive pings).
+	// MQTTConnectRetryInterval is the delay in seconds between connection attempts.
+	MQTTKeepAlive            int `toml:"mqtt_keepalive_seconds"`
+	MQTTConnectRetryInterval int `toml:"mqtt_connect_retry_interval_seconds"`
+
+	// DefaultPrecision rounds all numeric sensors to this many decimals (-1 keeps the
+	// built-in templates); SensorPrecision overrides it per sensor key, e.g. power_draw = 0
+	DefaultPrecision int            `toml:"default_precision"`
+	SensorPrecision  map[string]int `toml:"sensor_precision"`
+
+	// SensorOverrides replaces the built-in icon, device class or unit of sensors by key,
+	// e.g. temperature = { icon = "mdi:thermometer-high" }
+	SensorOverrides map[string]SensorOverride `toml:"sensor_overrides"`
+
+	// LogEvents logs performance level and throttle reason changes between cycles,
+	// PublishEvents also publishes them to homeassistant/sensor/nvml-gpu/{DEVICEID}/events
+	LogEvents     bool `toml:"log_events"`
+	PublishEvents bool `toml:"publish_events"`
+
+	// RediscoveryInterval republishes the discovery configs every N seconds (0 disables it),
+	// RediscoverOnReconnect after every reconnect to the broker, which may have restarted
+	// without its retained messages
+	RediscoveryInterval   int  `toml:"rediscovery_interval"`
+	RediscoverOnReconnect bool `toml:"rediscover_on_reconnect"`
+
+	// FanControl exposes fan speed numbers and an automatic fan control button in Home Assistant
+	FanControl bool `toml:"fan_control"`
+
+	// MQTTURL is a full broker URL (e.g. "unix:///run/mosquitto.sock" or "ws://host:9001/mqtt")
+	// used instead of mqtt_host/mqtt_port when set
+	MQTTURL string `toml:"mqtt_url"`
+
+	// StateTopicTemplate is a Go template for sensor state topics with the fields .NodeID, .DeviceID and .Sensor
+	StateTopicTemplate string `toml:"state_topic_template"`
+
+	// DiscoveryNodeID is the node ID segment of all discovery, state and command topics
+	// (homeassistant/<component>/<node_id>/<object_id>/...), e.g. per tenant on a shared broker
+	DiscoveryNodeID string `toml:"discovery_node_id"`
+
+	// DeviceIDStrategy selects the device ID used in topics and unique IDs: "pci" (PCI ID and
+	// short UUID), "uuid" (full UUID, follows the card across slots) or "pci_uuid"
+	DeviceIDStrategy string `toml:"device_id_strategy"`
+
+	// TemperatureUnit is "C" or "F". NVML reports Celsius, values are converted when published.
+	TemperatureUnit string `toml:"temperature_unit"`
+
+	// MemoryUsageUnit is "%" for VRAM usage as a percentage, or "B", "MiB" or "GiB" to
+	// publish the used VRAM as an absolute data size
+	MemoryUsageUnit string `toml:"memory_usage_unit"`
+
+	// CSVOutput appends the metrics of every GPU and cycle to this CSV file (empty disables it).
+	// The file is rotated to CSVOutput.1 once it reaches CSVMaxSize MiB (0 never rotates).
+	CSVOutput  string `toml:"csv_output"`
+	CSVMaxSize int    `toml:"csv_max_size"`
+
+	// StatsWindow enables min/max/avg temperature and power draw sensors over a rolling
+	// window such as "1h", or "daily" for the statistics since local midnight (empty disables them)
+	StatsWindow string `toml:"stats_window"`
+
+	// ViaDevice is the identifier of the HA device the GPU devices are nested under, e.g. a
+	// host device of another integration. "host" uses the host-level device of this service.
+	ViaDevice string `toml:"via_device"`
+
+	// HostConnections are "type:value" connections of the host-level device, e.g.
+	// "mac:00:11:22:33:44:55", so that HA merges it with the host's device of other integrations
+	HostConnections []string `toml:"host_connections"`
+
+	// HostnamePattern is a regular expression replaced by HostnameReplacement in the hostname
+	// before it is used in device names, e.g. "^gpu-(node-\\d+)\\..*$" with "$1" (empty disables it)
+	HostnamePattern     string `toml:"hostname_pattern"`
+	HostnameReplacement string `toml:"hostname_replacement"`
+
+	// PublishOnChange only publishes state values that changed since the last cycle, and
+	// unchanged ones again after PublishMaxInterval seconds as a heartbeat (0 never does)
+	PublishOnChange    bool `toml:"publish_on_change"`
+	PublishMaxInterval int  `toml:"publish_max_interval"`
+
+	// ForceUpdate makes Home Assistant record every received state, even an unchanged one
+	ForceUpdate bool `toml:"force_update"`
+
+	// MQTTHosts lists additional brokers for failover ("host", "host:port" or "scheme://host:port")
+	MQTTHosts []string `toml:"mqtt_hosts"`
+
+	// MirrorBrokers are independent brokers that receive every message as well, e.g. of a
+	// second Home Assistant instance. Unlike mqtt_hosts they are not used for failover.
+	MirrorBrokers []MirrorBroker `toml:"mirror_brokers"`
+
+	// mqttHostSet records whether mqtt_host was given explicitly (file, env or flag)
+	mqttHostSet bool
+}
+
+// DefaultAvailabilityTopic is the availability topic of the Last Will and the discovery configs
+const DefaultAvailabilityTopic = "homeassistant/sensor/nvml-gpu-ha/availability"
+
+// DefaultStateTopicTemplate is the sensor state topic layout expected by Home Assistant users
+const DefaultStateTopicTemplate = "homeassistant/{{.Component}}/{{.NodeID}}/{{.DeviceID}}_{{.Sensor}}/state"
+
+// DefaultDiscoveryNodeID is the node ID segment of the discovery topics
+const DefaultDiscoveryNodeID = "nvml-gpu"
+
+// StateTopicFields are the fields available in a state topic template
+type StateTopicFields struct {
+	Component string // "sensor" or "binary_sensor"
+	NodeID    string
+	DeviceID  string
+	Sensor    string
+}
+
+// SensorOverride is the presentation of a sensor replacing its built-in one. Empty fields
+// keep the built-in value.
+type SensorOverride struct {
+	Icon        string `toml:"icon"`
+	DeviceClass string `toml:"device_class"`
+	Unit        string `toml:"unit"`
+}
+
+// MirrorBroker is a broker receiving the same messages as the main one, with its own
+// credentials. The TLS files apply to ssl://, tls://, mqtts:// and wss:// URLs; without
+// a CA file the system roots verify the broker.
+type MirrorBroker struct {
+	URL                string `toml:"url"`
+	Username           string `toml:"username"`
+	Password           string `toml:"password"`
+	CAFile             string `toml:"ca_file"`
+	CertFile           string `toml:"cert_file"`
+	KeyFile            string `toml:"key_file"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
 }
 
 // DefaultConfig returns a config with default values
@@ -31,6 +282,96 @@ func DefaultConfig() *Config {
 		MQTTLWTEnable: true,
 		MQTTRetain:    true,
 		PollingPeriod: 30,
+		DryRun:        false,
+		NVMLTimeout:   10,
+
+		MQTTPublishTimeout: 5,
+
+		Output:  "mqtt",
+		HAURL:   "",
+		HAToken: "",
+
+		DiscoveryRetain:    true,
+		StateRetain:        true,
+		AvailabilityRetain: true,
+
+		DiscoveryQoS: 1,
+		StateQoS:     1,
+
+		DiscoveryConcurrency: 0,
+
+		AvailabilityTopic:   DefaultAvailabilityTopic,
+		PayloadAvailable:    "online",
+		PayloadNotAvailable: "offline",
+
+		NVMLInitAttempts: 5,
+		NVMLInitInterval: 5,
+
+		MaxConcurrentPolls: 0,
+
+		UnavailableAfterFailures: 3,
+
+		WatchdogPeriods: 0,
+
+		UtilizationSource: "instant",
+
+		SampleInterval:    0,
+		SampleAggregation: "max",
+		SampledMetrics:    []string{"gpu_utilization"},
+
+		UtilizationSamples: 1,
+		SmoothTemperature:  false,
+
+		BusyThreshold: 10,
+		MetricsListen: "",
+		GRPCListen:    "",
+
+		BusyOffThreshold: -1,
+
+		DeviceNameTemplate: "",
+
+		CleanupOnExit: false,
+
+		MQTTClientID:       "",
+		MQTTClientIDSuffix: true,
+
+		MQTTKeepAlive:            30,
+		MQTTConnectRetryInterval: 10,
+
+		DefaultPrecision: -1,
+
+		FanControl: false,
+
+		LogEvents:     false,
+		PublishEvents: false,
+
+		RediscoveryInterval:   0,
+		RediscoverOnReconnect: true,
+
+		StateTopicTemplate: DefaultStateTopicTemplate,
+
+		DiscoveryNodeID: DefaultDiscoveryNodeID,
+
+		DeviceIDStrategy: "pci",
+
+		TemperatureUnit: "C",
+
+		MemoryUsageUnit: "%",
+
+		CSVOutput:  "",
+		CSVMaxSize: 100,
+
+		ViaDevice: "",
+
+		StatsWindow: "",
+
+		HostnamePattern:     "",
+		HostnameReplacement: "",
+
+		PublishOnChange:    false,
+		PublishMaxInterval: 300,
+
+		ForceUpdate: true,
 	}
 }
 
@@ -45,14 +386,16 @@ func LoadConfigFromFile(filename string) (*Config, error) {
 	}
 
 	// Read and parse TOML file
-	if _, err := toml.DecodeFile(filename, config); err != nil {
+	meta, err := toml.DecodeFile(filename, config)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse config file %s: %v", filename, err)
 	}
+	config.mqttHostSet = meta.IsDefined("mqtt_host")
 
 	return config, nil
 }
 
-// LoadConfig loads configuration from file first, then overrides with command line flags
+// LoadConfig loads configuration from file first, then overrides with environment variables and command line flags
 func LoadConfig(cmd *cobra.Command) (*Config, error) {
 	// First load from config file
 	configFile := "/etc/nvml-gpu-ha.conf"
@@ -71,6 +414,11 @@ func LoadConfig(cmd *cobra.Command) (*Config, error) {
 		return nil, err
 	}
 
+	// Environment variables override the config file
+	if err := config.applyEnvOverrides(); err != nil {
+		return nil, err
+	}
+
 	// Override with command line flags if they were explicitly set
 	if cmd.Flags().Changed("hostname") {
 		config.Hostname, err = cmd.Flags().GetString("hostname")
@@ -84,6 +432,14 @@ func LoadConfig(cmd *cobra.Command) (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
+		config.mqttHostSet = true
+	}
+
+	if cmd.Flags().Changed("mqtt-hosts") {
+		config.MQTTHosts, err = cmd.Flags().GetStringSlice("mqtt-hosts")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if cmd.Flags().Changed("mqtt-port") {
@@ -121,6 +477,62 @@ func LoadConfig(cmd *cobra.Command) (*Config, error) {
 		}
 	}
 
+	if cmd.Flags().Changed("discovery-retain") {
+		config.DiscoveryRetain, err = cmd.Flags().GetBool("discovery-retain")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("state-retain") {
+		config.StateRetain, err = cmd.Flags().GetBool("state-retain")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("availability-retain") {
+		config.AvailabilityRetain, err = cmd.Flags().GetBool("availability-retain")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("discovery-qos") {
+		config.DiscoveryQoS, err = cmd.Flags().GetInt("discovery-qos")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("state-qos") {
+		config.StateQoS, err = cmd.Flags().GetInt("state-qos")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("availability-topic") {
+		config.AvailabilityTopic, err = cmd.Flags().GetString("availability-topic")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("payload-available") {
+		config.PayloadAvailable, err = cmd.Flags().GetString("payload-available")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("payload-not-available") {
+		config.PayloadNotAvailable, err = cmd.Flags().GetString("payload-not-available")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if cmd.Flags().Changed("polling-period") {
 		config.PollingPeriod, err = cmd.Flags().GetInt("polling-period")
 		if err != nil {
@@ -128,21 +540,912 @@ func LoadConfig(cmd *cobra.Command) (*Config, error) {
 		}
 	}
 
-	return config, nil
-}
+	if cmd.Flags().Changed("dry-run") {
+		config.DryRun, err = cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return nil, err
+		}
+	}
 
-// SaveToFile saves current configuration to a TOML file
-func (c *Config) SaveToFile(filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create config file %s: %v", filename, err)
+	if cmd.Flags().Changed("nvml-timeout") {
+		config.NVMLTimeout, err = cmd.Flags().GetInt("nvml-timeout")
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer file.Close()
 
-	encoder := toml.NewEncoder(file)
-	if err := encoder.Encode(c); err != nil {
-		return fmt.Errorf("failed to encode config to file %s: %v", filename, err)
+	if cmd.Flags().Changed("mqtt-publish-timeout") {
+		config.MQTTPublishTimeout, err = cmd.Flags().GetInt("mqtt-publish-timeout")
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	if cmd.Flags().Changed("output") {
+		config.Output, err = cmd.Flags().GetString("output")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("ha-url") {
+		config.HAURL, err = cmd.Flags().GetString("ha-url")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("ha-token") {
+		config.HAToken, err = cmd.Flags().GetString("ha-token")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("nvml-init-attempts") {
+		config.NVMLInitAttempts, err = cmd.Flags().GetInt("nvml-init-attempts")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("nvml-init-interval") {
+		config.NVMLInitInterval, err = cmd.Flags().GetInt("nvml-init-interval")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("watchdog-periods") {
+		config.WatchdogPeriods, err = cmd.Flags().GetInt("watchdog-periods")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("unavailable-after-failures") {
+		config.UnavailableAfterFailures, err = cmd.Flags().GetInt("unavailable-after-failures")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("discovery-concurrency") {
+		config.DiscoveryConcurrency, err = cmd.Flags().GetInt("discovery-concurrency")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("max-concurrent-polls") {
+		config.MaxConcurrentPolls, err = cmd.Flags().GetInt("max-concurrent-polls")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("utilization-source") {
+		config.UtilizationSource, err = cmd.Flags().GetString("utilization-source")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("sample-interval") {
+		config.SampleInterval, err = cmd.Flags().GetInt("sample-interval")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("sample-aggregation") {
+		config.SampleAggregation, err = cmd.Flags().GetString("sample-aggregation")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("sampled-metrics") {
+		config.SampledMetrics, err = cmd.Flags().GetStringSlice("sampled-metrics")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("utilization-samples") {
+		config.UtilizationSamples, err = cmd.Flags().GetInt("utilization-samples")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("smooth-temperature") {
+		config.SmoothTemperature, err = cmd.Flags().GetBool("smooth-temperature")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("busy-threshold") {
+		config.BusyThreshold, err = cmd.Flags().GetInt("busy-threshold")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("busy-off-threshold") {
+		config.BusyOffThreshold, err = cmd.Flags().GetInt("busy-off-threshold")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("metrics-listen") {
+		config.MetricsListen, err = cmd.Flags().GetString("metrics-listen")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("grpc-listen") {
+		config.GRPCListen, err = cmd.Flags().GetString("grpc-listen")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("device-name-template") {
+		config.DeviceNameTemplate, err = cmd.Flags().GetString("device-name-template")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("device-names") {
+		config.DeviceNames, err = cmd.Flags().GetStringToString("device-names")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("enabled-sensors") {
+		config.EnabledSensors, err = cmd.Flags().GetStringSlice("enabled-sensors")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("disabled-sensors") {
+		config.DisabledSensors, err = cmd.Flags().GetStringSlice("disabled-sensors")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("include-uuids") {
+		config.IncludeUUIDs, err = cmd.Flags().GetStringSlice("include-uuids")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("exclude-uuids") {
+		config.ExcludeUUIDs, err = cmd.Flags().GetStringSlice("exclude-uuids")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("include-indexes") {
+		config.IncludeIndexes, err = cmd.Flags().GetIntSlice("include-indexes")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("exclude-indexes") {
+		config.ExcludeIndexes, err = cmd.Flags().GetIntSlice("exclude-indexes")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("cleanup-on-exit") {
+		config.CleanupOnExit, err = cmd.Flags().GetBool("cleanup-on-exit")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("mqtt-client-id") {
+		config.MQTTClientID, err = cmd.Flags().GetString("mqtt-client-id")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("mqtt-client-id-suffix") {
+		config.MQTTClientIDSuffix, err = cmd.Flags().GetBool("mqtt-client-id-suffix")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("mqtt-keepalive") {
+		config.MQTTKeepAlive, err = cmd.Flags().GetInt("mqtt-keepalive")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("mqtt-connect-retry-interval") {
+		config.MQTTConnectRetryInterval, err = cmd.Flags().GetInt("mqtt-connect-retry-interval")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("default-precision") {
+		config.DefaultPrecision, err = cmd.Flags().GetInt("default-precision")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("sensor-precision") {
+		config.SensorPrecision, err = cmd.Flags().GetStringToInt("sensor-precision")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("log-events") {
+		config.LogEvents, err = cmd.Flags().GetBool("log-events")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("publish-events") {
+		config.PublishEvents, err = cmd.Flags().GetBool("publish-events")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("rediscovery-interval") {
+		config.RediscoveryInterval, err = cmd.Flags().GetInt("rediscovery-interval")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("rediscover-on-reconnect") {
+		config.RediscoverOnReconnect, err = cmd.Flags().GetBool("rediscover-on-reconnect")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("fan-control") {
+		config.FanControl, err = cmd.Flags().GetBool("fan-control")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("mqtt-url") {
+		config.MQTTURL, err = cmd.Flags().GetString("mqtt-url")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("discovery-node-id") {
+		config.DiscoveryNodeID, err = cmd.Flags().GetString("discovery-node-id")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("state-topic-template") {
+		config.StateTopicTemplate, err = cmd.Flags().GetString("state-topic-template")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("device-id-strategy") {
+		config.DeviceIDStrategy, err = cmd.Flags().GetString("device-id-strategy")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("stats-window") {
+		config.StatsWindow, err = cmd.Flags().GetString("stats-window")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("via-device") {
+		config.ViaDevice, err = cmd.Flags().GetString("via-device")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("host-connections") {
+		config.HostConnections, err = cmd.Flags().GetStringSlice("host-connections")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("hostname-pattern") {
+		config.HostnamePattern, err = cmd.Flags().GetString("hostname-pattern")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("hostname-replacement") {
+		config.HostnameReplacement, err = cmd.Flags().GetString("hostname-replacement")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("publish-on-change") {
+		config.PublishOnChange, err = cmd.Flags().GetBool("publish-on-change")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("publish-max-interval") {
+		config.PublishMaxInterval, err = cmd.Flags().GetInt("publish-max-interval")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("force-update") {
+		config.ForceUpdate, err = cmd.Flags().GetBool("force-update")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("csv-output") {
+		config.CSVOutput, err = cmd.Flags().GetString("csv-output")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("csv-max-size") {
+		config.CSVMaxSize, err = cmd.Flags().GetInt("csv-max-size")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("memory-usage-unit") {
+		config.MemoryUsageUnit, err = cmd.Flags().GetString("memory-usage-unit")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cmd.Flags().Changed("temperature-unit") {
+		config.TemperatureUnit, err = cmd.Flags().GetString("temperature-unit")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ValidateMQTTURL(config.MQTTURL); err != nil {
+		return nil, err
+	}
+	for i, broker := range config.MirrorBrokers {
+		if broker.URL == "" {
+			return nil, fmt.Errorf("mirror_brokers entry %d has no url", i+1)
+		}
+		if err := ValidateMQTTURL(broker.URL); err != nil {
+			return nil, fmt.Errorf("invalid mirror_brokers entry %d: %v", i+1, err)
+		}
+		if (broker.CertFile == "") != (broker.KeyFile == "") {
+			return nil, fmt.Errorf("mirror_brokers entry %d needs both cert_file and key_file for a client certificate", i+1)
+		}
+	}
+
+	switch config.Output {
+	case "mqtt":
+	case "rest":
+		if u, err := url.Parse(config.HAURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid ha_url %q, must be an http:// or https:// URL of Home Assistant", config.HAURL)
+		}
+		if config.HAToken == "" {
+			return nil, fmt.Errorf("output rest requires ha_token, a long-lived access token")
+		}
+	default:
+		return nil, fmt.Errorf("invalid output %q, must be mqtt or rest", config.Output)
+	}
+
+	if config.AvailabilityTopic == "" || strings.ContainsAny(config.AvailabilityTopic, "+#") {
+		return nil, fmt.Errorf("invalid availability topic %q", config.AvailabilityTopic)
+	}
+
+	if err := ValidateStateTopicTemplate(config.StateTopicTemplate); err != nil {
+		return nil, err
+	}
+
+	if !validNodeID.MatchString(config.DiscoveryNodeID) {
+		return nil, fmt.Errorf("invalid discovery node ID %q, may only contain letters, digits, _ and -", config.DiscoveryNodeID)
+	}
+
+	if config.StatsWindow != "" && config.StatsWindow != "daily" {
+		if window, err := time.ParseDuration(config.StatsWindow); err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid stats window %q, must be \"daily\" or a duration such as \"1h\"", config.StatsWindow)
+		}
+	}
+
+	for _, connection := range config.HostConnections {
+		if kind, value, ok := strings.Cut(connection, ":"); !ok || kind == "" || value == "" {
+			return nil, fmt.Errorf("invalid host connection %q, must be type:value, e.g. mac:00:11:22:33:44:55", connection)
+		}
+	}
+
+	if _, err := regexp.Compile(config.HostnamePattern); err != nil {
+		return nil, fmt.Errorf("invalid hostname pattern %q: %v", config.HostnamePattern, err)
+	}
+
+	if config.PublishMaxInterval < 0 {
+		return nil, fmt.Errorf("invalid publish_max_interval %d, must be 0 (no heartbeat) or more", config.PublishMaxInterval)
+	}
+
+	if config.MQTTKeepAlive < 0 {
+		return nil, fmt.Errorf("invalid mqtt_keepalive_seconds %d, must be 0 (disabled) or more", config.MQTTKeepAlive)
+	}
+
+	if config.MQTTConnectRetryInterval <= 0 {
+		return nil, fmt.Errorf("invalid mqtt_connect_retry_interval_seconds %d, must be at least 1", config.MQTTConnectRetryInterval)
+	}
+
+	// The monitoring ticker panics on a non-positive interval
+	if config.PollingPeriod <= 0 {
+		return nil, fmt.Errorf("invalid polling_period %d, must be at least 1", config.PollingPeriod)
+	}
+
+	// A zero timeout would fail every NVML request at once and mark every GPU hung
+	if config.NVMLTimeout <= 0 {
+		return nil, fmt.Errorf("invalid nvml_timeout_seconds %d, must be at least 1", config.NVMLTimeout)
+	}
+
+	if config.MQTTPublishTimeout <= 0 {
+		return nil, fmt.Errorf("invalid mqtt_publish_timeout_seconds %d, must be at least 1", config.MQTTPublishTimeout)
+	}
+
+	if config.DiscoveryQoS < 0 || config.DiscoveryQoS > 2 {
+		return nil, fmt.Errorf("invalid discovery_qos %d, must be 0, 1 or 2", config.DiscoveryQoS)
+	}
+	if config.StateQoS < 0 || config.StateQoS > 2 {
+		return nil, fmt.Errorf("invalid state_qos %d, must be 0, 1 or 2", config.StateQoS)
+	}
+
+	if config.CSVMaxSize < 0 {
+		return nil, fmt.Errorf("invalid csv_max_size %d, must be 0 (no rotation) or more", config.CSVMaxSize)
+	}
+
+	if config.UnavailableAfterFailures < 1 {
+		return nil, fmt.Errorf("invalid unavailable_after_failures %d, must be at least 1", config.UnavailableAfterFailures)
+	}
+
+	if config.DiscoveryConcurrency < 0 {
+		return nil, fmt.Errorf("invalid discovery_concurrency %d, must be 0 (no limit) or more", config.DiscoveryConcurrency)
+	}
+
+	if config.MaxConcurrentPolls < 0 {
+		return nil, fmt.Errorf("invalid max_concurrent_polls %d, must be 0 (no limit) or more", config.MaxConcurrentPolls)
+	}
+
+	// A single period would fire whenever a cycle takes a moment longer than the ticker
+	if config.WatchdogPeriods != 0 && config.WatchdogPeriods < 2 {
+		return nil, fmt.Errorf("invalid watchdog_periods %d, must be 0 (disabled) or at least 2", config.WatchdogPeriods)
+	}
+
+	if config.BusyOffThreshold > config.BusyThreshold {
+		return nil, fmt.Errorf("busy_off_threshold %d must not be above busy_threshold %d", config.BusyOffThreshold, config.BusyThreshold)
+	}
+
+	config.TemperatureUnit = strings.ToUpper(config.TemperatureUnit)
+	if config.TemperatureUnit != "C" && config.TemperatureUnit != "F" {
+		return nil, fmt.Errorf("invalid temperature unit %q, must be C or F", config.TemperatureUnit)
+	}
+
+	if _, ok := memoryUsageDivisors[config.MemoryUsageUnit]; !ok && config.MemoryUsageUnit != "%" {
+		return nil, fmt.Errorf("invalid memory usage unit %q, must be %%, B, MiB or GiB", config.MemoryUsageUnit)
+	}
+
+	switch config.DeviceIDStrategy {
+	case "pci", "uuid", "pci_uuid":
+	default:
+		return nil, fmt.Errorf("invalid device ID strategy %q, must be pci, uuid or pci_uuid", config.DeviceIDStrategy)
+	}
+
+	switch config.UtilizationSource {
+	case "instant", "samples", "process":
+	default:
+		return nil, fmt.Errorf("invalid utilization source %q, must be instant, samples or process", config.UtilizationSource)
+	}
+
+	if config.SampleInterval < 0 {
+		return nil, fmt.Errorf("invalid sample_interval %d, must be 0 (disabled) or more", config.SampleInterval)
+	}
+	if config.SampleAggregation != "max" && config.SampleAggregation != "avg" {
+		return nil, fmt.Errorf("invalid sample aggregation %q, must be max or avg", config.SampleAggregation)
+	}
+	for _, metric := range config.SampledMetrics {
+		switch metric {
+		case "gpu_utilization", "temperature", "power_draw":
+		default:
+			return nil, fmt.Errorf("invalid sampled metric %q, must be gpu_utilization, temperature or power_draw", metric)
+		}
+	}
+
+	return config, nil
+}
+
+// ValidateMQTTURL checks that a broker URL (if set) has a scheme supported by the MQTT client
+func ValidateMQTTURL(brokerURL string) error {
+	if brokerURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT URL %q: %v", brokerURL, err)
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "ws", "wss", "unix":
+		return nil
+	case "":
+		return fmt.Errorf("invalid MQTT URL %q: missing scheme, e.g. tcp:// or unix://", brokerURL)
+	default:
+		return fmt.Errorf("invalid MQTT URL %q: unsupported scheme %q", brokerURL, u.Scheme)
+	}
+}
+
+// validNodeID matches the node IDs Home Assistant accepts in discovery topics
+var validNodeID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ValidateStateTopicTemplate checks that a state topic template renders a publishable topic
+func ValidateStateTopicTemplate(topicTemplate string) error {
+	if topicTemplate == "" {
+		return nil
+	}
+
+	topic, err := RenderStateTopic(topicTemplate, StateTopicFields{Component: "sensor", NodeID: DefaultDiscoveryNodeID, DeviceID: "gpu1a2b3c4d", Sensor: "temperature"})
+	if err != nil {
+		return fmt.Errorf("invalid state topic template %q: %v", topicTemplate, err)
+	}
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("invalid state topic template %q: renders %q, which is not a valid topic", topicTemplate, topic)
+	}
+	return nil
+}
+
+// RenderStateTopic executes a state topic template (DefaultStateTopicTemplate when empty)
+func RenderStateTopic(topicTemplate string, fields StateTopicFields) (string, error) {
+	if topicTemplate == "" {
+		topicTemplate = DefaultStateTopicTemplate
+	}
+
+	tmpl, err := template.New("state_topic").Option("missingkey=error").Parse(topicTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var topic strings.Builder
+	if err := tmpl.Execute(&topic, fields); err != nil {
+		return "", err
+	}
+	return topic.String(), nil
+}
+
+// isTableCollection reports whether t is a list or map of tables, which cannot be written
+// as comma-separated values
+func isTableCollection(t reflect.Type) bool {
+	return (t.Kind() == reflect.Slice || t.Kind() == reflect.Map) && t.Elem().Kind() == reflect.Struct
+}
+
+// decodeInlineTOML decodes an inline TOML value, e.g. [{ url = "ssl://broker:8883" }], into field
+func decodeInlineTOML(value string, field reflect.Value) error {
+	holder := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "Value", Type: field.Type(), Tag: `toml:"value"`},
+	}))
+	if _, err := toml.Decode("value = "+value, holder.Interface()); err != nil {
+		return err
+	}
+	field.Set(holder.Elem().Field(0))
+	return nil
+}
+
+// applyEnvOverrides overrides fields with the matching NVML_GPU_HA_* environment variables
+func (c *Config) applyEnvOverrides() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if key == "" || !v.Field(i).CanSet() {
+			continue
+		}
+
+		envName := EnvPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		if isTableCollection(field.Type()) {
+			if err := decodeInlineTOML(value, field); err != nil {
+				return fmt.Errorf("invalid value in %s: %v", envName, err)
+			}
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid integer in %s: %v", envName, err)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean in %s: %v", envName, err)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			items := reflect.MakeSlice(field.Type(), 0, 0)
+			for _, item := range strings.Split(value, ",") {
+				item = strings.TrimSpace(item)
+				if item == "" {
+					continue
+				}
+				switch field.Type().Elem().Kind() {
+				case reflect.String:
+					items = reflect.Append(items, reflect.ValueOf(item))
+				case reflect.Int:
+					n, err := strconv.Atoi(item)
+					if err != nil {
+						return fmt.Errorf("invalid integer in %s: %v", envName, err)
+					}
+					items = reflect.Append(items, reflect.ValueOf(n))
+				default:
+					return fmt.Errorf("unsupported type for %s", envName)
+				}
+			}
+			field.Set(items)
+		case reflect.Map:
+			if field.Type().Key().Kind() != reflect.String {
+				return fmt.Errorf("unsupported type for %s", envName)
+			}
+			entries := reflect.MakeMap(field.Type())
+			for _, item := range strings.Split(value, ",") {
+				item = strings.TrimSpace(item)
+				if item == "" {
+					continue
+				}
+				k, v, ok := strings.Cut(item, "=")
+				if !ok {
+					return fmt.Errorf("invalid entry %q in %s, expected key=value", item, envName)
+				}
+				v = strings.TrimSpace(v)
+				switch field.Type().Elem().Kind() {
+				case reflect.String:
+					entries.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), reflect.ValueOf(v))
+				case reflect.Int:
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						return fmt.Errorf("invalid integer in %s: %v", envName, err)
+					}
+					entries.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), reflect.ValueOf(n))
+				default:
+					return fmt.Errorf("unsupported type for %s", envName)
+				}
+			}
+			field.Set(entries)
+		default:
+			return fmt.Errorf("unsupported type for %s", envName)
+		}
+
+		if key == "mqtt_host" {
+			c.mqttHostSet = true
+		}
+	}
+
+	return nil
+}
+
+// TemperatureUnitSymbol returns the unit of measurement of temperature sensors, "°C" or "°F"
+func (c *Config) TemperatureUnitSymbol() string {
+	if c.TemperatureUnit == "F" {
+		return "°F"
+	}
+	return "°C"
+}
+
+// ConvertTemperature converts a Celsius reading to the configured temperature unit
+func (c *Config) ConvertTemperature(celsius int) float64 {
+	if c.TemperatureUnit == "F" {
+		return float64(celsius)*9/5 + 32
+	}
+	return float64(celsius)
+}
+
+// HostnamePlaceholder in mqtt_username is replaced by the hostname, so that one config
+// works on every host of a broker with per-host usernames
+const HostnamePlaceholder = "%HOSTNAME%"
+
+// Username returns the MQTT username with HostnamePlaceholder replaced by the resolved hostname
+func (c *Config) Username() string {
+	return strings.ReplaceAll(c.MQTTUsername, HostnamePlaceholder, c.Hostname)
+}
+
+// MirrorUsername returns the MQTT username of a mirror broker with %HOSTNAME% replaced
+func (c *Config) MirrorUsername(broker MirrorBroker) string {
+	return strings.ReplaceAll(broker.Username, HostnamePlaceholder, c.Hostname)
+}
+
+// RewriteHostname applies the hostname pattern to hostname, returning it unchanged
+// if no pattern is configured
+func (c *Config) RewriteHostname(hostname string) string {
+	if c.HostnamePattern == "" {
+		return hostname
+	}
+	// The pattern was validated when the config was loaded
+	return regexp.MustCompile(c.HostnamePattern).ReplaceAllString(hostname, c.HostnameReplacement)
+}
+
+// RetainDiscovery reports whether discovery configs are retained
+func (c *Config) RetainDiscovery() bool {
+	return c.MQTTRetain && c.DiscoveryRetain
+}
+
+// RetainAvailability reports whether availability payloads and the Last Will are retained
+func (c *Config) RetainAvailability() bool {
+	return c.MQTTRetain && c.AvailabilityRetain
+}
+
+// RetainState reports whether sensor states are retained
+func (c *Config) RetainState() bool {
+	return c.MQTTRetain && c.StateRetain
+}
+
+// RESTOutput reports whether states are posted to the Home Assistant REST API instead of MQTT
+func (c *Config) RESTOutput() bool {
+	return c.Output == "rest"
+}
+
+// PublishTimeout returns how long to wait for the broker to confirm a publish
+func (c *Config) PublishTimeout() time.Duration {
+	return time.Duration(c.MQTTPublishTimeout) * time.Second
+}
+
+// FastSampling reports whether metrics are sampled between polls, which only helps with a
+// sample interval shorter than the polling period
+func (c *Config) FastSampling() bool {
+	return c.SampleInterval > 0 && c.SampleInterval < c.PollingPeriod && len(c.SampledMetrics) > 0
+}
+
+// StatsWindowDuration returns the rolling window of the min/max/avg sensors, 0 for daily statistics
+func (c *Config) StatsWindowDuration() time.Duration {
+	if c.StatsWindow == "daily" {
+		return 0
+	}
+	window, _ := time.ParseDuration(c.StatsWindow)
+	return window
+}
+
+// memoryUsageDivisors converts used VRAM bytes to the absolute memory usage units
+var memoryUsageDivisors = map[string]float64{
+	"B":   1,
+	"MiB": 1024 * 1024,
+	"GiB": 1024 * 1024 * 1024,
+}
+
+// MemoryUsageAbsolute reports whether VRAM usage is published as a data size instead of a percentage
+func (c *Config) MemoryUsageAbsolute() bool {
+	return c.MemoryUsageUnit != "%"
+}
+
+// ConvertMemoryUsage returns the VRAM usage in the configured unit
+func (c *Config) ConvertMemoryUsage(used, total uint64) float64 {
+	if divisor, ok := memoryUsageDivisors[c.MemoryUsageUnit]; ok {
+		return float64(used) / divisor
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total) * 100.0
+}
+
+// SensorEnabled reports whether the sensor with key should be registered and published
+func (c *Config) SensorEnabled(key string) bool {
+	for _, disabled := range c.DisabledSensors {
+		if disabled == key {
+			return false
+		}
+	}
+	if len(c.EnabledSensors) == 0 {
+		return true
+	}
+	for _, enabled := range c.EnabledSensors {
+		if enabled == key {
+			return true
+		}
+	}
+	return false
+}
+
+// MQTTBrokers returns the broker URLs to connect to. The mqtt_url broker, or else the
+// single mqtt_host/mqtt_port broker, comes first when it was set explicitly or when no
+// mqtt_hosts are given.
+func (c *Config) MQTTBrokers() []string {
+	var hosts []string
+	if c.MQTTURL != "" {
+		hosts = append(hosts, c.MQTTURL)
+	} else if c.mqttHostSet || len(c.MQTTHosts) == 0 {
+		hosts = append(hosts, c.MQTTHost)
+	}
+	hosts = append(hosts, c.MQTTHosts...)
+
+	seen := make(map[string]bool)
+	var brokers []string
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		broker := host
+		if !strings.Contains(host, "://") {
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				host = net.JoinHostPort(host, fmt.Sprint(c.MQTTPort))
+			}
+			broker = "tcp://" + host
+		}
+
+		if !seen[broker] {
+			seen[broker] = true
+			brokers = append(brokers, broker)
+		}
+	}
+
+	return brokers
+}
+
+// SaveToFile saves current configuration to a commented TOML file
+func (c *Config) SaveToFile(filename string) error {
+	// The config may hold the MQTT password, so keep it private to the owner
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create config file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	if err := c.writeCommented(file); err != nil {
+		return fmt.Errorf("failed to encode config to file %s: %v", filename, err)
+	}
+
+	return file.Close()
 }
@@ -0,0 +1,161 @@
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Result is the outcome of reading one GPU in a monitoring cycle
+type Result struct {
+	Device  nvidia.GPUDevice
+	Metrics nvidia.GPUMetrics
+	Err     error
+}
+
+// Server implements the Metrics service. The monitoring loop feeds it with SetDevices
+// and PublishCycle; it never reads NVML itself.
+type Server struct {
+	UnimplementedMetricsServer
+
+	mutex       sync.Mutex
+	devices     []*GPUDevice
+	subscribers map[chan *MetricsUpdate]bool
+}
+
+// NewServer creates a Server without devices or subscribers
+func NewServer() *Server {
+	return &Server{subscribers: make(map[chan *MetricsUpdate]bool)}
+}
+
+// Serve listens on addr and serves the Metrics service in the background
+func (s *Server) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer()
+	RegisterMetricsServer(server, s)
+
+	go func() {
+		log.Printf("Serving the gRPC metrics API on %s", addr)
+		if err := server.Serve(listener); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// SetDevices replaces the monitored GPUs returned by ListDevices
+func (s *Server) SetDevices(gpus []nvidia.GPUDevice) {
+	devices := make([]*GPUDevice, 0, len(gpus))
+	for _, gpu := range gpus {
+		devices = append(devices, &GPUDevice{
+			Index:            int32(gpu.Index),
+			Name:             gpu.Name,
+			Uuid:             gpu.UUID,
+			PciBusId:         gpu.PCIBusID,
+			DeviceId:         nvidia.GetDeviceID(gpu),
+			MemoryTotalBytes: gpu.Memory,
+		})
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.devices = devices
+}
+
+// PublishCycle sends the results of a monitoring cycle to every WatchMetrics stream.
+// A stream that has not sent the previous cycle yet skips this one, so a slow client
+// never delays the monitoring loop.
+func (s *Server) PublishCycle(timestamp time.Time, results []Result) {
+	update := &MetricsUpdate{Timestamp: timestamppb.New(timestamp)}
+	for _, result := range results {
+		update.Gpus = append(update.Gpus, gpuMetrics(result))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- update:
+		default:
+		}
+	}
+}
+
+// ListDevices returns the monitored GPUs
+func (s *Server) ListDevices(ctx context.Context, req *ListDevicesRequest) (*ListDevicesResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &ListDevicesResponse{Devices: s.devices}, nil
+}
+
+// WatchMetrics streams the results of every monitoring cycle until the client cancels
+func (s *Server) WatchMetrics(req *WatchMetricsRequest, stream Metrics_WatchMetricsServer) error {
+	updates := make(chan *MetricsUpdate, 1)
+	s.mutex.Lock()
+	s.subscribers[updates] = true
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.subscribers, updates)
+		s.mutex.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case update := <-updates:
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// gpuMetrics converts the result of reading a GPU to its message
+func gpuMetrics(result Result) *GPUMetrics {
+	message := &GPUMetrics{DeviceId: nvidia.GetDeviceID(result.Device)}
+	if result.Err != nil {
+		message.Error = result.Err.Error()
+		return message
+	}
+
+	metrics := result.Metrics
+	message.Timestamp = timestamppb.New(metrics.Timestamp)
+	message.PowerDrawWatts = metrics.PowerDraw
+	message.PerformanceLevel = metrics.PerformanceLevel
+	message.PerformanceState = int32(metrics.PerformanceState)
+	message.MemoryUsagePercent = metrics.MemoryUsage
+	message.MemoryUsedBytes = metrics.MemoryUsed
+	message.MemoryTotalBytes = metrics.MemoryTotal
+	message.MemoryReservedBytes = metrics.MemoryReserved
+	message.GpuUtilizationPercent = int32(metrics.GPUUtilization)
+	message.MemoryUtilizationPercent = int32(metrics.MemoryUtilization)
+	message.TemperatureCelsius = int32(metrics.Temperature)
+	message.MemoryTemperatureCelsius = int32(metrics.MemoryTemperature)
+	message.GraphicsClockMhz = int32(metrics.GraphicsClock)
+	message.MaxGraphicsClockMhz = int32(metrics.MaxGraphicsClock)
+	message.ApplicationsClockMhz = int32(metrics.ApplicationsClock)
+	message.TotalEnergyJoules = metrics.TotalEnergyJoules
+	message.ThrottleReasons = nvidia.ThrottleReasonNames(metrics.ThrottleReasons)
+
+	for key := range metrics.Failed {
+		message.Failed = append(message.Failed, key)
+	}
+	sort.Strings(message.Failed)
+	return message
+}
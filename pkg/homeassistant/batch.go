@@ -0,0 +1,124 @@
+package homeassistant
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// pendingPublish is a message of a batch whose delivery has not been confirmed yet
+type pendingPublish struct {
+	entity string // e.g. "sensor Temperature", used in logs and errors
+	token  mqtt.Token
+	// done is logged with the entity once delivered, e.g. "Registered" (empty for states)
+	done string
+}
+
+// publishBatch publishes messages without waiting, so that the broker round trips of
+// many discovery configs overlap instead of adding up
+type publishBatch struct {
+	m       *Manager
+	pending []pendingPublish
+}
+
+// newBatch starts a publish batch
+func (m *Manager) newBatch() *publishBatch {
+	return &publishBatch{m: m}
+}
+
+// publishConfig queues a discovery config, or only logs it in dry-run mode
+func (b *publishBatch) publishConfig(entity, topic string, payload []byte) {
+	b.publish(entity, topic, payload, b.m.config().DiscoveryQoS, b.m.config().RetainDiscovery(), "Registered")
+}
+
+// removeConfig queues an empty discovery config removing an entity, or only logs it in dry-run mode
+func (b *publishBatch) removeConfig(entity, topic string) {
+	if b.m.config().DryRun {
+		log.Printf("[dry-run] %s: (remove)", topic)
+		return
+	}
+	b.publish(entity, topic, nil, b.m.config().DiscoveryQoS, b.m.config().RetainDiscovery(), "Removed")
+}
+
+// publishState queues the state of a static sensor, or only logs it in dry-run mode. It is
+// only published with the discovery configs, so it is retained and delivered like them.
+func (b *publishBatch) publishState(entity, topic string, payload []byte) {
+	b.publish(entity, topic, payload, b.m.config().DiscoveryQoS, b.m.config().RetainDiscovery(), "")
+}
+
+func (b *publishBatch) publish(entity, topic string, payload []byte, qos int, retained bool, done string) {
+	if b.m.config().DryRun {
+		log.Printf("[dry-run] %s: %s", topic, payload)
+		return
+	}
+
+	// With mirror brokers, every broker confirms its own copy of the message
+	for i := range b.m.clients {
+		token := b.m.publishLimited(i, topic, byte(qos), retained, payload)
+		name := entity
+		if len(b.m.clients) > 1 {
+			name = fmt.Sprintf("%s on %s", entity, BrokerName(b.m.clients[i]))
+		}
+		b.pending = append(b.pending, pendingPublish{entity: name, token: token, done: done})
+	}
+}
+
+// publishLimited publishes a message to the i-th client once it has a free discovery slot.
+// The slot is freed when the broker confirms the message, or after the publish timeout so
+// that a lost message does not hold it forever.
+func (m *Manager) publishLimited(i int, topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if m.discoverySlots == nil {
+		return publishTo(m.clients, i, topic, qos, retained, payload)
+	}
+
+	slots := m.discoverySlots[i]
+	slots <- struct{}{}
+	token := publishTo(m.clients, i, topic, qos, retained, payload)
+	go func() {
+		token.WaitTimeout(m.config().PublishTimeout())
+		<-slots
+	}()
+	return token
+}
+
+// wait waits for all queued messages with a single overall deadline (the publish
+// timeout) and returns an error naming every message that failed or was not confirmed in time
+func (b *publishBatch) wait() error {
+	deadline := time.Now().Add(b.m.config().PublishTimeout())
+
+	var failures []string
+	for _, p := range b.pending {
+		if !delivered(p.token, time.Until(deadline)) {
+			failures = append(failures, fmt.Sprintf("%s: timeout", p.entity))
+			continue
+		}
+		if err := p.token.Error(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", p.entity, err))
+			continue
+		}
+		if p.done != "" {
+			log.Printf("%s %s", p.done, p.entity)
+		}
+	}
+
+	total := len(b.pending)
+	b.pending = nil
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to publish %d of %d message(s): %s", len(failures), total, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// delivered reports whether token completes within timeout. A token that already
+// completed counts as delivered even once the deadline has passed.
+func delivered(token mqtt.Token, timeout time.Duration) bool {
+	select {
+	case <-token.Done():
+		return true
+	default:
+	}
+	return timeout > 0 && token.WaitTimeout(timeout)
+}
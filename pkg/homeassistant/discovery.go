@@ -2,18 +2,53 @@ package homeassistant
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
 	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
 )
 
-// Manager handles Home Assistant MQTT Discovery
+// Version is the build version of this service announced in the discovery origin and the
+// device info, set by the main package
+var Version = "dev"
+
+// SupportURL is the project page announced in the discovery origin
+const SupportURL = "https://github.com/pccr10001/nvml-gpu-ha"
+
+// Manager handles Home Assistant MQTT Discovery. Every message is published to all
+// clients, the main broker first and then the mirror brokers.
 type Manager struct {
-	client mqtt.Client
-	config *config.Config
+	clients []mqtt.Client
+
+	// configRef is swapped as a whole by SetConfig, so that handlers running on other
+	// goroutines never see a half-applied reload
+	configRef atomic.Pointer[config.Config]
+
+	// subscriptions holds command topic handlers so they can be restored after a reconnect
+	subscriptionsMutex sync.Mutex
+	subscriptions      map[string]mqtt.MessageHandler
+
+	// clearedAvailability holds the availability topics whose retained payload was cleared
+	// since availability_retain was disabled
+	clearedMutex        sync.Mutex
+	clearedAvailability map[string]bool
+
+	// discoverySlots limits the unconfirmed batch messages per client (nil for no limit)
+	discoverySlots []chan struct{}
+
+	// devices holds the current handle of every registered GPU by device ID, which command
+	// handlers use instead of the handle captured at registration
+	devicesMutex sync.Mutex
+	devices      map[string]nvidia.GPUDevice
 }
 
 // SensorConfig represents Home Assistant sensor configuration
@@ -31,6 +66,70 @@ type SensorConfig struct {
 	ValueTemplate       string      `json:"value_template,omitempty"`
 	StateClass          string      `json:"state_class,omitempty"`
 	ForceUpdate         bool        `json:"force_update,omitempty"`
+	EntityCategory      string      `json:"entity_category,omitempty"`
+	Origin              *OriginInfo `json:"origin,omitempty"`
+
+	// Options lists the possible states of an enum sensor
+	Options []string `json:"options,omitempty"`
+
+	// Availability replaces AvailabilityTopic for entities that also depend on their GPU
+	Availability     []Availability `json:"availability,omitempty"`
+	AvailabilityMode string         `json:"availability_mode,omitempty"`
+}
+
+// BinarySensorConfig represents Home Assistant binary sensor configuration
+type BinarySensorConfig struct {
+	Name             string         `json:"name"`
+	StateTopic       string         `json:"state_topic"`
+	UniqueID         string         `json:"unique_id"`
+	DeviceClass      string         `json:"device_class,omitempty"`
+	Icon             string         `json:"icon,omitempty"`
+	Device           *DeviceInfo    `json:"device"`
+	Availability     []Availability `json:"availability,omitempty"`
+	AvailabilityMode string         `json:"availability_mode,omitempty"`
+	PayloadOn        string         `json:"payload_on"`
+	PayloadOff       string         `json:"payload_off"`
+	Origin           *OriginInfo    `json:"origin,omitempty"`
+}
+
+// ButtonConfig represents Home Assistant button configuration
+type ButtonConfig struct {
+	Name             string         `json:"name"`
+	CommandTopic     string         `json:"command_topic"`
+	UniqueID         string         `json:"unique_id"`
+	Icon             string         `json:"icon,omitempty"`
+	Device           *DeviceInfo    `json:"device"`
+	Availability     []Availability `json:"availability,omitempty"`
+	AvailabilityMode string         `json:"availability_mode,omitempty"`
+	PayloadPress     string         `json:"payload_press,omitempty"`
+	EntityCategory   string         `json:"entity_category,omitempty"`
+	Origin           *OriginInfo    `json:"origin,omitempty"`
+}
+
+// NumberConfig represents Home Assistant number configuration
+type NumberConfig struct {
+	Name              string         `json:"name"`
+	CommandTopic      string         `json:"command_topic"`
+	StateTopic        string         `json:"state_topic"`
+	UniqueID          string         `json:"unique_id"`
+	Min               int            `json:"min"`
+	Max               int            `json:"max"`
+	Step              int            `json:"step"`
+	Mode              string         `json:"mode,omitempty"`
+	UnitOfMeasurement string         `json:"unit_of_measurement,omitempty"`
+	Icon              string         `json:"icon,omitempty"`
+	Device            *DeviceInfo    `json:"device"`
+	Availability      []Availability `json:"availability,omitempty"`
+	AvailabilityMode  string         `json:"availability_mode,omitempty"`
+	EntityCategory    string         `json:"entity_category,omitempty"`
+	Origin            *OriginInfo    `json:"origin,omitempty"`
+}
+
+// Availability is one entry of an entity's availability list
+type Availability struct {
+	Topic               string `json:"topic"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
 }
 
 // DeviceInfo represents device information for Home Assistant
@@ -40,38 +139,362 @@ type DeviceInfo struct {
 	Model        string   `json:"model"`
 	Manufacturer string   `json:"manufacturer"`
 	SwVersion    string   `json:"sw_version,omitempty"`
+	// Connections are [type, value] pairs such as ["mac", "00:11:22:33:44:55"]
+	Connections [][]string `json:"connections,omitempty"`
+	// ViaDevice is an identifier of the device this device is connected through
+	ViaDevice string `json:"via_device,omitempty"`
 }
 
-// NewManager creates a new Home Assistant discovery manager
-func NewManager(client mqtt.Client, config *config.Config) *Manager {
-	return &Manager{
-		client: client,
-		config: config,
+// OriginInfo tells Home Assistant which application published a discovery config, shown
+// as "via nvml-gpu-ha" on the entities
+type OriginInfo struct {
+	Name       string `json:"name"`
+	SwVersion  string `json:"sw_version,omitempty"`
+	SupportURL string `json:"support_url,omitempty"`
+}
+
+// newOriginInfo returns the origin of all discovery configs of this service
+func newOriginInfo() *OriginInfo {
+	return &OriginInfo{
+		Name:       "nvml-gpu-ha",
+		SwVersion:  Version,
+		SupportURL: SupportURL,
 	}
 }
 
-// RegisterGPUSensors registers all sensors for a GPU device
+// sensorDefinition describes a sensor entity registered for each GPU
+type sensorDefinition struct {
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+	icon        string
+	stateClass  string
+	template    string
+	// entityCategory is "diagnostic" or "config", empty for primary sensors
+	entityCategory string
+	// options are the possible states of an enum sensor
+	options []string
+}
+
+// NewManager creates a new Home Assistant discovery manager publishing to clients
+func NewManager(clients []mqtt.Client, config *config.Config) *Manager {
+	m := &Manager{
+		clients:       clients,
+		subscriptions: make(map[string]mqtt.MessageHandler),
+
+		clearedAvailability: make(map[string]bool),
+		devices:             make(map[string]nvidia.GPUDevice),
+	}
+	m.configRef.Store(config)
+	if config.DiscoveryConcurrency > 0 {
+		m.discoverySlots = make([]chan struct{}, len(clients))
+		for i := range m.discoverySlots {
+			m.discoverySlots[i] = make(chan struct{}, config.DiscoveryConcurrency)
+		}
+	}
+	return m
+}
+
+// SetConfig replaces the configuration of the manager, e.g. after a reload
+func (m *Manager) SetConfig(config *config.Config) {
+	m.configRef.Store(config)
+}
+
+// config returns the current configuration of the manager
+func (m *Manager) config() *config.Config {
+	return m.configRef.Load()
+}
+
+// RegisterGPUSensors registers all sensors for a GPU device. The sensor configs are
+// published as one batch, so a slow broker delays registration only once per device.
 func (m *Manager) RegisterGPUSensors(device nvidia.GPUDevice, hostname string) error {
+	m.UpdateDevice(device)
 	deviceID := nvidia.GetDeviceID(device)
-	deviceName := nvidia.GetDeviceDisplayName(device, hostname)
+	deviceInfo := m.newDeviceInfo(device, hostname)
+	availability := m.gpuAvailability(deviceID)
+	batch := m.newBatch()
+
+	sensors := gpuSensors(device)
+	if m.config().StatsWindow != "" {
+		sensors = append(sensors, windowStatsSensors...)
+	}
+	for _, sensor := range sensors {
+		if sensor.key == "memory_usage" && m.config().MemoryUsageAbsolute() {
+			sensor = memoryUsedSensor(m.config(), sensor)
+		}
+		// A sensor the card cannot read would stay unknown forever, so a config left
+		// by an earlier version is removed instead
+		if !device.Supports(sensor.key) {
+			batch.removeConfig("sensor "+sensor.name, DiscoveryTopic(m.config(), "sensor", ObjectID(deviceID, sensor.key), "config"))
+			continue
+		}
+		if err := m.registerSensor(batch, deviceID, sensor, deviceInfo, availability); err != nil {
+			return fmt.Errorf("failed to register sensor %s: %v", sensor.key, err)
+		}
+	}
+
+	// Static diagnostic sensors only need their state published once
+	for _, sensor := range staticSensors(device) {
+		if err := m.registerSensor(batch, deviceID, sensor.sensorDefinition, deviceInfo, availability); err != nil {
+			return fmt.Errorf("failed to register sensor %s: %v", sensor.key, err)
+		}
+		if !m.config().SensorEnabled(sensor.key) {
+			continue
+		}
+
+		value := sensor.value
+		if celsius, ok := value.(int); ok && sensor.unit == "°C" {
+			value = m.config().ConvertTemperature(celsius)
+		}
 
-	deviceInfo := &DeviceInfo{
-		Identifiers:  []string{deviceID, device.UUID},
-		Name:         deviceName,
+		stateTopic := StateTopic(m.config(), deviceID, sensor.key)
+		payload, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to marshal sensor %s value: %v", sensor.key, err)
+		}
+		batch.publishState("sensor "+sensor.name+" value", stateTopic, payload)
+	}
+
+	for _, sensor := range gpuBinarySensors(device) {
+		if !device.Supports(sensor.key) {
+			batch.removeConfig("binary sensor "+sensor.name, DiscoveryTopic(m.config(), "binary_sensor", ObjectID(deviceID, sensor.key), "config"))
+			continue
+		}
+		if err := m.registerBinarySensor(batch, device, hostname, sensor.key, sensor.name, sensor.deviceClass, sensor.icon); err != nil {
+			return fmt.Errorf("failed to register binary sensor %s: %v", sensor.key, err)
+		}
+	}
+
+	if err := batch.wait(); err != nil {
+		return fmt.Errorf("failed to register sensors: %v", err)
+	}
+
+	// ECC counters can only be reset on devices with ECC enabled
+	if device.HasECC {
+		if err := m.RegisterButtonEntity(device, hostname, "reset_ecc_errors", "Reset ECC Errors", "mdi:restore", func(device nvidia.GPUDevice) error {
+			return nvidia.ClearEccErrors(device)
+		}); err != nil {
+			return fmt.Errorf("failed to register ECC reset button: %v", err)
+		}
+	}
+
+	if m.config().FanControl && device.FanCount > 0 {
+		if err := m.registerFanControls(device, hostname); err != nil {
+			return fmt.Errorf("failed to register fan controls: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// registerFanControls registers a speed number entity per fan and a button restoring automatic fan control
+func (m *Manager) registerFanControls(device nvidia.GPUDevice, hostname string) error {
+	for fan := 0; fan < device.FanCount; fan++ {
+		fan := fan
+		key := fmt.Sprintf("fan%d_speed", fan)
+		if err := m.RegisterNumberEntity(device, hostname, key, fmt.Sprintf("Fan %d Speed", fan), "mdi:fan",
+			device.MinFanSpeed, device.MaxFanSpeed, "%", func(device nvidia.GPUDevice, value int) error {
+				return nvidia.SetFanSpeed(device, fan, value)
+			}); err != nil {
+			return err
+		}
+
+		if speed, err := nvidia.GetFanSpeed(device, fan); err == nil {
+			if err := m.PublishNumberState(device, key, speed); err != nil {
+				log.Printf("Failed to publish fan %d speed: %v", fan, err)
+			}
+		}
+	}
+
+	return m.RegisterButtonEntity(device, hostname, "fan_auto", "Automatic Fan Control", "mdi:fan-auto", func(device nvidia.GPUDevice) error {
+		for fan := 0; fan < device.FanCount; fan++ {
+			if err := nvidia.SetDefaultFanSpeed(device, fan); err != nil {
+				return err
+			}
+
+			key := fmt.Sprintf("fan%d_speed", fan)
+			if speed, err := nvidia.GetFanSpeed(device, fan); err == nil {
+				if err := m.PublishNumberState(device, key, speed); err != nil {
+					log.Printf("Failed to publish fan %d speed: %v", fan, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateDevice records the current handle of a GPU device, e.g. once it was re-acquired
+// after a reset, for the command handlers of its entities
+func (m *Manager) UpdateDevice(device nvidia.GPUDevice) {
+	m.devicesMutex.Lock()
+	defer m.devicesMutex.Unlock()
+	m.devices[nvidia.GetDeviceID(device)] = device
+}
+
+// currentDevice returns the current handle of a device, or device itself when it was
+// not registered through RegisterGPUSensors
+func (m *Manager) currentDevice(device nvidia.GPUDevice) nvidia.GPUDevice {
+	m.devicesMutex.Lock()
+	defer m.devicesMutex.Unlock()
+	if current, ok := m.devices[nvidia.GetDeviceID(device)]; ok {
+		return current
+	}
+	return device
+}
+
+// newDeviceInfo builds the Home Assistant device information for a GPU device
+func (m *Manager) newDeviceInfo(device nvidia.GPUDevice, hostname string) *DeviceInfo {
+	return &DeviceInfo{
+		Identifiers:  []string{nvidia.GetDeviceID(device), device.UUID},
+		Name:         DeviceName(m.config(), device, hostname),
 		Model:        device.Name,
 		Manufacturer: "NVIDIA",
-		SwVersion:    "NVML",
+		SwVersion:    swVersion(),
+		ViaDevice:    m.viaDevice(hostname),
+	}
+}
+
+// swVersion returns the software version of the devices, the build version of this service
+// with the NVML version, e.g. "v1.2.3 (NVML 12.535.133.00)"
+func swVersion() string {
+	nvmlVersion, err := nvidia.GetNVMLVersion()
+	if err != nil {
+		return Version
+	}
+	return fmt.Sprintf("%s (NVML %s)", Version, nvmlVersion)
+}
+
+// viaDevice returns the identifier of the device GPUs are nested under (empty for none)
+func (m *Manager) viaDevice(hostname string) string {
+	if m.config().ViaDevice == "host" {
+		return hostDeviceIdentifier(hostname)
+	}
+	return m.config().ViaDevice
+}
+
+// DeviceName returns the Home Assistant device name of a GPU: the configured
+// device_names override for its UUID, short UUID or index, else the display name
+func DeviceName(cfg *config.Config, device nvidia.GPUDevice, hostname string) string {
+	for key, name := range cfg.DeviceNames {
+		if strings.EqualFold(key, device.UUID) || strings.EqualFold(key, nvidia.GetShortUUID(device.UUID)) || key == strconv.Itoa(device.Index) {
+			return name
+		}
+	}
+	return nvidia.GetDeviceDisplayName(device, hostname, cfg.DeviceNameTemplate)
+}
+
+// DefaultDiscoveryPrefix is the MQTT discovery prefix Home Assistant subscribes to by default
+const DefaultDiscoveryPrefix = "homeassistant"
+
+// DiscoveryTopic returns the topic <prefix>/<component>/<node_id>/<objectID>/<suffix>
+// of an entity, with the configured discovery_node_id as the node ID
+func DiscoveryTopic(cfg *config.Config, component, objectID, suffix string) string {
+	return prefixedDiscoveryTopic(DefaultDiscoveryPrefix, cfg, component, objectID, suffix)
+}
+
+// prefixedDiscoveryTopic returns the discovery topic of an entity under another discovery prefix
+func prefixedDiscoveryTopic(prefix string, cfg *config.Config, component, objectID, suffix string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s", strings.TrimSuffix(prefix, "/"), component, cfg.DiscoveryNodeID, objectID, suffix)
+}
+
+// ObjectID joins parts with underscores into a discovery object ID, replacing the
+// characters Home Assistant does not allow (anything but [a-zA-Z0-9_-]) with underscores
+func ObjectID(parts ...string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+}
+
+// StateTopic returns the state topic of a sensor from the configured state_topic_template.
+// Discovery configs and published states must both use it so that they always match.
+func StateTopic(cfg *config.Config, deviceID, sensor string) string {
+	return componentStateTopic(cfg, "sensor", deviceID, sensor)
+}
+
+// BinarySensorStateTopic returns the state topic of a binary sensor, like StateTopic
+func BinarySensorStateTopic(cfg *config.Config, deviceID, sensor string) string {
+	return componentStateTopic(cfg, "binary_sensor", deviceID, sensor)
+}
+
+// componentStateTopic renders the state_topic_template for a sensor of component
+func componentStateTopic(cfg *config.Config, component, deviceID, sensor string) string {
+	fields := config.StateTopicFields{Component: component, NodeID: cfg.DiscoveryNodeID, DeviceID: deviceID, Sensor: sensor}
+	topic, err := config.RenderStateTopic(cfg.StateTopicTemplate, fields)
+	if err != nil {
+		log.Printf("Warning: invalid state topic template %q, using default layout: %v", cfg.StateTopicTemplate, err)
+		topic, _ = config.RenderStateTopic(config.DefaultStateTopicTemplate, fields)
+	}
+	return topic
+}
+
+// memoryUsedSensor presents the VRAM usage sensor as the used VRAM in the configured data size unit
+func memoryUsedSensor(cfg *config.Config, sensor sensorDefinition) sensorDefinition {
+	sensor.name = "VRAM Used"
+	sensor.deviceClass = "data_size"
+	sensor.unit = cfg.MemoryUsageUnit
+	switch cfg.MemoryUsageUnit {
+	case "GiB":
+		sensor.template = "{{ value | round(2) }}"
+	default:
+		sensor.template = "{{ value | round(0) | int }}"
+	}
+	return sensor
+}
+
+// windowStatsSensors are the min/max/avg sensors over the configured stats_window
+var windowStatsSensors = []sensorDefinition{
+	{key: "temperature_min", name: "GPU Temperature Min", deviceClass: "temperature", unit: "°C", icon: "mdi:thermometer-low", stateClass: "measurement"},
+	{key: "temperature_max", name: "GPU Temperature Max", deviceClass: "temperature", unit: "°C", icon: "mdi:thermometer-high", stateClass: "measurement"},
+	{key: "temperature_avg", name: "GPU Temperature Avg", deviceClass: "temperature", unit: "°C", icon: "mdi:thermometer", stateClass: "measurement"},
+	{key: "power_draw_min", name: "Power Draw Min", deviceClass: "power", unit: "W", icon: "mdi:lightning-bolt-outline", stateClass: "measurement", template: "{{ value | round(1) }}"},
+	{key: "power_draw_max", name: "Power Draw Max", deviceClass: "power", unit: "W", icon: "mdi:lightning-bolt", stateClass: "measurement", template: "{{ value | round(1) }}"},
+	{key: "power_draw_avg", name: "Power Draw Avg", deviceClass: "power", unit: "W", icon: "mdi:lightning-bolt", stateClass: "measurement", template: "{{ value | round(1) }}"},
+}
+
+// performanceLevels are the options of the performance level enum sensor, P0 (maximum
+// performance) to P15 (minimum performance)
+var performanceLevels = func() []string {
+	levels := make([]string, 16)
+	for i := range levels {
+		levels[i] = fmt.Sprintf("P%d", i)
 	}
+	return levels
+}()
 
-	sensors := []struct {
-		key         string
-		name        string
-		deviceClass string
-		unit        string
-		icon        string
-		stateClass  string
-		template    string
-	}{
+// binarySensorDefinition describes an ON/OFF sensor of a GPU
+type binarySensorDefinition struct {
+	key         string
+	name        string
+	deviceClass string
+	icon        string
+}
+
+// gpuBinarySensors returns the binary sensors exposed for a GPU device, depending on its capabilities
+func gpuBinarySensors(device nvidia.GPUDevice) []binarySensorDefinition {
+	sensors := []binarySensorDefinition{
+		{key: "busy", name: "GPU Busy", deviceClass: "running", icon: "mdi:chip"},
+	}
+
+	// Decoded from the throttle reasons bitmask, so automations don't need to parse it
+	if device.HasThrottleReasons {
+		sensors = append(sensors,
+			binarySensorDefinition{key: "throttle_thermal", name: "Thermal Throttling", deviceClass: "heat", icon: "mdi:thermometer-alert"},
+			binarySensorDefinition{key: "throttle_power", name: "Power Throttling", deviceClass: "problem", icon: "mdi:flash-alert"},
+		)
+	}
+	if device.HasReliabilityViolations {
+		sensors = append(sensors, binarySensorDefinition{key: "throttle_reliability", name: "Reliability Throttling", deviceClass: "problem", icon: "mdi:shield-alert"})
+	}
+	return sensors
+}
+
+// gpuSensors returns the sensors exposed for a GPU device, depending on its capabilities
+func gpuSensors(device nvidia.GPUDevice) []sensorDefinition {
+	sensors := []sensorDefinition{
 		{
 			key:         "power_draw",
 			name:        "Power Draw",
@@ -83,10 +506,19 @@ func (m *Manager) RegisterGPUSensors(device nvidia.GPUDevice, hostname string) e
 		{
 			key:         "performance_level",
 			name:        "Performance Level",
-			deviceClass: "",
+			deviceClass: "enum",
 			unit:        "",
 			icon:        "mdi:speedometer",
 			stateClass:  "",
+			options:     performanceLevels,
+		},
+		{
+			key:         "performance_state_num",
+			name:        "Performance State",
+			deviceClass: "",
+			unit:        "",
+			icon:        "mdi:speedometer",
+			stateClass:  "measurement",
 		},
 		{
 			key:         "memory_usage",
@@ -105,6 +537,15 @@ func (m *Manager) RegisterGPUSensors(device nvidia.GPUDevice, hostname string) e
 			icon:        "mdi:chip",
 			stateClass:  "measurement",
 		},
+		{
+			key:         "memory_bandwidth_util",
+			name:        "Memory Bandwidth Utilization",
+			deviceClass: "",
+			unit:        "%",
+			icon:        "mdi:swap-horizontal",
+			stateClass:  "measurement",
+			template:    "{{ value | round(1) }}",
+		},
 		{
 			key:         "temperature",
 			name:        "GPU Temperature",
@@ -113,48 +554,438 @@ func (m *Manager) RegisterGPUSensors(device nvidia.GPUDevice, hostname string) e
 			icon:        "mdi:thermometer",
 			stateClass:  "measurement",
 		},
+		{
+			key:         "energy_consumption",
+			name:        "Energy Consumption",
+			deviceClass: "energy",
+			unit:        "kWh",
+			icon:        "mdi:lightning-bolt-circle",
+			stateClass:  "total_increasing",
+			template:    "{{ value | round(3) }}",
+		},
+		{
+			key:         "graphics_clock",
+			name:        "Graphics Clock",
+			deviceClass: "frequency",
+			unit:        "MHz",
+			icon:        "mdi:sine-wave",
+			stateClass:  "measurement",
+		},
+		{
+			key:            "max_graphics_clock",
+			name:           "Max Graphics Clock",
+			deviceClass:    "frequency",
+			unit:           "MHz",
+			icon:           "mdi:sine-wave",
+			stateClass:     "measurement",
+			entityCategory: "diagnostic",
+		},
+		{
+			key:            "applications_clock",
+			name:           "Applications Clock",
+			deviceClass:    "frequency",
+			unit:           "MHz",
+			icon:           "mdi:sine-wave",
+			stateClass:     "measurement",
+			entityCategory: "diagnostic",
+		},
+		{
+			key:         "video_clock",
+			name:        "Video Clock",
+			deviceClass: "frequency",
+			unit:        "MHz",
+			icon:        "mdi:sine-wave",
+			stateClass:  "measurement",
+		},
+		// A current link below the maximum under load hints at a badly seated card or riser
+		{
+			key:            "pcie_link_gen",
+			name:           "PCIe Link Generation",
+			icon:           "mdi:expansion-card",
+			stateClass:     "measurement",
+			entityCategory: "diagnostic",
+		},
+		{
+			key:            "max_pcie_link_gen",
+			name:           "Max PCIe Link Generation",
+			icon:           "mdi:expansion-card",
+			entityCategory: "diagnostic",
+		},
+		{
+			key:            "pcie_link_width",
+			name:           "PCIe Link Width",
+			unit:           "lanes",
+			icon:           "mdi:expansion-card-variant",
+			stateClass:     "measurement",
+			entityCategory: "diagnostic",
+		},
+		{
+			key:            "max_pcie_link_width",
+			name:           "Max PCIe Link Width",
+			unit:           "lanes",
+			icon:           "mdi:expansion-card-variant",
+			entityCategory: "diagnostic",
+		},
 	}
 
-	for _, sensor := range sensors {
-		if err := m.registerSensor(deviceID, deviceName, sensor.key, sensor.name,
-			sensor.deviceClass, sensor.unit, sensor.icon, sensor.stateClass,
-			sensor.template, deviceInfo); err != nil {
-			return fmt.Errorf("failed to register sensor %s: %v", sensor.key, err)
+	// Published as a JSON string, so the template unwraps it for the timestamp device class
+	sensors = append(sensors, sensorDefinition{
+		key:            "last_update",
+		name:           "Last Update",
+		deviceClass:    "timestamp",
+		icon:           "mdi:clock-outline",
+		template:       "{{ value_json }}",
+		entityCategory: "diagnostic",
+	})
+
+	// Only cards with a memory temperature sensor get this entity
+	if device.HasMemoryTemperature {
+		sensors = append(sensors, sensorDefinition{
+			key:         "memory_temperature",
+			name:        "GPU Memory Temperature",
+			deviceClass: "temperature",
+			unit:        "°C",
+			icon:        "mdi:thermometer",
+			stateClass:  "measurement",
+		})
+	}
+
+	// BAR1 memory is mostly relevant for GPUDirect/RDMA workloads
+	if device.HasBAR1 {
+		sensors = append(sensors, sensorDefinition{
+			key:            "bar1_usage",
+			name:           "BAR1 Memory Usage",
+			unit:           "%",
+			icon:           "mdi:memory",
+			stateClass:     "measurement",
+			template:       "{{ value | round(1) }}",
+			entityCategory: "diagnostic",
+		})
+	}
+
+	// Reserved VRAM staying high while the used VRAM drops points at allocator fragmentation
+	if device.HasMemoryInfoV2 {
+		sensors = append(sensors, sensorDefinition{
+			key:            "memory_reserved",
+			name:           "VRAM Reserved",
+			deviceClass:    "data_size",
+			unit:           "MiB",
+			icon:           "mdi:memory",
+			stateClass:     "measurement",
+			template:       "{{ value | round(0) | int }}",
+			entityCategory: "diagnostic",
+		})
+	}
+
+	// Comma-separated active throttle reasons, "none" while running at full clocks
+	if device.HasThrottleReasons {
+		sensors = append(sensors, sensorDefinition{
+			key:            "throttle_reasons",
+			name:           "Throttle Reasons",
+			icon:           "mdi:speedometer-slow",
+			template:       "{{ value_json }}",
+			entityCategory: "diagnostic",
+		})
+	}
+
+	// NVENC sessions for streaming and transcoding dashboards, both 0 while idle
+	if device.HasEncoderStats {
+		sensors = append(sensors,
+			sensorDefinition{
+				key:        "encoder_sessions",
+				name:       "Encoder Sessions",
+				icon:       "mdi:video-box",
+				stateClass: "measurement",
+			},
+			sensorDefinition{
+				key:        "encoder_fps",
+				name:       "Encoder FPS",
+				unit:       "fps",
+				icon:       "mdi:filmstrip",
+				stateClass: "measurement",
+			},
+		)
+	}
+
+	// Compute and persistence mode catch a shared card left in exclusive mode
+	if device.HasComputeMode {
+		sensors = append(sensors, sensorDefinition{
+			key:            "compute_mode",
+			name:           "Compute Mode",
+			icon:           "mdi:account-lock",
+			entityCategory: "diagnostic",
+		})
+	}
+	if device.HasPersistenceMode {
+		sensors = append(sensors, sensorDefinition{
+			key:            "persistence_mode",
+			name:           "Persistence Mode",
+			icon:           "mdi:pin",
+			entityCategory: "diagnostic",
+		})
+	}
+
+	// NVLink sensors only exist on multi-GPU rigs with NVLink bridges or SXM boards
+	if len(device.NvLinks) > 0 {
+		sensors = append(sensors,
+			sensorDefinition{
+				key:         "nvlink_throughput",
+				name:        "NVLink Throughput",
+				deviceClass: "data_rate",
+				unit:        "MB/s",
+				icon:        "mdi:swap-horizontal-bold",
+				stateClass:  "measurement",
+				template:    "{{ value | round(1) }}",
+			},
+			sensorDefinition{
+				key:        "nvlink_state",
+				name:       "NVLink Active Links",
+				icon:       "mdi:link-variant",
+				stateClass: "measurement",
+			},
+			sensorDefinition{
+				key:            "nvlink_errors",
+				name:           "NVLink Errors",
+				icon:           "mdi:link-variant-off",
+				stateClass:     "total_increasing",
+				entityCategory: "diagnostic",
+			},
+		)
+	}
+
+	// Clock offsets are signed (negative for underclocking)
+	if device.HasClockOffsets {
+		sensors = append(sensors,
+			sensorDefinition{
+				key:            "clock_offset_core",
+				name:           "Core Clock Offset",
+				unit:           "MHz",
+				icon:           "mdi:sine-wave",
+				stateClass:     "measurement",
+				template:       "{{ value | int }}",
+				entityCategory: "diagnostic",
+			},
+			sensorDefinition{
+				key:            "clock_offset_memory",
+				name:           "Memory Clock Offset",
+				unit:           "MHz",
+				icon:           "mdi:sine-wave",
+				stateClass:     "measurement",
+				template:       "{{ value | int }}",
+				entityCategory: "diagnostic",
+			},
+		)
+	}
+
+	return sensors
+}
+
+// staticSensor is a diagnostic sensor whose value is known at registration time
+type staticSensor struct {
+	sensorDefinition
+	value interface{}
+}
+
+// staticSensors returns the diagnostic sensors describing a GPU device
+func staticSensors(device nvidia.GPUDevice) []staticSensor {
+	sensors := []staticSensor{
+		{
+			sensorDefinition: sensorDefinition{
+				key:            "vram_total",
+				name:           "Total VRAM",
+				deviceClass:    "data_size",
+				unit:           "MiB",
+				icon:           "mdi:memory",
+				entityCategory: "diagnostic",
+			},
+			value: device.Memory / (1024 * 1024),
+		},
+		{
+			sensorDefinition: sensorDefinition{
+				key:            "pci_id",
+				name:           "PCI ID",
+				icon:           "mdi:expansion-card",
+				entityCategory: "diagnostic",
+			},
+			value: nvidia.GetShortPCIBusID(device.PCIBusID),
+		},
+		{
+			sensorDefinition: sensorDefinition{
+				key:            "uuid",
+				name:           "UUID",
+				icon:           "mdi:identifier",
+				entityCategory: "diagnostic",
+			},
+			value: device.UUID,
+		},
+	}
+
+	if device.SlowdownTemperature > 0 {
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "temperature_slowdown",
+				name:           "Slowdown Temperature",
+				deviceClass:    "temperature",
+				unit:           "°C",
+				icon:           "mdi:thermometer-alert",
+				entityCategory: "diagnostic",
+			},
+			value: device.SlowdownTemperature,
+		})
+	}
+
+	if device.ShutdownTemperature > 0 {
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "temperature_shutdown",
+				name:           "Shutdown Temperature",
+				deviceClass:    "temperature",
+				unit:           "°C",
+				icon:           "mdi:thermometer-off",
+				entityCategory: "diagnostic",
+			},
+			value: device.ShutdownTemperature,
+		})
+	}
+
+	// Serial and VBIOS version for reconciling the GPUs with an asset inventory
+	if device.Diagnostics.Serial != "" {
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "serial",
+				name:           "Serial Number",
+				icon:           "mdi:barcode",
+				entityCategory: "diagnostic",
+			},
+			value: device.Diagnostics.Serial,
+		})
+	}
+
+	if device.Diagnostics.VBIOSVersion != "" {
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "vbios_version",
+				name:           "VBIOS Version",
+				icon:           "mdi:chip",
+				entityCategory: "diagnostic",
+			},
+			value: device.Diagnostics.VBIOSVersion,
+		})
+	}
+
+	// Several NVML readings behave differently inside a VM or on a vGPU host
+	if device.Diagnostics.VirtualizationMode != "" {
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "virtualization_mode",
+				name:           "Virtualization Mode",
+				icon:           "mdi:server-network",
+				entityCategory: "diagnostic",
+			},
+			value: device.Diagnostics.VirtualizationMode,
+		})
+	}
+
+	// NUMA nodes for pinning workers to the CPU socket of the GPU, e.g. "0" or "0,1"
+	if len(device.Diagnostics.NUMANodes) > 0 {
+		nodes := make([]string, len(device.Diagnostics.NUMANodes))
+		for i, node := range device.Diagnostics.NUMANodes {
+			nodes[i] = strconv.Itoa(node)
 		}
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "numa_node",
+				name:           "NUMA Node",
+				icon:           "mdi:cpu-64-bit",
+				entityCategory: "diagnostic",
+			},
+			value: strings.Join(nodes, ","),
+		})
 	}
 
-	return nil
+	// Peer-to-peer links for checking that NCCL can use the fast paths, e.g. "GPU1 NVLink, GPU2 PCIe"
+	if len(device.P2PPeers) > 0 {
+		peers := make([]string, len(device.P2PPeers))
+		for i, peer := range device.P2PPeers {
+			peers[i] = fmt.Sprintf("GPU%d %s", peer.Index, peer.Link)
+		}
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "p2p_peers",
+				name:           "P2P Peers",
+				icon:           "mdi:swap-horizontal",
+				entityCategory: "diagnostic",
+			},
+			value: strings.Join(peers, ", "),
+		})
+	}
+
+	if driverVersion, err := nvidia.GetDriverVersion(); err == nil {
+		sensors = append(sensors, staticSensor{
+			sensorDefinition: sensorDefinition{
+				key:            "driver_version",
+				name:           "Driver Version",
+				icon:           "mdi:information-outline",
+				entityCategory: "diagnostic",
+			},
+			value: driverVersion,
+		})
+	}
+
+	return sensors
 }
 
-// registerSensor registers a single sensor with Home Assistant
-func (m *Manager) registerSensor(deviceID, deviceName, sensorKey, sensorName, deviceClass, unit, icon, stateClass, template string, deviceInfo *DeviceInfo) error {
-	uniqueID := fmt.Sprintf("nvml_gpu_%s_%s", deviceID, sensorKey)
-	stateTopic := fmt.Sprintf("homeassistant/sensor/nvml-gpu/%s_%s/state", deviceID, sensorKey)
-	configTopic := fmt.Sprintf("homeassistant/sensor/nvml-gpu/%s_%s/config", deviceID, sensorKey)
+// registerSensor queues the discovery config of a single sensor on batch. Sensors
+// disabled in the config are removed instead, in case they were registered before.
+// GPU sensors pass the availability of their GPU, host sensors nil.
+func (m *Manager) registerSensor(batch *publishBatch, deviceID string, sensor sensorDefinition, deviceInfo *DeviceInfo, availability []Availability) error {
+	uniqueID := fmt.Sprintf("nvml_gpu_%s_%s", deviceID, sensor.key)
+	stateTopic := StateTopic(m.config(), deviceID, sensor.key)
+	configTopic := DiscoveryTopic(m.config(), "sensor", ObjectID(deviceID, sensor.key), "config")
 
-	fullSensorName := sensorName
+	if !m.config().SensorEnabled(sensor.key) {
+		batch.removeConfig("sensor "+sensor.name, configTopic)
+		return nil
+	}
+
+	fullSensorName := sensor.name
+
+	// Temperature sensors are defined in Celsius and published in the configured unit
+	if sensor.unit == "°C" {
+		sensor.unit = m.config().TemperatureUnitSymbol()
+	}
+	sensor = applySensorOverride(m.config(), sensor)
 
 	sensorConfig := SensorConfig{
 		Name:              fullSensorName,
 		StateTopic:        stateTopic,
 		UniqueID:          uniqueID,
-		DeviceClass:       deviceClass,
-		UnitOfMeasurement: unit,
-		Icon:              icon,
+		DeviceClass:       sensor.deviceClass,
+		UnitOfMeasurement: sensor.unit,
+		Icon:              sensor.icon,
 		Device:            deviceInfo,
-		StateClass:        stateClass,
-		ForceUpdate:       true,
+		StateClass:        sensor.stateClass,
+		ForceUpdate:       m.config().ForceUpdate,
+		EntityCategory:    sensor.entityCategory,
+		Options:           sensor.options,
+		Origin:            newOriginInfo(),
 	}
 
-	if template != "" {
+	if sensor.template != "" {
+		sensorConfig.ValueTemplate = sensor.template
+	}
+	if template, ok := m.precisionTemplate(sensor); ok {
 		sensorConfig.ValueTemplate = template
 	}
 
-	// Add availability if LWT is enabled
-	if m.config.MQTTLWTEnable {
-		sensorConfig.AvailabilityTopic = "homeassistant/sensor/nvml-gpu-ha/availability"
-		sensorConfig.PayloadAvailable = "online"
-		sensorConfig.PayloadNotAvailable = "offline"
+	// GPU sensors follow their GPU and the service, host sensors the service if LWT is enabled
+	if len(availability) > 0 {
+		sensorConfig.Availability = availability
+		sensorConfig.AvailabilityMode = "all"
+	} else if m.config().MQTTLWTEnable {
+		sensorConfig.AvailabilityTopic = m.config().AvailabilityTopic
+		sensorConfig.PayloadAvailable = m.config().PayloadAvailable
+		sensorConfig.PayloadNotAvailable = m.config().PayloadNotAvailable
 	}
 
 	configJSON, err := json.Marshal(sensorConfig)
@@ -162,45 +993,463 @@ func (m *Manager) registerSensor(deviceID, deviceName, sensorKey, sensorName, de
 		return fmt.Errorf("failed to marshal sensor config: %v", err)
 	}
 
-	token := m.client.Publish(configTopic, 1, m.config.MQTTRetain, configJSON)
-	if !token.WaitTimeout(5*1e9) || token.Error() != nil { // 5 seconds
-		return fmt.Errorf("failed to publish sensor config: %v", token.Error())
+	batch.publishConfig("sensor "+fullSensorName, configTopic, configJSON)
+	return nil
+}
+
+// RegisterBinarySensor registers an ON/OFF binary sensor for a GPU device
+func (m *Manager) RegisterBinarySensor(device nvidia.GPUDevice, hostname, sensorKey, sensorName, deviceClass, icon string) error {
+	batch := m.newBatch()
+	if err := m.registerBinarySensor(batch, device, hostname, sensorKey, sensorName, deviceClass, icon); err != nil {
+		return err
+	}
+	return batch.wait()
+}
+
+// registerBinarySensor queues the discovery config of an ON/OFF binary sensor on batch
+func (m *Manager) registerBinarySensor(batch *publishBatch, device nvidia.GPUDevice, hostname, sensorKey, sensorName, deviceClass, icon string) error {
+	deviceID := nvidia.GetDeviceID(device)
+	uniqueID := fmt.Sprintf("nvml_gpu_%s_%s", deviceID, sensorKey)
+	stateTopic := BinarySensorStateTopic(m.config(), deviceID, sensorKey)
+	configTopic := DiscoveryTopic(m.config(), "binary_sensor", ObjectID(deviceID, sensorKey), "config")
+
+	if !m.config().SensorEnabled(sensorKey) {
+		batch.removeConfig("binary sensor "+sensorName, configTopic)
+		return nil
+	}
+
+	binarySensorConfig := BinarySensorConfig{
+		Name:        sensorName,
+		StateTopic:  stateTopic,
+		UniqueID:    uniqueID,
+		DeviceClass: deviceClass,
+		Icon:        icon,
+		Device:      m.newDeviceInfo(device, hostname),
+		PayloadOn:   "ON",
+		PayloadOff:  "OFF",
+		Origin:      newOriginInfo(),
+
+		Availability:     m.gpuAvailability(deviceID),
+		AvailabilityMode: "all",
+	}
+
+	configJSON, err := json.Marshal(binarySensorConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal binary sensor config: %v", err)
+	}
+
+	batch.publishConfig("binary sensor "+sensorName, configTopic, configJSON)
+	return nil
+}
+
+// RegisterButtonEntity registers a button for a GPU device and calls onPress with the
+// current handle of the device when it is pressed
+func (m *Manager) RegisterButtonEntity(device nvidia.GPUDevice, hostname, buttonKey, buttonName, icon string, onPress func(device nvidia.GPUDevice) error) error {
+	deviceID := nvidia.GetDeviceID(device)
+	uniqueID := fmt.Sprintf("nvml_gpu_%s_%s", deviceID, buttonKey)
+	commandTopic := DiscoveryTopic(m.config(), "button", ObjectID(deviceID, buttonKey), "command")
+	configTopic := DiscoveryTopic(m.config(), "button", ObjectID(deviceID, buttonKey), "config")
+
+	buttonConfig := ButtonConfig{
+		Name:           buttonName,
+		CommandTopic:   commandTopic,
+		UniqueID:       uniqueID,
+		Icon:           icon,
+		Device:         m.newDeviceInfo(device, hostname),
+		PayloadPress:   "PRESS",
+		EntityCategory: "config",
+		Origin:         newOriginInfo(),
+
+		Availability:     m.gpuAvailability(deviceID),
+		AvailabilityMode: "all",
+	}
+
+	configJSON, err := json.Marshal(buttonConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal button config: %v", err)
+	}
+
+	if m.config().DryRun {
+		log.Printf("[dry-run] %s: %s", configTopic, configJSON)
+		return nil
+	}
+
+	if err := m.publish(configTopic, m.config().DiscoveryQoS, m.config().RetainDiscovery(), configJSON); err != nil {
+		return fmt.Errorf("failed to publish button config: %v", err)
+	}
+
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) != buttonConfig.PayloadPress {
+			return
+		}
+
+		device := m.currentDevice(device)
+		log.Printf("Button pressed: %s (%s)", buttonName, device.Name)
+		if err := onPress(device); err != nil {
+			log.Printf("Failed to handle button %s for GPU %s: %v", buttonName, device.Name, err)
+			return
+		}
+		log.Printf("Handled button %s for GPU %s", buttonName, device.Name)
+	}
+
+	if err := m.subscribe(commandTopic, handler); err != nil {
+		return err
+	}
+
+	log.Printf("Registered button: %s", buttonName)
+	return nil
+}
+
+// RegisterNumberEntity registers a number for a GPU device and calls onSet with the
+// current handle of the device and the requested value. When onSet fails because the device does not support the control
+// or permissions are missing, the entity is marked unavailable.
+func (m *Manager) RegisterNumberEntity(device nvidia.GPUDevice, hostname, numberKey, numberName, icon string, min, max int, unit string, onSet func(device nvidia.GPUDevice, value int) error) error {
+	deviceID := nvidia.GetDeviceID(device)
+	uniqueID := fmt.Sprintf("nvml_gpu_%s_%s", deviceID, numberKey)
+	commandTopic := DiscoveryTopic(m.config(), "number", ObjectID(deviceID, numberKey), "command")
+	stateTopic := DiscoveryTopic(m.config(), "number", ObjectID(deviceID, numberKey), "state")
+	availabilityTopic := DiscoveryTopic(m.config(), "number", ObjectID(deviceID, numberKey), "availability")
+	configTopic := DiscoveryTopic(m.config(), "number", ObjectID(deviceID, numberKey), "config")
+
+	numberConfig := NumberConfig{
+		Name:              numberName,
+		CommandTopic:      commandTopic,
+		StateTopic:        stateTopic,
+		UniqueID:          uniqueID,
+		Min:               min,
+		Max:               max,
+		Step:              1,
+		Mode:              "slider",
+		UnitOfMeasurement: unit,
+		Icon:              icon,
+		Device:            m.newDeviceInfo(device, hostname),
+		Availability: append([]Availability{{
+			Topic:               availabilityTopic,
+			PayloadAvailable:    m.config().PayloadAvailable,
+			PayloadNotAvailable: m.config().PayloadNotAvailable,
+		}}, m.gpuAvailability(deviceID)...),
+		AvailabilityMode: "all",
+		EntityCategory:   "config",
+		Origin:           newOriginInfo(),
+	}
+
+	configJSON, err := json.Marshal(numberConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal number config: %v", err)
+	}
+
+	if m.config().DryRun {
+		log.Printf("[dry-run] %s: %s", configTopic, configJSON)
+		return nil
+	}
+
+	if err := m.publish(configTopic, m.config().DiscoveryQoS, m.config().RetainDiscovery(), configJSON); err != nil {
+		return fmt.Errorf("failed to publish number config: %v", err)
+	}
+	if err := m.publishAvailability(availabilityTopic, m.config().PayloadAvailable); err != nil {
+		return err
+	}
+
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		device := m.currentDevice(device)
+		value, err := strconv.ParseFloat(string(msg.Payload()), 64)
+		if err != nil {
+			log.Printf("Invalid value for %s (%s): %q", numberName, device.Name, msg.Payload())
+			return
+		}
+
+		log.Printf("Setting %s for GPU %s to %v", numberName, device.Name, value)
+		if err := onSet(device, int(math.Round(value))); err != nil {
+			log.Printf("Failed to set %s for GPU %s: %v", numberName, device.Name, err)
+			if errors.Is(err, nvidia.ErrNotSupported) || errors.Is(err, nvidia.ErrNoPermission) {
+				if err := m.publishAvailability(availabilityTopic, m.config().PayloadNotAvailable); err != nil {
+					log.Printf("Failed to mark %s unavailable: %v", numberName, err)
+				}
+			}
+			return
+		}
+
+		if err := m.publishState(stateTopic, []byte(strconv.Itoa(int(math.Round(value)))), m.config().StateQoS, m.config().RetainState()); err != nil {
+			log.Printf("Failed to publish %s state: %v", numberName, err)
+		}
 	}
 
-	log.Printf("Registered sensor: %s", fullSensorName)
+	if err := m.subscribe(commandTopic, handler); err != nil {
+		return err
+	}
+
+	log.Printf("Registered number: %s", numberName)
 	return nil
 }
 
-// RemoveGPUSensors removes all sensors for a GPU device
-func (m *Manager) RemoveGPUSensors(device nvidia.GPUDevice) error {
+// PublishNumberState publishes the current value of a number entity
+func (m *Manager) PublishNumberState(device nvidia.GPUDevice, numberKey string, value int) error {
+	stateTopic := DiscoveryTopic(m.config(), "number", ObjectID(nvidia.GetDeviceID(device), numberKey), "state")
+	return m.publishState(stateTopic, []byte(strconv.Itoa(value)), m.config().StateQoS, m.config().RetainState())
+}
+
+// publishState publishes a sensor state or availability payload, or only logs it in dry-run mode
+func (m *Manager) publishState(topic string, payload []byte, qos int, retained bool) error {
+	if m.config().DryRun {
+		log.Printf("[dry-run] %s: %s", topic, payload)
+		return nil
+	}
+
+	if err := m.publish(topic, qos, retained, payload); err != nil {
+		return fmt.Errorf("failed to publish state: %v", err)
+	}
+	return nil
+}
+
+// publish publishes a message to all brokers and waits for them to confirm it
+func (m *Manager) publish(topic string, qos int, retained bool, payload interface{}) error {
+	return Publish(m.clients, topic, byte(qos), retained, payload, m.config().PublishTimeout())
+}
+
+// subscribe subscribes to a command topic on all brokers and remembers it for
+// Resubscribe, so the entity can be controlled from the Home Assistant of every broker
+func (m *Manager) subscribe(topic string, handler mqtt.MessageHandler) error {
+	m.subscriptionsMutex.Lock()
+	m.subscriptions[topic] = handler
+	m.subscriptionsMutex.Unlock()
+
+	tokens := make([]mqtt.Token, len(m.clients))
+	for i, client := range m.clients {
+		tokens[i] = client.Subscribe(topic, 1, handler)
+	}
+	if err := waitAll(m.clients, tokens, m.config().PublishTimeout()); err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %v", topic, err)
+	}
+	return nil
+}
+
+// Resubscribe restores the command topic subscriptions on client, e.g. after it
+// reconnected to its broker
+func (m *Manager) Resubscribe(client mqtt.Client) {
+	m.subscriptionsMutex.Lock()
+	defer m.subscriptionsMutex.Unlock()
+
+	for topic, handler := range m.subscriptions {
+		token := client.Subscribe(topic, 1, handler)
+		if !token.WaitTimeout(m.config().PublishTimeout()) || token.Error() != nil {
+			log.Printf("Failed to resubscribe to %s: %v", topic, token.Error())
+		}
+	}
+}
+
+// precisionTemplate returns a rounding value template for the configured precision of
+// a sensor
+func (m *Manager) precisionTemplate(sensor sensorDefinition) (string, bool) {
+	precision, ok := sensorPrecision(m.config(), sensor)
+	if !ok {
+		return "", false
+	}
+
+	if precision <= 0 {
+		return "{{ value | round(0) | int }}", true
+	}
+	return fmt.Sprintf("{{ value | round(%d) }}", precision), true
+}
+
+// sensorPrecision returns the configured number of decimals of a sensor. The default
+// precision only applies to numeric (state class) sensors.
+func sensorPrecision(cfg *config.Config, sensor sensorDefinition) (int, bool) {
+	if precision, ok := cfg.SensorPrecision[sensor.key]; ok {
+		return precision, true
+	}
+	if cfg.DefaultPrecision < 0 || sensor.stateClass == "" {
+		return 0, false
+	}
+	return cfg.DefaultPrecision, true
+}
+
+// applySensorOverride replaces the icon, device class and unit of sensor by the ones
+// configured in sensor_overrides. The published values are not converted.
+func applySensorOverride(cfg *config.Config, sensor sensorDefinition) sensorDefinition {
+	override, ok := cfg.SensorOverrides[sensor.key]
+	if !ok {
+		return sensor
+	}
+	if override.Icon != "" {
+		sensor.icon = override.Icon
+	}
+	if override.DeviceClass != "" {
+		sensor.deviceClass = override.DeviceClass
+	}
+	if override.Unit != "" {
+		sensor.unit = override.Unit
+	}
+	return sensor
+}
+
+// UnknownSensorOverrides returns the sorted keys of sensor_overrides that match no sensor
+// of devices or the host device, e.g. misspelled keys
+func UnknownSensorOverrides(cfg *config.Config, devices []nvidia.GPUDevice) []string {
+	known := make(map[string]bool)
+	for _, sensor := range hostSensors {
+		known[sensor.key] = true
+	}
+	for _, sensor := range windowStatsSensors {
+		known[sensor.key] = true
+	}
+	for _, device := range devices {
+		for _, sensor := range gpuSensors(device) {
+			known[sensor.key] = true
+		}
+		for _, sensor := range staticSensors(device) {
+			known[sensor.key] = true
+		}
+	}
+
+	var unknown []string
+	for key := range cfg.SensorOverrides {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// RemoveGPUSensors removes all entities of a GPU device under the discovery prefix and
+// returns how many were removed
+func (m *Manager) RemoveGPUSensors(device nvidia.GPUDevice, prefix string) (int, error) {
 	deviceID := nvidia.GetDeviceID(device)
+	topic := func(component, objectID, suffix string) string {
+		return prefixedDiscoveryTopic(prefix, m.config(), component, objectID, suffix)
+	}
 
-	sensors := []string{"power_draw", "performance_level", "memory_usage", "gpu_utilization", "temperature"}
+	sensors := append(gpuSensors(device), windowStatsSensors...)
+	for _, sensor := range staticSensors(device) {
+		sensors = append(sensors, sensor.sensorDefinition)
+	}
 
+	var configTopics []string
 	for _, sensor := range sensors {
-		configTopic := fmt.Sprintf("homeassistant/sensor/nvml-gpu/%s_%s/config", deviceID, sensor)
+		configTopics = append(configTopics, topic("sensor", ObjectID(deviceID, sensor.key), "config"))
+	}
+	for _, sensor := range gpuBinarySensors(device) {
+		configTopics = append(configTopics, topic("binary_sensor", ObjectID(deviceID, sensor.key), "config"))
+	}
+	if device.HasECC {
+		configTopics = append(configTopics, topic("button", ObjectID(deviceID, "reset_ecc_errors"), "config"))
+	}
+	// Fan controls may have been registered before fan_control was turned off, and
+	// clearing a topic that was never used is harmless
+	if device.FanCount > 0 {
+		for fan := 0; fan < device.FanCount; fan++ {
+			configTopics = append(configTopics, topic("number", ObjectID(deviceID, fmt.Sprintf("fan%d_speed", fan)), "config"))
+		}
+		configTopics = append(configTopics, topic("button", ObjectID(deviceID, "fan_auto"), "config"))
+	}
+	configTopics = append(configTopics, topic("sensor", ObjectID(deviceID), "availability"))
 
-		// Send empty payload to remove the sensor
-		token := m.client.Publish(configTopic, 1, m.config.MQTTRetain, "")
-		if !token.WaitTimeout(5*1e9) || token.Error() != nil {
-			log.Printf("Failed to remove sensor %s: %v", sensor, token.Error())
+	cleared, err := m.removeConfigs(configTopics)
+	log.Printf("Removed entities for GPU: %s", device.Name)
+	return cleared, err
+}
+
+// removeConfigs publishes an empty payload to every topic, removing the entities, and returns
+// how many were confirmed by the broker
+func (m *Manager) removeConfigs(configTopics []string) (int, error) {
+	cleared := 0
+	for _, configTopic := range configTopics {
+		if m.config().DryRun {
+			log.Printf("[dry-run] %s: (remove)", configTopic)
+			cleared++
+			continue
+		}
+
+		// Send empty payload to remove the entity. It is always retained: configs retained
+		// before discovery_retain was turned off are only cleared by a retained empty payload.
+		if err := m.publish(configTopic, m.config().DiscoveryQoS, true, ""); err != nil {
+			log.Printf("Failed to remove entity %s: %v", configTopic, err)
+			continue
 		}
+		cleared++
+	}
+
+	if cleared < len(configTopics) {
+		return cleared, fmt.Errorf("failed to remove %d of %d entities", len(configTopics)-cleared, len(configTopics))
+	}
+	return cleared, nil
+}
+
+// GPUAvailabilityTopic returns the topic telling whether the GPU with deviceID can be read,
+// declared by all entities of the GPU next to the service availability
+func GPUAvailabilityTopic(cfg *config.Config, deviceID string) string {
+	return DiscoveryTopic(cfg, "sensor", ObjectID(deviceID), "availability")
+}
+
+// gpuAvailability returns the availability list of the entities of a GPU: the GPU itself
+// and, if LWT is enabled, the service. All of them have to be available.
+func (m *Manager) gpuAvailability(deviceID string) []Availability {
+	availability := []Availability{{
+		Topic:               GPUAvailabilityTopic(m.config(), deviceID),
+		PayloadAvailable:    m.config().PayloadAvailable,
+		PayloadNotAvailable: m.config().PayloadNotAvailable,
+	}}
+	if m.config().MQTTLWTEnable {
+		availability = append(availability, Availability{
+			Topic:               m.config().AvailabilityTopic,
+			PayloadAvailable:    m.config().PayloadAvailable,
+			PayloadNotAvailable: m.config().PayloadNotAvailable,
+		})
+	}
+	return availability
+}
+
+// PublishGPUAvailability marks the entities of a GPU available or not available,
+// e.g. while the GPU is lost after an Xid error
+func (m *Manager) PublishGPUAvailability(device nvidia.GPUDevice, available bool) error {
+	status := m.config().PayloadNotAvailable
+	if available {
+		status = m.config().PayloadAvailable
 	}
 
+	if err := m.publishAvailability(GPUAvailabilityTopic(m.config(), nvidia.GetDeviceID(device)), status); err != nil {
+		return fmt.Errorf("failed to publish GPU availability: %v", err)
+	}
 	return nil
 }
 
-// PublishAvailability publishes availability status
-func (m *Manager) PublishAvailability(status string) error {
-	if !m.config.MQTTLWTEnable {
+// PublishAvailability publishes the configured available or not available payload
+func (m *Manager) PublishAvailability(available bool) error {
+	if !m.config().MQTTLWTEnable {
 		return nil
 	}
 
-	topic := "homeassistant/sensor/nvml-gpu-ha/availability"
-	token := m.client.Publish(topic, 1, m.config.MQTTRetain, status)
-	if !token.WaitTimeout(5*1e9) || token.Error() != nil {
-		return fmt.Errorf("failed to publish availability: %v", token.Error())
+	status := m.config().PayloadNotAvailable
+	if available {
+		status = m.config().PayloadAvailable
 	}
 
+	if err := m.publishAvailability(m.config().AvailabilityTopic, status); err != nil {
+		return fmt.Errorf("failed to publish availability: %v", err)
+	}
 	return nil
 }
+
+// publishAvailability publishes an availability payload, retained if availability_retain
+// is enabled. Otherwise a payload retained before it was disabled is cleared first, as
+// the broker would keep serving it to new subscribers.
+func (m *Manager) publishAvailability(topic, status string) error {
+	retained := m.config().RetainAvailability()
+
+	m.clearedMutex.Lock()
+	cleared := m.clearedAvailability[topic]
+	if retained {
+		delete(m.clearedAvailability, topic)
+	}
+	m.clearedMutex.Unlock()
+
+	if !retained && !cleared {
+		if err := m.publishState(topic, nil, 1, true); err != nil {
+			return err
+		}
+		m.clearedMutex.Lock()
+		m.clearedAvailability[topic] = true
+		m.clearedMutex.Unlock()
+	}
+	return m.publishState(topic, []byte(status), 1, retained)
+}
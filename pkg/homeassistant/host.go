@@ -0,0 +1,94 @@
+package homeassistant
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// hostSensors are the aggregate sensors of the host-level device
+var hostSensors = []sensorDefinition{
+	{
+		key:        "gpu_count",
+		name:       "GPU Count",
+		icon:       "mdi:expansion-card",
+		stateClass: "measurement",
+	},
+	{
+		key:         "total_power_draw",
+		name:        "Total GPU Power Draw",
+		deviceClass: "power",
+		unit:        "W",
+		icon:        "mdi:lightning-bolt",
+		stateClass:  "measurement",
+		template:    "{{ value | round(1) }}",
+	},
+	{
+		key:            "driver_version",
+		name:           "NVIDIA Driver Version",
+		icon:           "mdi:package-variant",
+		entityCategory: "diagnostic",
+	},
+	{
+		key:            "nvml_version",
+		name:           "NVML Version",
+		icon:           "mdi:package-variant",
+		entityCategory: "diagnostic",
+	},
+}
+
+// HostDeviceID returns the device ID of the host-level device for hostname
+func HostDeviceID(hostname string) string {
+	id := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(hostname))
+	return "host_" + id
+}
+
+// hostDeviceIdentifier returns the HA device identifier of the host-level device for hostname
+func hostDeviceIdentifier(hostname string) string {
+	return "nvml_gpu_" + HostDeviceID(hostname)
+}
+
+// RegisterHostSensors registers the aggregate sensors of the host-level device
+func (m *Manager) RegisterHostSensors(hostname string) error {
+	deviceID := HostDeviceID(hostname)
+	deviceInfo := &DeviceInfo{
+		Identifiers:  []string{hostDeviceIdentifier(hostname)},
+		Name:         fmt.Sprintf("%s GPUs", hostname),
+		Model:        "NVML GPU Host",
+		Manufacturer: "NVIDIA",
+		SwVersion:    swVersion(),
+	}
+	for _, connection := range m.config().HostConnections {
+		kind, value, _ := strings.Cut(connection, ":")
+		deviceInfo.Connections = append(deviceInfo.Connections, []string{kind, value})
+	}
+
+	batch := m.newBatch()
+	for _, sensor := range hostSensors {
+		if err := m.registerSensor(batch, deviceID, sensor, deviceInfo, nil); err != nil {
+			return fmt.Errorf("failed to register sensor %s: %v", sensor.key, err)
+		}
+	}
+
+	return batch.wait()
+}
+
+// RemoveHostSensors removes the aggregate sensors of the host-level device under the
+// discovery prefix and returns how many entities were removed
+func (m *Manager) RemoveHostSensors(hostname, prefix string) (int, error) {
+	deviceID := HostDeviceID(hostname)
+
+	var configTopics []string
+	for _, sensor := range hostSensors {
+		configTopics = append(configTopics, prefixedDiscoveryTopic(prefix, m.config(), "sensor", ObjectID(deviceID, sensor.key), "config"))
+	}
+
+	cleared, err := m.removeConfigs(configTopics)
+	log.Printf("Removed host entities for: %s", hostname)
+	return cleared, err
+}
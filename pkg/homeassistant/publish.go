@@ -0,0 +1,94 @@
+package homeassistant
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// errNotConnected fails the publishes to a disconnected broker when there are several
+var errNotConnected = errors.New("not connected")
+
+// failedToken is a completed token of a message that was not sent
+type failedToken struct {
+	err error
+}
+
+func (t failedToken) Wait() bool                     { return true }
+func (t failedToken) WaitTimeout(time.Duration) bool { return true }
+func (t failedToken) Error() error                   { return t.err }
+
+func (t failedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// publishAll publishes a message to every client without waiting and returns their tokens
+// in the same order. With more than one client, a client that is not connected gets a
+// failed token instead of queueing the message, so a broker that is down does not hold up
+// the others until the publish timeout; it gets the states again once it reconnects.
+func publishAll(clients []mqtt.Client, topic string, qos byte, retained bool, payload interface{}) []mqtt.Token {
+	tokens := make([]mqtt.Token, len(clients))
+	for i := range clients {
+		tokens[i] = publishTo(clients, i, topic, qos, retained, payload)
+	}
+	return tokens
+}
+
+// publishTo publishes a message to the i-th client like publishAll
+func publishTo(clients []mqtt.Client, i int, topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if len(clients) > 1 && !clients[i].IsConnectionOpen() {
+		return failedToken{err: errNotConnected}
+	}
+	return clients[i].Publish(topic, qos, retained, payload)
+}
+
+// waitAll waits for the tokens of clients with a single overall deadline and returns an
+// error naming every broker that failed or did not confirm in time
+func waitAll(clients []mqtt.Client, tokens []mqtt.Token, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	var failures []string
+	for i, token := range tokens {
+		var err error
+		if !delivered(token, time.Until(deadline)) {
+			err = errors.New("timeout")
+		} else if token.Error() != nil {
+			err = token.Error()
+		}
+		if err == nil {
+			continue
+		}
+
+		// A single broker keeps the plain error of the client
+		if len(clients) == 1 {
+			return err
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", BrokerName(clients[i]), err))
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// Publish publishes a message to every client and waits up to timeout for all of them to
+// confirm it. The brokers are independent, a failed one does not stop the delivery to the others.
+func Publish(clients []mqtt.Client, topic string, qos byte, retained bool, payload interface{}, timeout time.Duration) error {
+	return waitAll(clients, publishAll(clients, topic, qos, retained, payload), timeout)
+}
+
+// BrokerName returns the first broker URL of client, used to tell brokers apart in logs
+func BrokerName(client mqtt.Client) string {
+	options := client.OptionsReader()
+	servers := options.Servers()
+	if len(servers) == 0 {
+		return "(no broker)"
+	}
+	return servers[0].Redacted()
+}
@@ -0,0 +1,274 @@
+package homeassistant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+// RESTPublisher posts entity states to the Home Assistant REST API, for instances without
+// an MQTT broker. Entities created through the API cannot be discovered, so every state
+// carries the friendly name, unit, device class, icon and state class as attributes.
+type RESTPublisher struct {
+	configRef atomic.Pointer[config.Config] // swapped as a whole by SetConfig
+	client    *http.Client
+
+	// entities holds the registered entities by device ID and sensor key
+	entitiesMutex sync.Mutex
+	entities      map[string]map[string]restEntity
+}
+
+// restEntity is an entity whose state is posted to the REST API
+type restEntity struct {
+	entityID   string
+	sensor     sensorDefinition
+	attributes map[string]interface{}
+}
+
+// restState is the body of POST /api/states/<entity_id>
+type restState struct {
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// NewRESTPublisher creates a publisher posting to the configured ha_url with ha_token
+func NewRESTPublisher(config *config.Config) *RESTPublisher {
+	p := &RESTPublisher{
+		client:   &http.Client{},
+		entities: make(map[string]map[string]restEntity),
+	}
+	p.configRef.Store(config)
+	return p
+}
+
+// SetConfig replaces the configuration of the publisher, e.g. after a reload
+func (p *RESTPublisher) SetConfig(config *config.Config) {
+	p.configRef.Store(config)
+}
+
+// config returns the current configuration of the publisher
+func (p *RESTPublisher) config() *config.Config {
+	return p.configRef.Load()
+}
+
+// RESTEntityID returns the entity ID of a sensor posted to the REST API, derived from its
+// unique ID in MQTT mode, e.g. sensor.nvml_gpu_00_04_00_0_gpu1a2b3_temperature
+func RESTEntityID(component, deviceID, sensor string) string {
+	objectID := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(fmt.Sprintf("nvml_gpu_%s_%s", deviceID, sensor)))
+
+	// Home Assistant rejects entity IDs with repeated or trailing underscores
+	for strings.Contains(objectID, "__") {
+		objectID = strings.ReplaceAll(objectID, "__", "_")
+	}
+	return component + "." + strings.Trim(objectID, "_")
+}
+
+// RegisterGPU records the entities of a GPU device and posts the states of its static
+// diagnostic sensors
+func (p *RESTPublisher) RegisterGPU(device nvidia.GPUDevice, hostname string) error {
+	deviceID := nvidia.GetDeviceID(device)
+	deviceName := DeviceName(p.config(), device, hostname)
+
+	sensors := gpuSensors(device)
+	if p.config().StatsWindow != "" {
+		sensors = append(sensors, windowStatsSensors...)
+	}
+	for _, sensor := range sensors {
+		if sensor.key == "memory_usage" && p.config().MemoryUsageAbsolute() {
+			sensor = memoryUsedSensor(p.config(), sensor)
+		}
+		if device.Supports(sensor.key) {
+			p.register(deviceID, "sensor", deviceName, sensor)
+		}
+	}
+	for _, sensor := range gpuBinarySensors(device) {
+		if device.Supports(sensor.key) {
+			p.register(deviceID, "binary_sensor", deviceName, sensorDefinition{
+				key:         sensor.key,
+				name:        sensor.name,
+				deviceClass: sensor.deviceClass,
+				icon:        sensor.icon,
+			})
+		}
+	}
+
+	for _, sensor := range staticSensors(device) {
+		p.register(deviceID, "sensor", deviceName, sensor.sensorDefinition)
+
+		value := sensor.value
+		if celsius, ok := value.(int); ok && sensor.unit == "°C" {
+			value = p.config().ConvertTemperature(celsius)
+		}
+		if err := p.PublishState(deviceID, sensor.key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterHost records the aggregate entities of the host-level device
+func (p *RESTPublisher) RegisterHost(hostname string) {
+	for _, sensor := range hostSensors {
+		p.register(HostDeviceID(hostname), "sensor", fmt.Sprintf("%s GPUs", hostname), sensor)
+	}
+}
+
+// register records an enabled entity of a device with its display attributes
+func (p *RESTPublisher) register(deviceID, component, deviceName string, sensor sensorDefinition) {
+	if !p.config().SensorEnabled(sensor.key) {
+		return
+	}
+
+	// Temperature sensors are defined in Celsius and published in the configured unit
+	if sensor.unit == "°C" {
+		sensor.unit = p.config().TemperatureUnitSymbol()
+	}
+	sensor = applySensorOverride(p.config(), sensor)
+
+	attributes := map[string]interface{}{"friendly_name": deviceName + " " + sensor.name}
+	for name, value := range map[string]string{
+		"unit_of_measurement": sensor.unit,
+		"device_class":        sensor.deviceClass,
+		"icon":                sensor.icon,
+		"state_class":         sensor.stateClass,
+	} {
+		if value != "" {
+			attributes[name] = value
+		}
+	}
+	if len(sensor.options) > 0 {
+		attributes["options"] = sensor.options
+	}
+
+	p.entitiesMutex.Lock()
+	defer p.entitiesMutex.Unlock()
+	if p.entities[deviceID] == nil {
+		p.entities[deviceID] = make(map[string]restEntity)
+	}
+	p.entities[deviceID][sensor.key] = restEntity{
+		entityID:   RESTEntityID(component, deviceID, sensor.key),
+		sensor:     sensor,
+		attributes: attributes,
+	}
+}
+
+// PublishState posts value as the state of a registered sensor of a device. Booleans are
+// binary sensor states, numbers are rounded like the value templates of MQTT discovery.
+// Unregistered (e.g. disabled) sensors are skipped.
+func (p *RESTPublisher) PublishState(deviceID, sensor string, value interface{}) error {
+	p.entitiesMutex.Lock()
+	entity, ok := p.entities[deviceID][sensor]
+	p.entitiesMutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return p.post(entity, restStateValue(p.config(), entity.sensor, value))
+}
+
+// PublishGPUAvailability sets all entities of a GPU device to unavailable. They become
+// available again with the next posted states.
+func (p *RESTPublisher) PublishGPUAvailability(device nvidia.GPUDevice, available bool) error {
+	if available {
+		return nil
+	}
+
+	p.entitiesMutex.Lock()
+	var entities []restEntity
+	for _, entity := range p.entities[nvidia.GetDeviceID(device)] {
+		entities = append(entities, entity)
+	}
+	p.entitiesMutex.Unlock()
+
+	for _, entity := range entities {
+		if err := p.post(entity, "unavailable"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sets the state of an entity with POST /api/states/<entity_id>, or only logs it in dry-run mode
+func (p *RESTPublisher) post(entity restEntity, state string) error {
+	body, err := json.Marshal(restState{State: state, Attributes: entity.attributes})
+	if err != nil {
+		return fmt.Errorf("failed to marshal state of %s: %v", entity.entityID, err)
+	}
+
+	url := strings.TrimSuffix(p.config().HAURL, "/") + "/api/states/" + entity.entityID
+	if p.config().DryRun {
+		log.Printf("[dry-run] POST %s: %s", url, body)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config().PublishTimeout())
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post state of %s: %v", entity.entityID, err)
+	}
+	request.Header.Set("Authorization", "Bearer "+p.config().HAToken)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to post state of %s: %v", entity.entityID, err)
+	}
+	defer response.Body.Close()
+
+	// 200 updates an existing entity, 201 creates it
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to post state of %s: %s", entity.entityID, response.Status)
+	}
+	return nil
+}
+
+// templatePrecision matches the rounding of the built-in value templates
+var templatePrecision = regexp.MustCompile(`round\((\d+)\)`)
+
+// restStateValue formats a sensor value as an entity state. The REST API cannot apply value
+// templates, so numbers are rounded to the configured or built-in template precision.
+func restStateValue(cfg *config.Config, sensor sensorDefinition, value interface{}) string {
+	switch value := value.(type) {
+	case bool:
+		if value {
+			return "on"
+		}
+		return "off"
+	case float64:
+		precision, ok := sensorPrecision(cfg, sensor)
+		if !ok {
+			if match := templatePrecision.FindStringSubmatch(sensor.template); match != nil {
+				precision, _ = strconv.Atoi(match[1])
+			} else if strings.Contains(sensor.template, "int") {
+				precision = 0
+			} else {
+				return strconv.FormatFloat(value, 'f', -1, 64)
+			}
+		}
+		if precision <= 0 {
+			return strconv.FormatFloat(math.Round(value), 'f', 0, 64)
+		}
+		return strconv.FormatFloat(value, 'f', precision, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,618 @@
+package nvidia
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by control operations, distinguishable with errors.Is
+var (
+	ErrNotSupported = errors.New("not supported by the device")
+	ErrNoPermission = errors.New("insufficient permissions")
+	// ErrGPULost is returned by GetGPUMetrics when the GPU fell off the bus or needs a
+	// reset (e.g. after an Xid error); ReacquireDevice looks up a fresh handle
+	ErrGPULost = errors.New("GPU is lost")
+	// ErrRequestHung is returned without calling NVML while an earlier request to the same
+	// device is still stuck in the driver after its timeout
+	ErrRequestHung = errors.New("an earlier NVML request to the device is still hung")
+)
+
+// requestMutex is held exclusively by the NVML requests that change the library state
+// (initialization, shutdown, enumeration) and shared by all others. NVML is thread-safe, so
+// requests to different GPUs run in parallel while lockDevice keeps the requests to one GPU
+// from overlapping. A hung request keeps its shared lock, so exclusive requests must not
+// be made while the service is monitoring: they would wait for it and, being pending,
+// block every new shared request as well.
+var requestMutex sync.RWMutex
+
+// deviceMutexes serializes the requests to each device, keyed by NVML index (guarded by deviceMutexesMutex)
+var (
+	deviceMutexesMutex sync.Mutex
+	deviceMutexes      = make(map[int]*sync.Mutex)
+)
+
+// lockDevice waits until no other request to device is in progress and returns the function releasing it.
+// A hung request only blocks its own device, the other GPUs keep being read.
+func lockDevice(device GPUDevice) (unlock func()) {
+	requestMutex.RLock()
+
+	deviceMutexesMutex.Lock()
+	mutex, ok := deviceMutexes[device.Index]
+	if !ok {
+		mutex = &sync.Mutex{}
+		deviceMutexes[device.Index] = mutex
+	}
+	deviceMutexesMutex.Unlock()
+
+	mutex.Lock()
+	return func() {
+		mutex.Unlock()
+		requestMutex.RUnlock()
+	}
+}
+
+// samplesMutex guards the previous counter readings of all devices
+var samplesMutex sync.Mutex
+
+// GPUDiagnostics identifies a GPU board for asset tracking, read once at enumeration
+type GPUDiagnostics struct {
+	Serial       string // Board serial number, empty if not supported (most consumer cards)
+	VBIOSVersion string // Empty if not supported
+	NUMANodes    []int  // NUMA nodes closest to the GPU, empty if unknown (always on Windows)
+
+	// VirtualizationMode is "None", "Pass-Through", "vGPU", "Host vGPU" or "Host vSGA",
+	// empty if not supported (most consumer cards)
+	VirtualizationMode string
+}
+
+// GPUMetrics contains current GPU metrics
+type GPUMetrics struct {
+	PowerDraw         float64   // Watts
+	PerformanceLevel  string    // P0, P8, etc.
+	PerformanceState  int       // Numeric P-state (0 for P0, 8 for P8), -1 if not supported
+	MemoryUsage       float64   // Percentage
+	MemoryUsed        uint64    // Bytes
+	MemoryTotal       uint64    // Bytes
+	GPUUtilization    int       // Percentage
+	MemoryUtilization int       // Percentage
+	Temperature       int       // Celsius
+	TotalEnergyJoules float64   // Joules consumed since driver load
+	MemoryTemperature int       // Celsius (only valid if HasMemoryTemperature)
+	CoreClockOffset   int       // MHz, may be negative (only valid if HasClockOffsets)
+	MemoryClockOffset int       // MHz, may be negative (only valid if HasClockOffsets)
+	GraphicsClock     int       // Current SM clock in MHz
+	MaxGraphicsClock  int       // Maximum (boost) SM clock in MHz
+	VideoClock        int       // Current video encoder/decoder clock in MHz
+	ApplicationsClock int       // Applications (target) SM clock in MHz
+	Bar1Used          uint64    // BAR1 memory used in bytes (only valid if HasBAR1)
+	Bar1Total         uint64    // BAR1 memory total in bytes (only valid if HasBAR1)
+	NvLinkThroughput  float64   // NVLink TX+RX data throughput in MB/s across all links (only valid with NvLinks)
+	NvLinkActiveLinks int       // Number of active NVLink links (only valid with NvLinks)
+	NvLinkErrors      uint64    // Total NVLink data link errors across all links (only valid with NvLinks)
+	ComputeMode       string    // "Default", "Exclusive Process", etc. (only valid if HasComputeMode)
+	PersistenceMode   bool      // Driver persistence mode (only valid if HasPersistenceMode)
+	ThrottleReasons   uint64    // Bitmask of active clock throttle reasons (see ThrottleReasonNames)
+	Timestamp         time.Time // When the metrics were read
+
+	// MemoryReserved is the VRAM in bytes reserved by the driver and not available for
+	// allocations (only valid if HasMemoryInfoV2, MemoryUsed then excludes it)
+	MemoryReserved uint64
+
+	// Active NVENC sessions and their average frames per second, 0 when idle (only valid if HasEncoderStats)
+	EncoderSessions int
+	EncoderFPS      int
+
+	// Current and maximum PCIe link generation and width (lanes). The current link can
+	// downshift while idle, a lower maximum than the card supports hints at a bad slot.
+	PCIeLinkGen      int
+	MaxPCIeLinkGen   int
+	PCIeLinkWidth    int
+	MaxPCIeLinkWidth int
+
+	// MemoryBandwidthUtil is the DRAM bandwidth utilization in percent, read through GPU
+	// performance monitoring if HasGPM, else the memory controller utilization
+	MemoryBandwidthUtil float64
+
+	// ReliabilityThrottled reports clocks held back by the reliability voltage policy since
+	// the previous read (only valid if HasReliabilityViolations)
+	ReliabilityThrottled bool
+
+	// Failed holds the sensor keys of the metrics that could not be read this cycle
+	Failed map[string]bool
+}
+
+// markFailed records that the metrics feeding the sensors with keys could not be read
+func (m *GPUMetrics) markFailed(keys ...string) {
+	if m.Failed == nil {
+		m.Failed = make(map[string]bool)
+	}
+	for _, key := range keys {
+		m.Failed[key] = true
+	}
+}
+
+// PartialMetricsError is returned with metrics of which only some could be read.
+// The metrics listed in GPUMetrics.Failed are invalid, all others can be published.
+type PartialMetricsError struct {
+	Errors []error
+}
+
+func (e *PartialMetricsError) Error() string {
+	return fmt.Sprintf("failed to read %d metric(s): %s", len(e.Errors), joinErrors(e.Errors))
+}
+
+func (e *PartialMetricsError) Unwrap() []error {
+	return e.Errors
+}
+
+// coreMetrics are the metrics of which at least one must be read for a partial update
+var coreMetrics = []string{"power_draw", "memory_usage", "gpu_utilization", "temperature"}
+
+// metricsError returns the error for the failed reads errs of a cycle: nil without
+// failures, a PartialMetricsError if any core metric was read, else a plain error
+// since nothing useful is left to publish (e.g. the GPU fell off the bus)
+func metricsError(metrics GPUMetrics, errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	for _, key := range coreMetrics {
+		if !metrics.Failed[key] {
+			return &PartialMetricsError{Errors: errs}
+		}
+	}
+	return fmt.Errorf("failed to read any core metric: %s", joinErrors(errs))
+}
+
+// joinErrors joins the messages of errs for a single log line
+func joinErrors(errs []error) string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// hungRequests records since when a timed-out request to a device is still running, by NVML index
+var (
+	hungMutex    sync.Mutex
+	hungRequests = make(map[int]time.Time)
+)
+
+// HungRequests returns the number of devices with a timed-out NVML request that has not returned yet
+func HungRequests() int {
+	hungMutex.Lock()
+	defer hungMutex.Unlock()
+	return len(hungRequests)
+}
+
+// withTimeout runs request for device in the background and waits up to timeout for it.
+// NVML calls cannot be cancelled, so a request that times out keeps running and holds the
+// device lock. Until it returns, further requests fail fast with ErrRequestHung instead of
+// piling up goroutines that wait for the lock.
+func withTimeout(device GPUDevice, timeout time.Duration, action string, request func()) error {
+	hungMutex.Lock()
+	since, hung := hungRequests[device.Index]
+	hungMutex.Unlock()
+	if hung {
+		return fmt.Errorf("%s for device %s (%s): %w for %v", action, device.Name, GetShortPCIBusID(device.PCIBusID),
+			ErrRequestHung, time.Since(since).Round(time.Second))
+	}
+
+	started := time.Now()
+	done := make(chan struct{})
+	go func() {
+		request()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	hungMutex.Lock()
+	hungRequests[device.Index] = started
+	hungMutex.Unlock()
+	log.Printf("Warning: NVML request %s for GPU %s (%s) is hung in the driver, skipping the GPU until it returns",
+		action, device.Name, GetShortPCIBusID(device.PCIBusID))
+
+	go func() {
+		<-done
+		hungMutex.Lock()
+		delete(hungRequests, device.Index)
+		hungMutex.Unlock()
+		log.Printf("Hung NVML request %s for GPU %s (%s) returned after %v",
+			action, device.Name, GetShortPCIBusID(device.PCIBusID), time.Since(started).Round(time.Second))
+	}()
+
+	return fmt.Errorf("timeout after %v %s for device %s (%s)", timeout, action, device.Name, GetShortPCIBusID(device.PCIBusID))
+}
+
+// GetGPUMetrics retrieves current metrics for a GPU device, giving up after timeout
+func GetGPUMetrics(device GPUDevice, timeout time.Duration) (GPUMetrics, error) {
+	var metrics GPUMetrics
+	var err error
+	if timeoutErr := withTimeout(device, timeout, "getting GPU metrics", func() {
+		metrics, err = getGPUMetricsInternal(device)
+	}); timeoutErr != nil {
+		return GPUMetrics{}, timeoutErr
+	}
+	return metrics, err
+}
+
+// GetQuickMetrics reads only the instantaneous GPU utilization, temperature and power draw of
+// a device, which are cheap enough to sample between monitoring cycles. The other fields of
+// the returned metrics are left empty.
+func GetQuickMetrics(device GPUDevice, timeout time.Duration) (GPUMetrics, error) {
+	var metrics GPUMetrics
+	var err error
+	if timeoutErr := withTimeout(device, timeout, "sampling GPU metrics", func() {
+		metrics, err = getQuickMetricsInternal(device)
+	}); timeoutErr != nil {
+		return GPUMetrics{}, timeoutErr
+	}
+	return metrics, err
+}
+
+// ReacquireDevice looks up a fresh handle of a lost device by its PCI bus ID, since
+// the handle may change when the GPU is reset. It fails while the GPU is still lost.
+func ReacquireDevice(device GPUDevice, timeout time.Duration) (GPUDevice, error) {
+	recovered := device
+	var err error
+	if timeoutErr := withTimeout(device, timeout, "re-acquiring the handle", func() {
+		recovered, err = reacquireHandle(device)
+	}); timeoutErr != nil {
+		return device, timeoutErr
+	}
+	return recovered, err
+}
+
+// computeModeNames names the NVML compute modes by their value
+var computeModeNames = map[int]string{
+	0: "Default",
+	1: "Exclusive Thread",
+	2: "Prohibited",
+	3: "Exclusive Process",
+}
+
+// computeModeName returns the readable name of an NVML compute mode
+func computeModeName(mode int) string {
+	if name, ok := computeModeNames[mode]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (%d)", mode)
+}
+
+// virtualizationModeNames names the NVML GPU virtualization modes by their value
+var virtualizationModeNames = map[int]string{
+	0: "None",
+	1: "Pass-Through",
+	2: "vGPU",
+	3: "Host vGPU",
+	4: "Host vSGA",
+}
+
+// virtualizationModeName returns the readable name of an NVML GPU virtualization mode
+func virtualizationModeName(mode int) string {
+	if name, ok := virtualizationModeNames[mode]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (%d)", mode)
+}
+
+// nvlinkSample is an NVLink data counter reading used to compute throughput
+type nvlinkSample struct {
+	totalKiB  uint64
+	timestamp time.Time
+}
+
+// Utilization sources, see SetUtilizationSource
+const (
+	UtilizationSourceInstant = "instant" // Driver utilization over its last sample period (default)
+	UtilizationSourceSamples = "samples" // Average of the driver's utilization samples since the previous read
+	UtilizationSourceProcess = "process" // Sum of the per-process SM utilization since the previous read
+)
+
+// utilizationSource selects how the GPU utilization is read
+var utilizationSource = UtilizationSourceInstant
+
+// SetUtilizationSource selects how the GPU utilization is read before any metrics are read.
+// Unknown sources fall back to UtilizationSourceInstant.
+func SetUtilizationSource(source string) {
+	switch source {
+	case UtilizationSourceSamples, UtilizationSourceProcess:
+		utilizationSource = source
+	default:
+		utilizationSource = UtilizationSourceInstant
+	}
+}
+
+// utilizationTimestamps holds the timestamp of the newest utilization sample read per
+// device UUID (guarded by samplesMutex), so every read only covers the new samples
+var utilizationTimestamps = make(map[string]uint64)
+
+// lastUtilizationTimestamp returns the timestamp of the newest utilization sample read from the device
+func lastUtilizationTimestamp(uuid string) uint64 {
+	samplesMutex.Lock()
+	defer samplesMutex.Unlock()
+	return utilizationTimestamps[uuid]
+}
+
+// utilizationSample is a driver utilization sample or the utilization of one process
+type utilizationSample struct {
+	timestamp uint64 // Microseconds
+	value     uint32 // Percentage
+}
+
+// averageUtilization returns the average of the samples newer than last and records the
+// newest one, or false without new samples
+func averageUtilization(uuid string, last uint64, samples []utilizationSample) (int, bool) {
+	var total, count, newest uint64
+	for _, sample := range samples {
+		if sample.timestamp <= last {
+			continue
+		}
+		total += uint64(sample.value)
+		count++
+		newest = max(newest, sample.timestamp)
+	}
+	if count == 0 {
+		return 0, false
+	}
+
+	setLastUtilizationTimestamp(uuid, newest)
+	return int((total + count/2) / count), true
+}
+
+// processUtilization returns the summed utilization of the processes, capped at 100, and
+// records the newest sample
+func processUtilization(uuid string, samples []utilizationSample) int {
+	var total uint32
+	var newest uint64
+	for _, sample := range samples {
+		total += sample.value
+		newest = max(newest, sample.timestamp)
+	}
+
+	setLastUtilizationTimestamp(uuid, newest)
+	return int(min(total, 100))
+}
+
+// setLastUtilizationTimestamp records the timestamp of the newest utilization sample read from the device
+func setLastUtilizationTimestamp(uuid string, timestamp uint64) {
+	samplesMutex.Lock()
+	defer samplesMutex.Unlock()
+	if timestamp > utilizationTimestamps[uuid] {
+		utilizationTimestamps[uuid] = timestamp
+	}
+}
+
+// nvlinkSamples holds the previous NVLink data counter per device UUID (guarded by samplesMutex)
+var nvlinkSamples = make(map[string]nvlinkSample)
+
+// nvlinkThroughput returns the NVLink throughput in MB/s since the previous reading of
+// the device's cumulative data counter, 0 for the first reading or after a counter reset
+func nvlinkThroughput(uuid string, totalKiB uint64, timestamp time.Time) float64 {
+	samplesMutex.Lock()
+	previous, ok := nvlinkSamples[uuid]
+	nvlinkSamples[uuid] = nvlinkSample{totalKiB: totalKiB, timestamp: timestamp}
+	samplesMutex.Unlock()
+	if !ok || totalKiB < previous.totalKiB {
+		return 0
+	}
+
+	seconds := timestamp.Sub(previous.timestamp).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(totalKiB-previous.totalKiB) * 1024 / 1e6 / seconds
+}
+
+// throttleReasons names the clock throttle reason bits of nvmlClocksThrottleReasons
+var throttleReasons = []struct {
+	mask uint64
+	name string
+}{
+	{0x1, "gpu_idle"},
+	{0x2, "applications_clocks_setting"},
+	{0x4, "sw_power_cap"},
+	{0x8, "hw_slowdown"},
+	{0x10, "sync_boost"},
+	{0x20, "sw_thermal_slowdown"},
+	{0x40, "hw_thermal_slowdown"},
+	{0x80, "hw_power_brake_slowdown"},
+	{0x100, "display_clock_setting"},
+}
+
+// Throttle reason groups used for the per-cause throttling binary sensors
+const (
+	ThrottleReasonsThermal uint64 = 0x20 | 0x40 // sw_thermal_slowdown, hw_thermal_slowdown
+	ThrottleReasonsPower   uint64 = 0x4 | 0x80  // sw_power_cap, hw_power_brake_slowdown
+)
+
+// reliabilitySamples holds the previous reliability violation time per device UUID (guarded by samplesMutex)
+var reliabilitySamples = make(map[string]uint64)
+
+// reliabilityThrottled reports whether the cumulative reliability violation time of a
+// device grew since its previous reading (false for the first reading)
+func reliabilityThrottled(uuid string, violationTime uint64) bool {
+	samplesMutex.Lock()
+	defer samplesMutex.Unlock()
+
+	previous, ok := reliabilitySamples[uuid]
+	reliabilitySamples[uuid] = violationTime
+	return ok && violationTime > previous
+}
+
+// ThrottleReasonNames returns the names of the throttle reasons set in mask
+func ThrottleReasonNames(mask uint64) []string {
+	names := []string{}
+	for _, reason := range throttleReasons {
+		if mask&reason.mask != 0 {
+			names = append(names, reason.name)
+		}
+	}
+	return names
+}
+
+// GetShortPCIBusID formats PCI Bus ID from 00000000:04:00.0 to 00:04:00.0
+func GetShortPCIBusID(pciBusID string) string {
+	// Split by colon to separate domain:bus:device.function
+	parts := strings.Split(pciBusID, ":")
+	if len(parts) >= 3 {
+		// Format: domain should be 2 digits instead of 8
+		domain := parts[0]
+		if len(domain) > 2 {
+			// Take the last 2 characters of the domain
+			domain = domain[len(domain)-2:]
+		}
+		// Return formatted as domain:bus:device.function
+		return fmt.Sprintf("%s:%s:%s", domain, parts[1], parts[2])
+	}
+	// If format is unexpected, return as-is
+	return pciBusID
+}
+
+// Device ID strategies, see SetDeviceIDStrategy
+const (
+	DeviceIDStrategyPCI     = "pci"      // PCI ID and short UUID, e.g. 00_04_00_0_gpu1a2b3 (default)
+	DeviceIDStrategyUUID    = "uuid"     // Full UUID only, follows the card across PCI slots
+	DeviceIDStrategyPCIUUID = "pci_uuid" // PCI ID and full UUID
+)
+
+// deviceIDStrategy selects the format returned by GetDeviceID
+var deviceIDStrategy = DeviceIDStrategyPCI
+
+// SetDeviceIDStrategy selects the device ID format before any device ID is used.
+// Unknown strategies fall back to DeviceIDStrategyPCI.
+func SetDeviceIDStrategy(strategy string) {
+	switch strategy {
+	case DeviceIDStrategyUUID, DeviceIDStrategyPCIUUID:
+		deviceIDStrategy = strategy
+	default:
+		deviceIDStrategy = DeviceIDStrategyPCI
+	}
+}
+
+// GetDeviceID generates a unique device identifier for MQTT topics
+func GetDeviceID(device GPUDevice) string {
+	deviceID := deviceIDFromStrategy(device)
+	if device.DuplicateID {
+		deviceID = fmt.Sprintf("%s_%d", deviceID, device.Index)
+	}
+	return deviceID
+}
+
+// deviceIDFromStrategy formats the device ID of device in the selected strategy
+func deviceIDFromStrategy(device GPUDevice) string {
+	// The full UUID with dashes replaced, e.g. gpu_1a2b3c4d_0000_0000_0000_000000000000
+	fullUUID := strings.ToLower(strings.Replace(device.UUID, "-", "_", -1))
+	if deviceIDStrategy == DeviceIDStrategyUUID {
+		return fullUUID
+	}
+
+	// Format PCI Bus ID to short format and remove unwanted characters
+	shortPCIBusID := GetShortPCIBusID(device.PCIBusID)
+	deviceID := strings.Replace(shortPCIBusID, ":", "_", -1)
+	deviceID = strings.Replace(deviceID, ".", "_", -1)
+
+	if deviceIDStrategy == DeviceIDStrategyPCIUUID {
+		return strings.ToLower(fmt.Sprintf("%s_%s", deviceID, fullUUID))
+	}
+
+	// Add GPU UUID suffix (first 8 characters) to ensure uniqueness across different machines
+	uuidSuffix := GetShortUUID(device.UUID)
+
+	return strings.ToLower(fmt.Sprintf("%s_%s", deviceID, uuidSuffix))
+}
+
+// Supports reports whether the card supports the metric feeding the sensor with key.
+// Window statistics such as temperature_max follow the metric they aggregate.
+func (d GPUDevice) Supports(key string) bool {
+	for _, suffix := range []string{"_min", "_max", "_avg"} {
+		key = strings.TrimSuffix(key, suffix)
+	}
+	return !d.Unsupported[key]
+}
+
+// UnsupportedSensors returns the sorted keys of the sensors the card does not support
+func (d GPUDevice) UnsupportedSensors() []string {
+	keys := make([]string, 0, len(d.Unsupported))
+	for key := range d.Unsupported {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// markDuplicateIDs flags the devices whose device ID collides with another enumerated
+// device, so that their sensors do not overwrite each other in Home Assistant
+func markDuplicateIDs(devices []GPUDevice) {
+	byID := make(map[string][]int)
+	for i, device := range devices {
+		id := GetDeviceID(device)
+		byID[id] = append(byID[id], i)
+	}
+
+	for id, indexes := range byID {
+		if len(indexes) < 2 {
+			continue
+		}
+		log.Printf("Warning: %d GPUs share the device ID %s (duplicate UUID %s), appending the GPU index to their device IDs",
+			len(indexes), id, devices[indexes[0]].UUID)
+		for _, i := range indexes {
+			devices[i].DuplicateID = true
+		}
+	}
+}
+
+// P2P link types between two GPUs, see GetP2PStatus
+const (
+	P2PLinkNone   = "none" // No peer-to-peer access, transfers are staged through host memory
+	P2PLinkPCIe   = "PCIe"
+	P2PLinkNVLink = "NVLink"
+)
+
+// P2PPeer is the peer-to-peer link from a GPU to another GPU
+type P2PPeer struct {
+	Index int    // NVML index of the peer
+	Link  string // P2PLinkNone, P2PLinkPCIe or P2PLinkNVLink
+}
+
+// markP2PPeers records the peer-to-peer links between every pair of devices. Peers whose
+// status cannot be read are left out.
+func markP2PPeers(devices []GPUDevice) {
+	if len(devices) < 2 {
+		return
+	}
+
+	for i := range devices {
+		for j := range devices {
+			if i == j {
+				continue
+			}
+			link, err := p2pLink(devices[i], devices[j])
+			if err != nil {
+				log.Printf("Warning: GPU %d: %v", devices[i].Index, err)
+				continue
+			}
+			devices[i].P2PPeers = append(devices[i].P2PPeers, P2PPeer{Index: devices[j].Index, Link: link})
+		}
+	}
+}
+
+// GetShortUUID returns the short UUID form used in device IDs (first 8 characters without dashes)
+func GetShortUUID(uuid string) string {
+	shortUUID := strings.Replace(uuid, "-", "", -1)
+	if len(shortUUID) > 8 {
+		shortUUID = shortUUID[:8]
+	}
+	return strings.ToLower(shortUUID)
+}
@@ -0,0 +1,67 @@
+package nvidia
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// DisplayNameFields are the fields available in a device name template
+type DisplayNameFields struct {
+	Hostname string
+	Index    int
+	Name     string // Full device name, e.g. "NVIDIA GeForce RTX 3080"
+	Model    string // Device name without the "NVIDIA " prefix
+	PCIID    string // Short PCI bus ID, e.g. 00:04:00.0
+	UUID     string
+	VRAMGB   float64
+}
+
+// renderDisplayName executes a Go text/template device name template
+func renderDisplayName(nameTemplate string, fields DisplayNameFields) (string, error) {
+	tmpl, err := template.New("device_name").Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, fields); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// GetDeviceDisplayName generates a display name from nameTemplate (a Go template over
+// DisplayNameFields), falling back to the format: {HOSTNAME} {PCI ID} - NVIDIA {MODEL} {VRAM}
+func GetDeviceDisplayName(device GPUDevice, hostname, nameTemplate string) string {
+	vramGB := float64(device.Memory) / (1024 * 1024 * 1024)
+
+	// Extract model name from device name (remove "NVIDIA" prefix if present)
+	modelName := device.Name
+	if strings.HasPrefix(strings.ToUpper(modelName), "NVIDIA ") {
+		modelName = strings.TrimPrefix(modelName, "NVIDIA ")
+	}
+
+	// Use short format PCI Bus ID (00:04:00.0 instead of 00000000:04:00.0)
+	shortPCIBusID := GetShortPCIBusID(device.PCIBusID)
+
+	if nameTemplate != "" {
+		name, err := renderDisplayName(nameTemplate, DisplayNameFields{
+			Hostname: hostname,
+			Index:    device.Index,
+			Name:     device.Name,
+			Model:    modelName,
+			PCIID:    shortPCIBusID,
+			UUID:     device.UUID,
+			VRAMGB:   vramGB,
+		})
+		if err == nil && name != "" {
+			return name
+		}
+		log.Printf("Warning: invalid device name template %q, using default format: %v", nameTemplate, err)
+	}
+
+	return fmt.Sprintf("%s %s - NVIDIA %s %.0fGB", hostname, shortPCIBusID, modelName, vramGB)
+}
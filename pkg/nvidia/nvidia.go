@@ -4,18 +4,17 @@
 package nvidia
 
 import (
+	"encoding/binary"
 	"fmt"
-	"strings"
-	"sync"
+	"log"
+	"math"
+	"math/bits"
 	"time"
 	"unsafe"
 
 	"github.com/NVIDIA/go-nvml/pkg/nvml"
 )
 
-// requestMutex prevents overlapping NVML requests to avoid slowdowns
-var requestMutex sync.Mutex
-
 // convertCString converts a C-style char array to a Go string
 func convertCString(cstr [32]int8) string {
 	n := 0
@@ -36,16 +35,57 @@ type GPUDevice struct {
 	PCIBusID string
 	Memory   uint64 // Total memory in bytes
 	UUID     string
-}
 
-// GPUMetrics contains current GPU metrics
-type GPUMetrics struct {
-	PowerDraw         float64 // Watts
-	PerformanceLevel  string  // P0, P8, etc.
-	MemoryUsage       float64 // Percentage
-	GPUUtilization    int     // Percentage
-	MemoryUtilization int     // Percentage
-	Temperature       int     // Celsius
+	// HasMemoryTemperature reports whether the device exposes a memory temperature sensor
+	HasMemoryTemperature bool
+	// HasClockOffsets reports whether the device exposes core/memory clock VF offsets
+	HasClockOffsets bool
+	// HasECC reports whether ECC is currently enabled on the device
+	HasECC bool
+	// HasBAR1 reports whether the device reports BAR1 memory usage
+	HasBAR1 bool
+	// HasThrottleReasons reports whether the device reports its clock throttle reasons
+	HasThrottleReasons bool
+	// HasReliabilityViolations reports whether the device reports reliability policy violations
+	HasReliabilityViolations bool
+	// HasEncoderStats reports whether the device reports its NVENC encoder sessions
+	HasEncoderStats bool
+	// HasMemoryInfoV2 reports whether the driver reports the reserved VRAM (nvmlDeviceGetMemoryInfo_v2)
+	HasMemoryInfoV2 bool
+	// HasComputeMode reports whether the device reports its compute mode
+	HasComputeMode bool
+	// HasPersistenceMode reports whether the device reports persistence mode (Linux only)
+	HasPersistenceMode bool
+	// HasGPM reports whether the device supports GPU performance monitoring (Hopper and
+	// newer), which reads the DRAM bandwidth utilization
+	HasGPM bool
+	// NvLinks lists the NVLink link indexes of the device (empty without NVLink)
+	NvLinks []int
+
+	// Temperature thresholds in Celsius, read once at enumeration (0 if not supported)
+	SlowdownTemperature int
+	ShutdownTemperature int
+
+	// FanCount is the number of fans (0 if not supported); manual fan speeds must
+	// lie between MinFanSpeed and MaxFanSpeed percent
+	FanCount    int
+	MinFanSpeed int
+	MaxFanSpeed int
+
+	// Diagnostics holds the serial number and VBIOS version of the board
+	Diagnostics GPUDiagnostics
+
+	// DuplicateID is set when another enumerated GPU has the same device ID (vGPU or
+	// passthrough instances sharing a UUID); GetDeviceID then appends the index
+	DuplicateID bool
+
+	// Unsupported lists the sensors, by key, whose metric the card reported as not supported
+	// at enumeration (e.g. power draw on some GeForce boards); see Supports
+	Unsupported map[string]bool
+
+	// P2PPeers lists the peer-to-peer links to the other enumerated GPUs, read once at
+	// enumeration (empty on single-GPU hosts)
+	P2PPeers []P2PPeer
 }
 
 // Init initializes the NVML library
@@ -60,11 +100,17 @@ func Init() error {
 	return nil
 }
 
-// Shutdown shuts down the NVML library
+// Shutdown shuts down the NVML library. It is skipped while a request is hung, since
+// waiting for it could block the exit of the process forever.
 func Shutdown() error {
+	if HungRequests() > 0 {
+		return fmt.Errorf("failed to shutdown NVML: %d device(s) with a hung request", HungRequests())
+	}
+
 	requestMutex.Lock()
 	defer requestMutex.Unlock()
 
+	freeGPMSamples()
 	ret := nvml.Shutdown()
 	if ret != nvml.SUCCESS {
 		return fmt.Errorf("failed to shutdown NVML: %s", nvml.ErrorString(ret))
@@ -72,7 +118,8 @@ func Shutdown() error {
 	return nil
 }
 
-// GetGPUDevices returns all available GPU devices
+// GetGPUDevices returns all available GPU devices. Devices that fail to
+// enumerate are skipped with a warning; an error is only returned if none succeed.
 func GetGPUDevices() ([]GPUDevice, error) {
 	requestMutex.Lock()
 	defer requestMutex.Unlock()
@@ -82,104 +129,290 @@ func GetGPUDevices() ([]GPUDevice, error) {
 		return nil, fmt.Errorf("failed to get device count: %s", nvml.ErrorString(ret))
 	}
 
-	devices := make([]GPUDevice, count)
+	devices := make([]GPUDevice, 0, count)
+	var lastErr error
 
 	for i := 0; i < count; i++ {
 		device, ret := nvml.DeviceGetHandleByIndex(i)
 		if ret != nvml.SUCCESS {
-			return nil, fmt.Errorf("failed to get device handle for index %d: %s", i, nvml.ErrorString(ret))
+			lastErr = fmt.Errorf("failed to get device handle for index %d: %s", i, nvml.ErrorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
 		}
 
 		// Get device name
 		name, ret := device.GetName()
 		if ret != nvml.SUCCESS {
-			return nil, fmt.Errorf("failed to get device name: %s", nvml.ErrorString(ret))
+			lastErr = fmt.Errorf("failed to get device name: %s", nvml.ErrorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
 		}
 
 		// Get PCI Bus ID
 		pciInfo, ret := device.GetPciInfo()
 		if ret != nvml.SUCCESS {
-			return nil, fmt.Errorf("failed to get PCI info: %s", nvml.ErrorString(ret))
+			lastErr = fmt.Errorf("failed to get PCI info: %s", nvml.ErrorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
 		}
 
 		// Get memory info
 		memInfo, ret := device.GetMemoryInfo()
 		if ret != nvml.SUCCESS {
-			return nil, fmt.Errorf("failed to get memory info: %s", nvml.ErrorString(ret))
+			lastErr = fmt.Errorf("failed to get memory info: %s", nvml.ErrorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
 		}
 
 		// Get UUID
 		uuid, ret := device.GetUUID()
 		if ret != nvml.SUCCESS {
-			return nil, fmt.Errorf("failed to get device UUID: %s", nvml.ErrorString(ret))
+			lastErr = fmt.Errorf("failed to get device UUID: %s", nvml.ErrorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
+		}
+
+		// Probe for a memory temperature sensor (HBM/GDDR6X cards)
+		_, ret = getMemoryTemperature(device)
+		hasMemoryTemperature := ret == nvml.SUCCESS
+
+		// Probe for clock VF offset support
+		_, ret = device.GetGpcClkVfOffset()
+		hasClockOffsets := ret == nvml.SUCCESS
+
+		// Check whether ECC is enabled
+		eccMode, _, ret := device.GetEccMode()
+		hasECC := ret == nvml.SUCCESS && eccMode == nvml.FEATURE_ENABLED
+
+		// Probe for the v2 memory info with the reserved VRAM. Older drivers do not export
+		// the symbol and calling it would abort the process, so it is looked up first.
+		hasMemoryInfoV2 := false
+		if nvml.Extensions().LookupSymbol("nvmlDeviceGetMemoryInfo_v2") == nil {
+			_, ret = device.GetMemoryInfo_v2()
+			hasMemoryInfoV2 = ret == nvml.SUCCESS
+		}
+
+		// Probe for BAR1 memory info
+		_, ret = device.GetBAR1MemoryInfo()
+		hasBAR1 := ret == nvml.SUCCESS
+
+		// Probe for clock throttle reasons and reliability violations
+		_, ret = device.GetCurrentClocksThrottleReasons()
+		hasThrottleReasons := ret == nvml.SUCCESS
+		_, ret = device.GetViolationStatus(nvml.PERF_POLICY_RELIABILITY)
+		hasReliabilityViolations := ret == nvml.SUCCESS
+
+		// Probe for NVENC encoder statistics (missing on cards without NVENC)
+		_, _, _, ret = device.GetEncoderStats()
+		hasEncoderStats := ret == nvml.SUCCESS
+
+		// Probe for compute and persistence mode
+		_, ret = device.GetComputeMode()
+		hasComputeMode := ret == nvml.SUCCESS
+		_, ret = device.GetPersistenceMode()
+		hasPersistenceMode := ret == nvml.SUCCESS
+
+		// Probe for GPU performance monitoring
+		gpmSupport, ret := device.GpmQueryDeviceSupport()
+		hasGPM := ret == nvml.SUCCESS && gpmSupport.IsSupportedDevice != 0
+
+		// Probe for NVLink links
+		var nvLinks []int
+		for link := 0; link < nvml.NVLINK_MAX_LINKS; link++ {
+			if _, ret := device.GetNvLinkState(link); ret == nvml.SUCCESS {
+				nvLinks = append(nvLinks, link)
+			}
+		}
+
+		// Temperature thresholds are static per card
+		slowdownTemperature, ret := device.GetTemperatureThreshold(nvml.TEMPERATURE_THRESHOLD_SLOWDOWN)
+		if ret != nvml.SUCCESS {
+			slowdownTemperature = 0
+		}
+		shutdownTemperature, ret := device.GetTemperatureThreshold(nvml.TEMPERATURE_THRESHOLD_SHUTDOWN)
+		if ret != nvml.SUCCESS {
+			shutdownTemperature = 0
 		}
 
-		devices[i] = GPUDevice{
-			Index:    i,
-			Handle:   device,
-			Name:     name,
-			PCIBusID: convertCString(pciInfo.BusId),
-			Memory:   memInfo.Total,
-			UUID:     uuid,
+		// Fans and the allowed manual fan speed range
+		fanCount, ret := device.GetNumFans()
+		if ret != nvml.SUCCESS {
+			fanCount = 0
 		}
+		minFanSpeed, maxFanSpeed, ret := device.GetMinMaxFanSpeed()
+		if ret != nvml.SUCCESS {
+			minFanSpeed, maxFanSpeed = 0, 100
+		}
+
+		devices = append(devices, GPUDevice{
+			Index:                i,
+			Handle:               device,
+			Name:                 name,
+			PCIBusID:             convertCString(pciInfo.BusId),
+			Memory:               memInfo.Total,
+			UUID:                 uuid,
+			HasMemoryTemperature: hasMemoryTemperature,
+			HasClockOffsets:      hasClockOffsets,
+			HasECC:               hasECC,
+			HasBAR1:              hasBAR1,
+			HasThrottleReasons:   hasThrottleReasons,
+			HasComputeMode:       hasComputeMode,
+			HasPersistenceMode:   hasPersistenceMode,
+			HasGPM:               hasGPM,
+			NvLinks:              nvLinks,
+			SlowdownTemperature:  int(slowdownTemperature),
+			ShutdownTemperature:  int(shutdownTemperature),
+			FanCount:             int(fanCount),
+			MinFanSpeed:          int(minFanSpeed),
+			MaxFanSpeed:          int(maxFanSpeed),
+
+			HasReliabilityViolations: hasReliabilityViolations,
+			HasEncoderStats:          hasEncoderStats,
+			HasMemoryInfoV2:          hasMemoryInfoV2,
+
+			Diagnostics: getDiagnostics(device),
+			Unsupported: getUnsupported(device),
+		})
 	}
 
+	// Only fail if no device at all could be enumerated
+	if len(devices) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("failed to enumerate any of %d GPU(s): %v", count, lastErr)
+	}
+
+	markDuplicateIDs(devices)
+	markP2PPeers(devices)
 	return devices, nil
 }
 
-// GetGPUMetrics retrieves current metrics for a GPU device with timeout protection
-func GetGPUMetrics(device GPUDevice) (GPUMetrics, error) {
-	// Use a timeout channel to prevent hanging requests
-	done := make(chan struct {
-		metrics GPUMetrics
-		err     error
-	}, 1)
-
-	go func() {
-		metrics, err := getGPUMetricsInternal(device)
-		done <- struct {
-			metrics GPUMetrics
-			err     error
-		}{metrics, err}
-	}()
-
-	select {
-	case result := <-done:
-		return result.metrics, result.err
-	case <-time.After(10 * time.Second):
-		return GPUMetrics{}, fmt.Errorf("timeout getting GPU metrics for device %s", device.Name)
+// getMemoryTemperature reads the memory temperature through NVML field values,
+// since it is not available as a TemperatureSensors value
+func getMemoryTemperature(device nvml.Device) (int, nvml.Return) {
+	value, ret := getFieldValue(device, nvml.FI_DEV_MEMORY_TEMP)
+	return int(value), ret
+}
+
+// getFieldValue reads a single NVML field (one of the nvml.FI_DEV_* IDs) of device
+func getFieldValue(device nvml.Device, fieldID uint32) (int64, nvml.Return) {
+	values := []nvml.FieldValue{{FieldId: fieldID}}
+	if ret := device.GetFieldValues(values); ret != nvml.SUCCESS {
+		return 0, ret
+	}
+	if ret := nvml.Return(values[0].NvmlReturn); ret != nvml.SUCCESS {
+		return 0, ret
+	}
+	return fieldValueToInt64(values[0]), nvml.SUCCESS
+}
+
+// nvLinkErrorCounters are the data link error counters summed into NvLinkErrors
+var nvLinkErrorCounters = []nvml.NvLinkErrorCounter{
+	nvml.NVLINK_ERROR_DL_REPLAY,
+	nvml.NVLINK_ERROR_DL_RECOVERY,
+	nvml.NVLINK_ERROR_DL_CRC_FLIT,
+	nvml.NVLINK_ERROR_DL_CRC_DATA,
+	nvml.NVLINK_ERROR_DL_ECC_DATA,
+}
+
+// getNvLinkDataKiB reads the cumulative NVLink TX+RX data counters summed across all links.
+// The field values are used instead of the deprecated utilization counters, which also
+// need root to be configured first.
+func getNvLinkDataKiB(device nvml.Device) (uint64, nvml.Return) {
+	values := []nvml.FieldValue{
+		{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_TX, ScopeId: math.MaxUint32},
+		{FieldId: nvml.FI_DEV_NVLINK_THROUGHPUT_DATA_RX, ScopeId: math.MaxUint32},
+	}
+	if ret := device.GetFieldValues(values); ret != nvml.SUCCESS {
+		return 0, ret
+	}
+
+	var total uint64
+	for _, value := range values {
+		if ret := nvml.Return(value.NvmlReturn); ret != nvml.SUCCESS {
+			return 0, ret
+		}
+		total += uint64(fieldValueToInt64(value))
+	}
+	return total, nvml.SUCCESS
+}
+
+// fieldValueToInt64 decodes the value of an NVML field according to its value type
+func fieldValueToInt64(value nvml.FieldValue) int64 {
+	ptr := unsafe.Pointer(&value.Value[0])
+	switch nvml.ValueType(value.ValueType) {
+	case nvml.VALUE_TYPE_DOUBLE:
+		return int64(*(*float64)(ptr))
+	case nvml.VALUE_TYPE_UNSIGNED_INT:
+		return int64(*(*uint32)(ptr))
+	case nvml.VALUE_TYPE_UNSIGNED_LONG, nvml.VALUE_TYPE_UNSIGNED_LONG_LONG:
+		return int64(*(*uint64)(ptr))
+	case nvml.VALUE_TYPE_SIGNED_LONG_LONG:
+		return *(*int64)(ptr)
+	case nvml.VALUE_TYPE_SIGNED_INT:
+		return int64(*(*int32)(ptr))
+	case nvml.VALUE_TYPE_UNSIGNED_SHORT:
+		return int64(*(*uint16)(ptr))
+	default:
+		return 0
 	}
 }
 
 // getGPUMetricsInternal performs the actual NVML calls with mutex protection
 func getGPUMetricsInternal(device GPUDevice) (GPUMetrics, error) {
-	requestMutex.Lock()
-	defer requestMutex.Unlock()
+	unlock := lockDevice(device)
+	defer unlock()
 
-	metrics := GPUMetrics{}
+	metrics := GPUMetrics{Timestamp: time.Now()}
+
+	// A failed read only drops the affected metrics, the others are still published
+	var errs []error
 
 	// Get power draw
 	power, ret := device.Handle.GetPowerUsage()
 	if ret == nvml.SUCCESS {
 		metrics.PowerDraw = float64(power) / 1000.0 // Convert mW to W
 	} else if ret != nvml.ERROR_NOT_SUPPORTED {
-		return metrics, fmt.Errorf("failed to get power usage: %s", nvml.ErrorString(ret))
+		errs = append(errs, fmt.Errorf("failed to get power usage: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("power_draw")
 	}
 
 	// Get performance state
+	metrics.PerformanceState = -1
 	perfState, ret := device.Handle.GetPerformanceState()
-	if ret == nvml.SUCCESS {
+	if ret == nvml.SUCCESS && perfState == nvml.PSTATE_UNKNOWN {
+		// Not one of the P0-P15 options of the enum sensor, so the previous state is kept
+		metrics.markFailed("performance_level", "performance_state_num")
+	} else if ret == nvml.SUCCESS {
 		metrics.PerformanceLevel = fmt.Sprintf("P%d", int(perfState))
+		metrics.PerformanceState = int(perfState)
 	} else if ret != nvml.ERROR_NOT_SUPPORTED {
-		return metrics, fmt.Errorf("failed to get performance state: %s", nvml.ErrorString(ret))
+		errs = append(errs, fmt.Errorf("failed to get performance state: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("performance_level", "performance_state_num")
 	}
 
 	// Get memory usage
-	memInfo, ret := device.Handle.GetMemoryInfo()
+	memInfo, ret := getMemoryInfo(device)
 	if ret == nvml.SUCCESS {
 		metrics.MemoryUsage = float64(memInfo.Used) / float64(memInfo.Total) * 100.0
+		metrics.MemoryUsed = memInfo.Used
+		metrics.MemoryTotal = memInfo.Total
+		metrics.MemoryReserved = memInfo.Reserved
+	} else if isLost(ret) {
+		return GPUMetrics{}, fmt.Errorf("failed to get memory info: %s: %w", nvml.ErrorString(ret), ErrGPULost)
 	} else {
-		return metrics, fmt.Errorf("failed to get memory info: %s", nvml.ErrorString(ret))
+		errs = append(errs, fmt.Errorf("failed to get memory info: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("memory_usage", "memory_reserved")
+	}
+
+	// Get BAR1 memory usage
+	if device.HasBAR1 {
+		bar1Info, ret := device.Handle.GetBAR1MemoryInfo()
+		if ret == nvml.SUCCESS {
+			metrics.Bar1Used = bar1Info.Bar1Used
+			metrics.Bar1Total = bar1Info.Bar1Total
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get BAR1 memory info: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("bar1_usage")
+		}
 	}
 
 	// Get utilization rates
@@ -187,8 +420,26 @@ func getGPUMetricsInternal(device GPUDevice) (GPUMetrics, error) {
 	if ret == nvml.SUCCESS {
 		metrics.GPUUtilization = int(utilization.Gpu)
 		metrics.MemoryUtilization = int(utilization.Memory)
+		// Without new samples the instantaneous value is kept
+		if sampled, ok := sampledUtilization(device); ok {
+			metrics.GPUUtilization = sampled
+		}
 	} else if ret != nvml.ERROR_NOT_SUPPORTED {
-		return metrics, fmt.Errorf("failed to get utilization rates: %s", nvml.ErrorString(ret))
+		errs = append(errs, fmt.Errorf("failed to get utilization rates: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("gpu_utilization", "memory_bandwidth_util")
+	}
+
+	// Get memory bandwidth utilization, falling back to the memory controller utilization
+	// without GPM and on the first read, which has no previous sample yet
+	metrics.MemoryBandwidthUtil = float64(metrics.MemoryUtilization)
+	if device.HasGPM {
+		bandwidthUtil, ok, ret := getDRAMBandwidthUtil(device)
+		if ret != nvml.SUCCESS {
+			errs = append(errs, fmt.Errorf("failed to get DRAM bandwidth utilization: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("memory_bandwidth_util")
+		} else if ok {
+			metrics.MemoryBandwidthUtil = bandwidthUtil
+		}
 	}
 
 	// Get temperature
@@ -196,65 +447,233 @@ func getGPUMetricsInternal(device GPUDevice) (GPUMetrics, error) {
 	if ret == nvml.SUCCESS {
 		metrics.Temperature = int(temperature)
 	} else if ret != nvml.ERROR_NOT_SUPPORTED {
-		return metrics, fmt.Errorf("failed to get temperature: %s", nvml.ErrorString(ret))
+		errs = append(errs, fmt.Errorf("failed to get temperature: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("temperature")
 	}
 
-	return metrics, nil
-}
+	// Get memory temperature
+	if device.HasMemoryTemperature {
+		memoryTemperature, ret := getMemoryTemperature(device.Handle)
+		if ret == nvml.SUCCESS {
+			metrics.MemoryTemperature = memoryTemperature
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get memory temperature: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("memory_temperature")
+		}
+	}
 
-// GetShortPCIBusID formats PCI Bus ID from 00000000:04:00.0 to 00:04:00.0
-func GetShortPCIBusID(pciBusID string) string {
-	// Split by colon to separate domain:bus:device.function
-	parts := strings.Split(pciBusID, ":")
-	if len(parts) >= 3 {
-		// Format: domain should be 2 digits instead of 8
-		domain := parts[0]
-		if len(domain) > 2 {
-			// Take the last 2 characters of the domain
-			domain = domain[len(domain)-2:]
-		}
-		// Return formatted as domain:bus:device.function
-		return fmt.Sprintf("%s:%s:%s", domain, parts[1], parts[2])
-	}
-	// If format is unexpected, return as-is
-	return pciBusID
-}
+	// Get clock VF offsets
+	if device.HasClockOffsets {
+		coreOffset, ret := device.Handle.GetGpcClkVfOffset()
+		if ret == nvml.SUCCESS {
+			metrics.CoreClockOffset = coreOffset
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get core clock offset: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("clock_offset_core")
+		}
+
+		memoryOffset, ret := device.Handle.GetMemClkVfOffset()
+		if ret == nvml.SUCCESS {
+			metrics.MemoryClockOffset = memoryOffset
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get memory clock offset: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("clock_offset_memory")
+		}
+	}
+
+	// Get current, maximum and applications SM clocks
+	graphicsClock, ret := device.Handle.GetClockInfo(nvml.CLOCK_SM)
+	if ret == nvml.SUCCESS {
+		metrics.GraphicsClock = int(graphicsClock)
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get graphics clock: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("graphics_clock")
+	}
+
+	maxGraphicsClock, ret := device.Handle.GetMaxClockInfo(nvml.CLOCK_SM)
+	if ret == nvml.SUCCESS {
+		metrics.MaxGraphicsClock = int(maxGraphicsClock)
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get max graphics clock: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("max_graphics_clock")
+	}
+
+	applicationsClock, ret := device.Handle.GetApplicationsClock(nvml.CLOCK_SM)
+	if ret == nvml.SUCCESS {
+		metrics.ApplicationsClock = int(applicationsClock)
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get applications clock: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("applications_clock")
+	}
+
+	// Get the video encoder/decoder clock
+	videoClock, ret := device.Handle.GetClockInfo(nvml.CLOCK_VIDEO)
+	if ret == nvml.SUCCESS {
+		metrics.VideoClock = int(videoClock)
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get video clock: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("video_clock")
+	}
+
+	// Get current and maximum PCIe link generation and width
+	for _, link := range []struct {
+		key   string
+		name  string
+		get   func() (int, nvml.Return)
+		value *int
+	}{
+		{"pcie_link_gen", "PCIe link generation", device.Handle.GetCurrPcieLinkGeneration, &metrics.PCIeLinkGen},
+		{"max_pcie_link_gen", "max PCIe link generation", device.Handle.GetMaxPcieLinkGeneration, &metrics.MaxPCIeLinkGen},
+		{"pcie_link_width", "PCIe link width", device.Handle.GetCurrPcieLinkWidth, &metrics.PCIeLinkWidth},
+		{"max_pcie_link_width", "max PCIe link width", device.Handle.GetMaxPcieLinkWidth, &metrics.MaxPCIeLinkWidth},
+	} {
+		value, ret := link.get()
+		if ret == nvml.SUCCESS {
+			*link.value = value
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get %s: %s", link.name, nvml.ErrorString(ret)))
+			metrics.markFailed(link.key)
+		}
+	}
 
-// GetDeviceID generates a unique device identifier for MQTT topics
-func GetDeviceID(device GPUDevice) string {
-	// Format PCI Bus ID to short format and remove unwanted characters
-	shortPCIBusID := GetShortPCIBusID(device.PCIBusID)
-	deviceID := strings.Replace(shortPCIBusID, ":", "_", -1)
-	deviceID = strings.Replace(deviceID, ".", "_", -1)
+	// Get NVENC encoder sessions
+	if device.HasEncoderStats {
+		sessions, averageFPS, _, ret := device.Handle.GetEncoderStats()
+		if ret == nvml.SUCCESS {
+			metrics.EncoderSessions = sessions
+			metrics.EncoderFPS = int(averageFPS)
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get encoder stats: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("encoder_sessions", "encoder_fps")
+		}
+	}
 
-	// Add GPU UUID suffix (first 8 characters) to ensure uniqueness across different machines
-	uuidSuffix := strings.Replace(device.UUID, "-", "", -1)
-	if len(uuidSuffix) > 8 {
-		uuidSuffix = uuidSuffix[:8]
+	// Get compute and persistence mode
+	if device.HasComputeMode {
+		computeMode, ret := device.Handle.GetComputeMode()
+		if ret == nvml.SUCCESS {
+			metrics.ComputeMode = computeModeName(int(computeMode))
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get compute mode: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("compute_mode")
+		}
+	}
+	if device.HasPersistenceMode {
+		persistenceMode, ret := device.Handle.GetPersistenceMode()
+		if ret == nvml.SUCCESS {
+			metrics.PersistenceMode = persistenceMode == nvml.FEATURE_ENABLED
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get persistence mode: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("persistence_mode")
+		}
 	}
 
-	return strings.ToLower(fmt.Sprintf("%s_%s", deviceID, uuidSuffix))
+	// Get NVLink throughput, link state and errors
+	if len(device.NvLinks) > 0 {
+		totalKiB, ret := getNvLinkDataKiB(device.Handle)
+		if ret == nvml.SUCCESS {
+			metrics.NvLinkThroughput = nvlinkThroughput(device.UUID, totalKiB, metrics.Timestamp)
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get NVLink throughput: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("nvlink_throughput")
+		}
+
+		for _, link := range device.NvLinks {
+			state, ret := device.Handle.GetNvLinkState(link)
+			if ret == nvml.SUCCESS {
+				if state == nvml.FEATURE_ENABLED {
+					metrics.NvLinkActiveLinks++
+				}
+			} else if ret != nvml.ERROR_NOT_SUPPORTED {
+				errs = append(errs, fmt.Errorf("failed to get NVLink %d state: %s", link, nvml.ErrorString(ret)))
+				metrics.markFailed("nvlink_state")
+			}
+
+			for _, counter := range nvLinkErrorCounters {
+				errors, ret := device.Handle.GetNvLinkErrorCounter(link, counter)
+				if ret == nvml.SUCCESS {
+					metrics.NvLinkErrors += errors
+				} else if ret != nvml.ERROR_NOT_SUPPORTED {
+					errs = append(errs, fmt.Errorf("failed to get NVLink %d error counter: %s", link, nvml.ErrorString(ret)))
+					metrics.markFailed("nvlink_errors")
+				}
+			}
+		}
+	}
+
+	// Get clock throttle reasons
+	throttleReasons, ret := device.Handle.GetCurrentClocksThrottleReasons()
+	if ret == nvml.SUCCESS {
+		metrics.ThrottleReasons = throttleReasons
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get clock throttle reasons: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("throttle_reasons", "throttle_thermal", "throttle_power")
+	}
+
+	// Get reliability policy violations
+	if device.HasReliabilityViolations {
+		violation, ret := device.Handle.GetViolationStatus(nvml.PERF_POLICY_RELIABILITY)
+		if ret == nvml.SUCCESS {
+			metrics.ReliabilityThrottled = reliabilityThrottled(device.UUID, violation.ViolationTime)
+		} else if ret != nvml.ERROR_NOT_SUPPORTED {
+			errs = append(errs, fmt.Errorf("failed to get reliability violations: %s", nvml.ErrorString(ret)))
+			metrics.markFailed("throttle_reliability")
+		}
+	}
+
+	// Get total energy consumption
+	energy, ret := device.Handle.GetTotalEnergyConsumption()
+	if ret == nvml.SUCCESS {
+		metrics.TotalEnergyJoules = float64(energy) / 1000.0 // Convert mJ to J
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get total energy consumption: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("energy_consumption")
+	}
+
+	return metrics, metricsError(metrics, errs)
 }
 
-// GetDeviceDisplayName generates a display name in the format: {HOSTNAME} {PCI ID} - NVIDIA {MODEL} {VRAM}
-func GetDeviceDisplayName(device GPUDevice, hostname string) string {
-	vramGB := float64(device.Memory) / (1024 * 1024 * 1024)
+// getQuickMetricsInternal reads the metrics returned by GetQuickMetrics with mutex protection
+func getQuickMetricsInternal(device GPUDevice) (GPUMetrics, error) {
+	unlock := lockDevice(device)
+	defer unlock()
 
-	// Extract model name from device name (remove "NVIDIA" prefix if present)
-	modelName := device.Name
-	if strings.HasPrefix(strings.ToUpper(modelName), "NVIDIA ") {
-		modelName = strings.TrimPrefix(modelName, "NVIDIA ")
+	metrics := GPUMetrics{Timestamp: time.Now()}
+	var errs []error
+
+	utilization, ret := device.Handle.GetUtilizationRates()
+	if ret == nvml.SUCCESS {
+		metrics.GPUUtilization = int(utilization.Gpu)
+	} else if isLost(ret) {
+		return GPUMetrics{}, fmt.Errorf("failed to get utilization rates: %s: %w", nvml.ErrorString(ret), ErrGPULost)
+	} else {
+		errs = append(errs, fmt.Errorf("failed to get utilization rates: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("gpu_utilization")
 	}
 
-	// Use short format PCI Bus ID (00:04:00.0 instead of 00000000:04:00.0)
-	shortPCIBusID := GetShortPCIBusID(device.PCIBusID)
-	return fmt.Sprintf("%s %s - NVIDIA %s %.0fGB", hostname, shortPCIBusID, modelName, vramGB)
+	temperature, ret := device.Handle.GetTemperature(nvml.TEMPERATURE_GPU)
+	if ret == nvml.SUCCESS {
+		metrics.Temperature = int(temperature)
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get temperature: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("temperature")
+	}
+
+	power, ret := device.Handle.GetPowerUsage()
+	if ret == nvml.SUCCESS {
+		metrics.PowerDraw = float64(power) / 1000.0 // Convert mW to W
+	} else if ret != nvml.ERROR_NOT_SUPPORTED {
+		errs = append(errs, fmt.Errorf("failed to get power usage: %s", nvml.ErrorString(ret)))
+		metrics.markFailed("power_draw")
+	}
+
+	return metrics, metricsError(metrics, errs)
 }
 
 // GetNVMLVersion returns the NVML version information
 func GetNVMLVersion() (string, error) {
-	requestMutex.Lock()
-	defer requestMutex.Unlock()
+	requestMutex.RLock()
+	defer requestMutex.RUnlock()
 
 	version, ret := nvml.SystemGetNVMLVersion()
 	if ret != nvml.SUCCESS {
@@ -265,8 +684,8 @@ func GetNVMLVersion() (string, error) {
 
 // GetDriverVersion returns the NVIDIA driver version
 func GetDriverVersion() (string, error) {
-	requestMutex.Lock()
-	defer requestMutex.Unlock()
+	requestMutex.RLock()
+	defer requestMutex.RUnlock()
 
 	version, ret := nvml.SystemGetDriverVersion()
 	if ret != nvml.SUCCESS {
@@ -275,10 +694,293 @@ func GetDriverVersion() (string, error) {
 	return version, nil
 }
 
+// GetP2PStatus returns the peer-to-peer link type from device to peer: P2PLinkNVLink,
+// P2PLinkPCIe or P2PLinkNone
+func GetP2PStatus(device, peer GPUDevice) (string, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+	return p2pLink(device, peer)
+}
+
+// p2pLink reads the peer-to-peer link type from device to peer, preferring NVLink
+func p2pLink(device, peer GPUDevice) (string, error) {
+	status, ret := device.Handle.GetP2PStatus(peer.Handle, nvml.P2P_CAPS_INDEX_NVLINK)
+	if ret == nvml.SUCCESS && status == nvml.P2P_STATUS_OK {
+		return P2PLinkNVLink, nil
+	}
+
+	status, ret = device.Handle.GetP2PStatus(peer.Handle, nvml.P2P_CAPS_INDEX_READ)
+	if ret != nvml.SUCCESS {
+		return "", fmt.Errorf("failed to get P2P status to GPU %d: %s", peer.Index, nvml.ErrorString(ret))
+	}
+	if status == nvml.P2P_STATUS_OK {
+		return P2PLinkPCIe, nil
+	}
+	return P2PLinkNone, nil
+}
+
+// ClearEccErrors resets the volatile ECC error counters of a GPU device
+func ClearEccErrors(device GPUDevice) error {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	ret := device.Handle.ClearEccErrorCounts(nvml.VOLATILE_ECC)
+	if ret == nvml.ERROR_NO_PERMISSION {
+		return fmt.Errorf("no permission to clear ECC error counts for device %s (root required)", device.Name)
+	} else if ret != nvml.SUCCESS {
+		return fmt.Errorf("failed to clear ECC error counts: %s", nvml.ErrorString(ret))
+	}
+	return nil
+}
+
+// GetFanSpeed returns the current speed of a fan in percent
+func GetFanSpeed(device GPUDevice, fan int) (int, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	speed, ret := device.Handle.GetFanSpeed_v2(fan)
+	if ret == nvml.ERROR_NOT_SUPPORTED {
+		return 0, fmt.Errorf("fan %d speed: %w", fan, ErrNotSupported)
+	} else if ret != nvml.SUCCESS {
+		return 0, fmt.Errorf("failed to get fan %d speed: %s", fan, nvml.ErrorString(ret))
+	}
+	return int(speed), nil
+}
+
+// SetFanSpeed switches a fan to manual control at the given speed in percent
+func SetFanSpeed(device GPUDevice, fan int, percent int) error {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	ret := device.Handle.SetFanSpeed_v2(fan, percent)
+	if ret == nvml.ERROR_NO_PERMISSION {
+		return fmt.Errorf("setting fan %d speed for device %s (root required): %w", fan, device.Name, ErrNoPermission)
+	} else if ret == nvml.ERROR_NOT_SUPPORTED {
+		return fmt.Errorf("manual fan control for device %s: %w", device.Name, ErrNotSupported)
+	} else if ret != nvml.SUCCESS {
+		return fmt.Errorf("failed to set fan %d speed: %s", fan, nvml.ErrorString(ret))
+	}
+	return nil
+}
+
+// SetDefaultFanSpeed restores the automatic fan control policy of a fan
+func SetDefaultFanSpeed(device GPUDevice, fan int) error {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	ret := device.Handle.SetDefaultFanSpeed_v2(fan)
+	if ret == nvml.ERROR_NO_PERMISSION {
+		return fmt.Errorf("restoring fan %d policy for device %s (root required): %w", fan, device.Name, ErrNoPermission)
+	} else if ret == nvml.ERROR_NOT_SUPPORTED {
+		return fmt.Errorf("fan control for device %s: %w", device.Name, ErrNotSupported)
+	} else if ret != nvml.SUCCESS {
+		return fmt.Errorf("failed to restore default fan %d speed: %s", fan, nvml.ErrorString(ret))
+	}
+	return nil
+}
+
+// maxNUMANodes is the number of NUMA nodes the memory affinity is read for
+const maxNUMANodes = 64
+
+// numaNodes returns the NUMA nodes set in the bitmask words of a memory affinity
+func numaNodes(nodeSet []uint) []int {
+	var nodes []int
+	for word, set := range nodeSet {
+		for bit := 0; bit < bits.UintSize; bit++ {
+			if set&(1<<bit) != 0 {
+				nodes = append(nodes, word*bits.UintSize+bit)
+			}
+		}
+	}
+	return nodes
+}
+
+// sampledUtilization reads the GPU utilization of device since the previous read from the
+// configured utilization source. It returns false for the instant source or without new samples.
+func sampledUtilization(device GPUDevice) (int, bool) {
+	last := lastUtilizationTimestamp(device.UUID)
+
+	switch utilizationSource {
+	case UtilizationSourceSamples:
+		valueType, samples, ret := device.Handle.GetSamples(nvml.GPU_UTILIZATION_SAMPLES, last)
+		if ret != nvml.SUCCESS || valueType != nvml.VALUE_TYPE_UNSIGNED_INT {
+			return 0, false
+		}
+		values := make([]utilizationSample, 0, len(samples))
+		for _, sample := range samples {
+			values = append(values, utilizationSample{timestamp: sample.TimeStamp, value: binary.LittleEndian.Uint32(sample.SampleValue[:4])})
+		}
+		return averageUtilization(device.UUID, last, values)
+
+	case UtilizationSourceProcess:
+		samples, ret := device.Handle.GetProcessUtilization(last)
+		if ret == nvml.ERROR_NOT_FOUND {
+			// No process used the GPU since the previous read
+			return 0, true
+		} else if ret != nvml.SUCCESS {
+			return 0, false
+		}
+		values := make([]utilizationSample, 0, len(samples))
+		for _, sample := range samples {
+			values = append(values, utilizationSample{timestamp: sample.TimeStamp, value: sample.SmUtil})
+		}
+		return processUtilization(device.UUID, values), true
+	}
+	return 0, false
+}
+
+// gpmSamples holds the previous GPM sample of every device by UUID (guarded by samplesMutex)
+var gpmSamples = make(map[string]nvml.GpmSample)
+
+// getDRAMBandwidthUtil takes a GPM sample of device and returns the DRAM bandwidth
+// utilization in percent since the previous one. ok is false on the first read.
+func getDRAMBandwidthUtil(device GPUDevice) (float64, bool, nvml.Return) {
+	sample, ret := nvml.GpmSampleAlloc()
+	if ret != nvml.SUCCESS {
+		return 0, false, ret
+	}
+	if ret := device.Handle.GpmSampleGet(sample); ret != nvml.SUCCESS {
+		sample.Free()
+		return 0, false, ret
+	}
+
+	samplesMutex.Lock()
+	previous, ok := gpmSamples[device.UUID]
+	gpmSamples[device.UUID] = sample
+	samplesMutex.Unlock()
+	if !ok {
+		return 0, false, nvml.SUCCESS
+	}
+	defer previous.Free()
+
+	metricsGet := nvml.GpmMetricsGetType{
+		NumMetrics: 1,
+		Sample1:    previous,
+		Sample2:    sample,
+		Metrics:    [210]nvml.GpmMetric{{MetricId: uint32(nvml.GPM_METRIC_DRAM_BW_UTIL)}},
+	}
+	if ret := nvml.GpmMetricsGet(&metricsGet); ret != nvml.SUCCESS {
+		return 0, false, ret
+	}
+	if ret := nvml.Return(metricsGet.Metrics[0].NvmlReturn); ret != nvml.SUCCESS {
+		return 0, false, ret
+	}
+	return metricsGet.Metrics[0].Value, true, nvml.SUCCESS
+}
+
+// freeGPMSamples frees the previous GPM samples of all devices
+func freeGPMSamples() {
+	samplesMutex.Lock()
+	defer samplesMutex.Unlock()
+	for uuid, sample := range gpmSamples {
+		sample.Free()
+		delete(gpmSamples, uuid)
+	}
+}
+
+// getUnsupported probes the metrics read for every card once and returns the sensors
+// whose metric device does not support
+func getUnsupported(device nvml.Device) map[string]bool {
+	unsupported := make(map[string]bool)
+	probe := func(ret nvml.Return, keys ...string) {
+		if ret == nvml.ERROR_NOT_SUPPORTED {
+			for _, key := range keys {
+				unsupported[key] = true
+			}
+		}
+	}
+
+	_, ret := device.GetPowerUsage()
+	probe(ret, "power_draw")
+	_, ret = device.GetPerformanceState()
+	probe(ret, "performance_level", "performance_state_num")
+	_, ret = device.GetUtilizationRates()
+	probe(ret, "gpu_utilization", "busy", "memory_bandwidth_util")
+	_, ret = device.GetTemperature(nvml.TEMPERATURE_GPU)
+	probe(ret, "temperature")
+	_, ret = device.GetClockInfo(nvml.CLOCK_SM)
+	probe(ret, "graphics_clock")
+	_, ret = device.GetMaxClockInfo(nvml.CLOCK_SM)
+	probe(ret, "max_graphics_clock")
+	_, ret = device.GetApplicationsClock(nvml.CLOCK_SM)
+	probe(ret, "applications_clock")
+	_, ret = device.GetTotalEnergyConsumption()
+	probe(ret, "energy_consumption")
+	_, ret = device.GetClockInfo(nvml.CLOCK_VIDEO)
+	probe(ret, "video_clock")
+	_, ret = device.GetCurrPcieLinkGeneration()
+	probe(ret, "pcie_link_gen")
+	_, ret = device.GetMaxPcieLinkGeneration()
+	probe(ret, "max_pcie_link_gen")
+	_, ret = device.GetCurrPcieLinkWidth()
+	probe(ret, "pcie_link_width")
+	_, ret = device.GetMaxPcieLinkWidth()
+	probe(ret, "max_pcie_link_width")
+
+	return unsupported
+}
+
+// getDiagnostics reads the serial number, VBIOS version and NUMA nodes of device,
+// leaving out the ones the board does not report
+func getDiagnostics(device nvml.Device) GPUDiagnostics {
+	var diagnostics GPUDiagnostics
+	if serial, ret := device.GetSerial(); ret == nvml.SUCCESS {
+		diagnostics.Serial = serial
+	}
+	if version, ret := device.GetVbiosVersion(); ret == nvml.SUCCESS {
+		diagnostics.VBIOSVersion = version
+	}
+	if nodeSet, ret := device.GetMemoryAffinity(maxNUMANodes, nvml.AFFINITY_SCOPE_NODE); ret == nvml.SUCCESS {
+		diagnostics.NUMANodes = numaNodes(nodeSet)
+	}
+	if mode, ret := device.GetVirtualizationMode(); ret == nvml.SUCCESS {
+		diagnostics.VirtualizationMode = virtualizationModeName(int(mode))
+	}
+	return diagnostics
+}
+
+// getMemoryInfo reads the memory info of device with the reserved VRAM if the driver supports
+// the v2 call, otherwise with the v1 call (Reserved is 0 and Used includes it)
+func getMemoryInfo(device GPUDevice) (nvml.Memory_v2, nvml.Return) {
+	if device.HasMemoryInfoV2 {
+		return device.Handle.GetMemoryInfo_v2()
+	}
+	memInfo, ret := device.Handle.GetMemoryInfo()
+	return nvml.Memory_v2{Total: memInfo.Total, Free: memInfo.Free, Used: memInfo.Used}, ret
+}
+
+// isLost reports whether ret means the GPU is no longer usable until it is reset
+func isLost(ret nvml.Return) bool {
+	return ret == nvml.ERROR_GPU_IS_LOST || ret == nvml.ERROR_UNKNOWN
+}
+
+// reacquireHandle replaces the handle of device by a fresh one looked up by PCI bus ID
+func reacquireHandle(device GPUDevice) (GPUDevice, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	handle, ret := nvml.DeviceGetHandleByPciBusId(device.PCIBusID)
+	if ret != nvml.SUCCESS {
+		return device, fmt.Errorf("failed to get device handle for %s: %s", device.PCIBusID, nvml.ErrorString(ret))
+	}
+
+	// A GPU that is still lost hands out a handle that cannot be read
+	uuid, ret := handle.GetUUID()
+	if ret != nvml.SUCCESS {
+		return device, fmt.Errorf("failed to get device UUID: %s", nvml.ErrorString(ret))
+	}
+	if uuid != device.UUID {
+		log.Printf("Warning: GPU at %s changed its UUID from %s to %s, keeping the old one for its entities", device.PCIBusID, device.UUID, uuid)
+	}
+
+	device.Handle = handle
+	return device, nil
+}
+
 // IsDeviceAvailable checks if a GPU device is still available and responsive
 func IsDeviceAvailable(device GPUDevice) bool {
-	requestMutex.Lock()
-	defer requestMutex.Unlock()
+	unlock := lockDevice(device)
+	defer unlock()
 
 	// Try to get device name as a simple health check
 	_, ret := device.Handle.GetName()
@@ -4,76 +4,1160 @@
 package nvidia
 
 import (
-	"errors"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// go-nvml only supports Linux (it loads the library through dlopen), so on
+// Windows the NVML C API is called directly from nvml.dll, which ships with
+// the NVIDIA driver.
+
+// nvmlReturn mirrors nvmlReturn_t
+type nvmlReturn uintptr
+
+const (
+	nvmlSuccess               nvmlReturn = 0
+	nvmlErrorNotSupported     nvmlReturn = 3
+	nvmlErrorNoPermission     nvmlReturn = 4
+	nvmlErrorNotFound         nvmlReturn = 6
+	nvmlErrorInsufficientSize nvmlReturn = 7
+	nvmlErrorFunctionNotFound nvmlReturn = 13
+	nvmlErrorGPUIsLost        nvmlReturn = 15
+	nvmlErrorUnknown          nvmlReturn = 999
+)
+
+// NVML constants used by this package (see nvml.h)
+const (
+	nvmlTemperatureGPU               = 0
+	nvmlPStateUnknown                = 32
+	nvmlClockSM                      = 1
+	nvmlClockVideo                   = 3
+	nvmlGPUUtilizationSamples        = 1
+	nvmlP2PCapsIndexRead             = 0
+	nvmlP2PCapsIndexNVLink           = 2
+	nvmlP2PStatusOK                  = 0
+	nvmlTemperatureThresholdShutdown = 0
+	nvmlTemperatureThresholdSlowdown = 1
+	nvmlFeatureEnabled               = 1
+	nvmlPerfPolicyReliability        = 5
+	nvmlVolatileECC                  = 0
+	nvmlFieldMemoryTemp              = 82
+	nvmlFieldNvLinkThroughputDataTx  = 138
+	nvmlFieldNvLinkThroughputDataRx  = 139
+	nvmlFieldScopeAllLinks           = 0xFFFFFFFF
+	nvmlNvLinkMaxLinks               = 18
+	nvmlNvLinkErrorCounterCount      = 5 // DL_REPLAY, DL_RECOVERY, DL_CRC_FLIT, DL_CRC_DATA, DL_ECC_DATA
+
+	nvmlValueTypeDouble           = 0
+	nvmlValueTypeUnsignedInt      = 1
+	nvmlValueTypeUnsignedLong     = 2
+	nvmlValueTypeUnsignedLongLong = 3
+	nvmlValueTypeSignedLongLong   = 4
+	nvmlValueTypeSignedInt        = 5
+	nvmlValueTypeUnsignedShort    = 6
+
+	nvmlStringBufferSize = 96
+)
+
+// nvmlPciInfo mirrors nvmlPciInfo_t (v3)
+type nvmlPciInfo struct {
+	BusIdLegacy    [16]byte
+	Domain         uint32
+	Bus            uint32
+	Device         uint32
+	PciDeviceId    uint32
+	PciSubSystemId uint32
+	BusId          [32]byte
+}
+
+// nvmlMemory mirrors nvmlMemory_t
+type nvmlMemory struct {
+	Total uint64
+	Free  uint64
+	Used  uint64
+}
+
+// nvmlMemoryV2 mirrors nvmlMemory_v2_t, Version must be set to nvmlMemoryV2Version
+type nvmlMemoryV2 struct {
+	Version  uint32
+	Total    uint64
+	Reserved uint64
+	Free     uint64
+	Used     uint64
+}
+
+// nvmlMemoryV2Version is the nvmlMemory_v2 version: the struct size with the version in the top byte
+var nvmlMemoryV2Version = uint32(unsafe.Sizeof(nvmlMemoryV2{})) | 2<<24
+
+// nvmlViolationTime mirrors nvmlViolationTime_t
+type nvmlViolationTime struct {
+	ReferenceTime uint64
+	ViolationTime uint64
+}
+
+// nvmlBAR1Memory mirrors nvmlBAR1Memory_t
+type nvmlBAR1Memory struct {
+	Bar1Total uint64
+	Bar1Free  uint64
+	Bar1Used  uint64
+}
+
+// nvmlUtilization mirrors nvmlUtilization_t
+type nvmlUtilization struct {
+	Gpu    uint32
+	Memory uint32
+}
+
+// nvmlSample mirrors nvmlSample_t, the value is a union of nvmlValue_t
+type nvmlSample struct {
+	TimeStamp   uint64
+	SampleValue [8]byte
+}
+
+// nvmlProcessUtilizationSample mirrors nvmlProcessUtilizationSample_t
+type nvmlProcessUtilizationSample struct {
+	Pid       uint32
+	TimeStamp uint64
+	SmUtil    uint32
+	MemUtil   uint32
+	EncUtil   uint32
+	DecUtil   uint32
+}
+
+// nvmlFieldValue mirrors nvmlFieldValue_t
+type nvmlFieldValue struct {
+	FieldId     uint32
+	ScopeId     uint32
+	Timestamp   int64
+	LatencyUsec int64
+	ValueType   uint32
+	NvmlReturn  uint32
+	Value       [8]byte
+}
+
+var (
+	nvmlDLL   *syscall.DLL
+	procMutex sync.Mutex // guards procs
+	procs     = make(map[string]*syscall.Proc)
 )
 
 // GPUDevice represents an NVIDIA GPU device
 type GPUDevice struct {
 	Index    int
-	Handle   interface{} // Placeholder for Windows
+	Handle   uintptr // nvmlDevice_t
 	Name     string
 	PCIBusID string
 	Memory   uint64 // Total memory in bytes
 	UUID     string
+
+	// HasMemoryTemperature reports whether the device exposes a memory temperature sensor
+	HasMemoryTemperature bool
+	// HasClockOffsets reports whether the device exposes core/memory clock VF offsets
+	HasClockOffsets bool
+	// HasECC reports whether ECC is currently enabled on the device
+	HasECC bool
+	// HasBAR1 reports whether the device reports BAR1 memory usage
+	HasBAR1 bool
+	// HasThrottleReasons reports whether the device reports its clock throttle reasons
+	HasThrottleReasons bool
+	// HasReliabilityViolations reports whether the device reports reliability policy violations
+	HasReliabilityViolations bool
+	// HasEncoderStats reports whether the device reports its NVENC encoder sessions
+	HasEncoderStats bool
+	// HasMemoryInfoV2 reports whether the driver reports the reserved VRAM (nvmlDeviceGetMemoryInfo_v2)
+	HasMemoryInfoV2 bool
+	// HasComputeMode reports whether the device reports its compute mode
+	HasComputeMode bool
+	// HasPersistenceMode reports whether the device reports persistence mode (Linux only)
+	HasPersistenceMode bool
+	// NvLinks lists the NVLink link indexes of the device (empty without NVLink)
+	NvLinks []int
+
+	// Temperature thresholds in Celsius, read once at enumeration (0 if not supported)
+	SlowdownTemperature int
+	ShutdownTemperature int
+
+	// FanCount is the number of fans (0 if not supported); manual fan speeds must
+	// lie between MinFanSpeed and MaxFanSpeed percent
+	FanCount    int
+	MinFanSpeed int
+	MaxFanSpeed int
+
+	// Diagnostics holds the serial number and VBIOS version of the board
+	Diagnostics GPUDiagnostics
+
+	// DuplicateID is set when another enumerated GPU has the same device ID (vGPU or
+	// passthrough instances sharing a UUID); GetDeviceID then appends the index
+	DuplicateID bool
+
+	// Unsupported lists the sensors, by key, whose metric the card reported as not supported
+	// at enumeration (e.g. power draw on some GeForce boards); see Supports
+	Unsupported map[string]bool
+
+	// P2PPeers lists the peer-to-peer links to the other enumerated GPUs, read once at
+	// enumeration (empty on single-GPU hosts)
+	P2PPeers []P2PPeer
 }
 
-// GPUMetrics contains current GPU metrics
-type GPUMetrics struct {
-	PowerDraw         float64 // Watts
-	PerformanceLevel  string  // P0, P8, etc.
-	MemoryUsage       float64 // Percentage
-	GPUUtilization    int     // Percentage
-	MemoryUtilization int     // Percentage
-	Temperature       int     // Celsius
+// loadNVML loads nvml.dll from System32 (DCH drivers) or the legacy NVSMI directory
+func loadNVML() (*syscall.DLL, error) {
+	candidates := []string{
+		filepath.Join(os.Getenv("SystemRoot"), "System32", "nvml.dll"),
+		filepath.Join(os.Getenv("ProgramFiles"), "NVIDIA Corporation", "NVSMI", "nvml.dll"),
+	}
+
+	var lastErr error
+	for _, path := range candidates {
+		dll, err := syscall.LoadDLL(path)
+		if err == nil {
+			return dll, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("failed to load nvml.dll: %v", lastErr)
+}
+
+// findProc looks up an exported NVML function, caching the result
+func findProc(name string) *syscall.Proc {
+	procMutex.Lock()
+	defer procMutex.Unlock()
+
+	if proc, ok := procs[name]; ok {
+		return proc
+	}
+	if nvmlDLL == nil {
+		return nil
+	}
+
+	proc, err := nvmlDLL.FindProc(name)
+	if err != nil {
+		return nil
+	}
+	procs[name] = proc
+	return proc
+}
+
+// nvmlCall calls an NVML function by name, returning ERROR_FUNCTION_NOT_FOUND
+// if the installed driver does not export it
+//
+//go:uintptrescapes
+func nvmlCall(name string, args ...uintptr) nvmlReturn {
+	proc := findProc(name)
+	if proc == nil {
+		return nvmlErrorFunctionNotFound
+	}
+
+	ret, _, _ := proc.Call(args...)
+	return nvmlReturn(uint32(ret))
+}
+
+// errorString returns the NVML description of an error code
+func errorString(ret nvmlReturn) string {
+	proc := findProc("nvmlErrorString")
+	if ret == nvmlErrorFunctionNotFound || proc == nil {
+		return fmt.Sprintf("NVML error %d", ret)
+	}
+
+	r, _, _ := proc.Call(uintptr(ret))
+	// Reinterpret the returned const char* without a uintptr to pointer conversion
+	return cString(*(**byte)(unsafe.Pointer(&r)))
+}
+
+// cString converts a NUL-terminated C string to a Go string
+func cString(p *byte) string {
+	if p == nil {
+		return ""
+	}
+	var buf []byte
+	for ptr := unsafe.Pointer(p); *(*byte)(ptr) != 0; ptr = unsafe.Add(ptr, 1) {
+		buf = append(buf, *(*byte)(ptr))
+	}
+	return string(buf)
+}
+
+// bufferString converts a NUL-terminated byte buffer to a Go string
+func bufferString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
+
+// getSystemString calls an NVML function of the form fn(char *buf, unsigned int length)
+func getSystemString(name string) (string, nvmlReturn) {
+	buf := make([]byte, nvmlStringBufferSize)
+	ret := nvmlCall(name, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	return bufferString(buf), ret
+}
+
+// getDeviceString calls an NVML function of the form fn(nvmlDevice_t, char *buf, unsigned int length)
+func getDeviceString(name string, handle uintptr) (string, nvmlReturn) {
+	buf := make([]byte, nvmlStringBufferSize)
+	ret := nvmlCall(name, handle, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+	return bufferString(buf), ret
 }
 
 // Init initializes the NVML library
 func Init() error {
-	return errors.New("NVML is not supported on Windows build. Please use Linux build for production")
+	requestMutex.Lock()
+	defer requestMutex.Unlock()
+
+	if nvmlDLL == nil {
+		dll, err := loadNVML()
+		if err != nil {
+			return fmt.Errorf("failed to initialize NVML: %v", err)
+		}
+		nvmlDLL = dll
+	}
+
+	ret := nvmlCall("nvmlInit_v2")
+	if ret != nvmlSuccess {
+		return fmt.Errorf("failed to initialize NVML: %s", errorString(ret))
+	}
+	return nil
 }
 
-// Shutdown shuts down the NVML library
+// Shutdown shuts down the NVML library. It is skipped while a request is hung, since
+// waiting for it could block the exit of the process forever.
 func Shutdown() error {
+	if HungRequests() > 0 {
+		return fmt.Errorf("failed to shutdown NVML: %d device(s) with a hung request", HungRequests())
+	}
+
+	requestMutex.Lock()
+	defer requestMutex.Unlock()
+
+	ret := nvmlCall("nvmlShutdown")
+	if ret != nvmlSuccess {
+		return fmt.Errorf("failed to shutdown NVML: %s", errorString(ret))
+	}
 	return nil
 }
 
-// GetGPUDevices returns all available GPU devices
+// GetGPUDevices returns all available GPU devices. Devices that fail to
+// enumerate are skipped with a warning; an error is only returned if none succeed.
 func GetGPUDevices() ([]GPUDevice, error) {
-	return nil, errors.New("NVML is not supported on Windows build. Please use Linux build for production")
+	requestMutex.Lock()
+	defer requestMutex.Unlock()
+
+	var count uint32
+	ret := nvmlCall("nvmlDeviceGetCount_v2", uintptr(unsafe.Pointer(&count)))
+	if ret != nvmlSuccess {
+		return nil, fmt.Errorf("failed to get device count: %s", errorString(ret))
+	}
+
+	devices := make([]GPUDevice, 0, count)
+	var lastErr error
+
+	for i := 0; i < int(count); i++ {
+		var handle uintptr
+		ret := nvmlCall("nvmlDeviceGetHandleByIndex_v2", uintptr(i), uintptr(unsafe.Pointer(&handle)))
+		if ret != nvmlSuccess {
+			lastErr = fmt.Errorf("failed to get device handle for index %d: %s", i, errorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
+		}
+
+		// Get device name
+		name, ret := getDeviceString("nvmlDeviceGetName", handle)
+		if ret != nvmlSuccess {
+			lastErr = fmt.Errorf("failed to get device name: %s", errorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
+		}
+
+		// Get PCI Bus ID
+		var pciInfo nvmlPciInfo
+		ret = nvmlCall("nvmlDeviceGetPciInfo_v3", handle, uintptr(unsafe.Pointer(&pciInfo)))
+		if ret != nvmlSuccess {
+			lastErr = fmt.Errorf("failed to get PCI info: %s", errorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
+		}
+
+		// Get memory info
+		var memInfo nvmlMemory
+		ret = nvmlCall("nvmlDeviceGetMemoryInfo", handle, uintptr(unsafe.Pointer(&memInfo)))
+		if ret != nvmlSuccess {
+			lastErr = fmt.Errorf("failed to get memory info: %s", errorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
+		}
+
+		// Get UUID
+		uuid, ret := getDeviceString("nvmlDeviceGetUUID", handle)
+		if ret != nvmlSuccess {
+			lastErr = fmt.Errorf("failed to get device UUID: %s", errorString(ret))
+			log.Printf("Warning: skipping GPU %d: %v", i, lastErr)
+			continue
+		}
+
+		// Probe for a memory temperature sensor (HBM/GDDR6X cards)
+		_, ret = getMemoryTemperature(handle)
+		hasMemoryTemperature := ret == nvmlSuccess
+
+		// Probe for clock VF offset support
+		var offset int32
+		ret = nvmlCall("nvmlDeviceGetGpcClkVfOffset", handle, uintptr(unsafe.Pointer(&offset)))
+		hasClockOffsets := ret == nvmlSuccess
+
+		// Check whether ECC is enabled
+		var eccMode, eccPending uint32
+		ret = nvmlCall("nvmlDeviceGetEccMode", handle, uintptr(unsafe.Pointer(&eccMode)), uintptr(unsafe.Pointer(&eccPending)))
+		hasECC := ret == nvmlSuccess && eccMode == nvmlFeatureEnabled
+
+		// Probe for BAR1 memory info
+		var bar1Info nvmlBAR1Memory
+		ret = nvmlCall("nvmlDeviceGetBAR1MemoryInfo", handle, uintptr(unsafe.Pointer(&bar1Info)))
+		hasBAR1 := ret == nvmlSuccess
+
+		// Probe for clock throttle reasons and reliability violations
+		var throttleReasons uint64
+		ret = nvmlCall("nvmlDeviceGetCurrentClocksThrottleReasons", handle, uintptr(unsafe.Pointer(&throttleReasons)))
+		hasThrottleReasons := ret == nvmlSuccess
+		var violation nvmlViolationTime
+		ret = nvmlCall("nvmlDeviceGetViolationStatus", handle, nvmlPerfPolicyReliability, uintptr(unsafe.Pointer(&violation)))
+		hasReliabilityViolations := ret == nvmlSuccess
+
+		// Probe for the v2 memory info with the reserved VRAM (missing on older drivers)
+		memInfoV2 := nvmlMemoryV2{Version: nvmlMemoryV2Version}
+		ret = nvmlCall("nvmlDeviceGetMemoryInfo_v2", handle, uintptr(unsafe.Pointer(&memInfoV2)))
+		hasMemoryInfoV2 := ret == nvmlSuccess
+
+		// Probe for NVENC encoder statistics (missing on cards without NVENC)
+		var encoderSessions, encoderFPS, encoderLatency uint32
+		ret = nvmlCall("nvmlDeviceGetEncoderStats", handle, uintptr(unsafe.Pointer(&encoderSessions)), uintptr(unsafe.Pointer(&encoderFPS)), uintptr(unsafe.Pointer(&encoderLatency)))
+		hasEncoderStats := ret == nvmlSuccess
+
+		// Probe for compute and persistence mode (persistence mode is Linux only)
+		var computeMode, persistenceMode uint32
+		ret = nvmlCall("nvmlDeviceGetComputeMode", handle, uintptr(unsafe.Pointer(&computeMode)))
+		hasComputeMode := ret == nvmlSuccess
+		ret = nvmlCall("nvmlDeviceGetPersistenceMode", handle, uintptr(unsafe.Pointer(&persistenceMode)))
+		hasPersistenceMode := ret == nvmlSuccess
+
+		// Probe for NVLink links
+		var nvLinks []int
+		for link := 0; link < nvmlNvLinkMaxLinks; link++ {
+			var state uint32
+			if ret := nvmlCall("nvmlDeviceGetNvLinkState", handle, uintptr(link), uintptr(unsafe.Pointer(&state))); ret == nvmlSuccess {
+				nvLinks = append(nvLinks, link)
+			}
+		}
+
+		// Temperature thresholds are static per card
+		var slowdownTemperature, shutdownTemperature uint32
+		if ret := nvmlCall("nvmlDeviceGetTemperatureThreshold", handle, nvmlTemperatureThresholdSlowdown, uintptr(unsafe.Pointer(&slowdownTemperature))); ret != nvmlSuccess {
+			slowdownTemperature = 0
+		}
+		if ret := nvmlCall("nvmlDeviceGetTemperatureThreshold", handle, nvmlTemperatureThresholdShutdown, uintptr(unsafe.Pointer(&shutdownTemperature))); ret != nvmlSuccess {
+			shutdownTemperature = 0
+		}
+
+		// Fans and the allowed manual fan speed range
+		var fanCount, minFanSpeed, maxFanSpeed uint32
+		if ret := nvmlCall("nvmlDeviceGetNumFans", handle, uintptr(unsafe.Pointer(&fanCount))); ret != nvmlSuccess {
+			fanCount = 0
+		}
+		if ret := nvmlCall("nvmlDeviceGetMinMaxFanSpeed", handle, uintptr(unsafe.Pointer(&minFanSpeed)), uintptr(unsafe.Pointer(&maxFanSpeed))); ret != nvmlSuccess {
+			minFanSpeed, maxFanSpeed = 0, 100
+		}
+
+		devices = append(devices, GPUDevice{
+			Index:                i,
+			Handle:               handle,
+			Name:                 name,
+			PCIBusID:             bufferString(pciInfo.BusId[:]),
+			Memory:               memInfo.Total,
+			UUID:                 uuid,
+			HasMemoryTemperature: hasMemoryTemperature,
+			HasClockOffsets:      hasClockOffsets,
+			HasECC:               hasECC,
+			HasBAR1:              hasBAR1,
+			HasThrottleReasons:   hasThrottleReasons,
+			HasComputeMode:       hasComputeMode,
+			HasPersistenceMode:   hasPersistenceMode,
+			NvLinks:              nvLinks,
+			SlowdownTemperature:  int(slowdownTemperature),
+			ShutdownTemperature:  int(shutdownTemperature),
+			FanCount:             int(fanCount),
+			MinFanSpeed:          int(minFanSpeed),
+			MaxFanSpeed:          int(maxFanSpeed),
+
+			HasReliabilityViolations: hasReliabilityViolations,
+			HasEncoderStats:          hasEncoderStats,
+			HasMemoryInfoV2:          hasMemoryInfoV2,
+
+			Diagnostics: getDiagnostics(handle),
+			Unsupported: getUnsupported(handle),
+		})
+	}
+
+	// Only fail if no device at all could be enumerated
+	if len(devices) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("failed to enumerate any of %d GPU(s): %v", count, lastErr)
+	}
+
+	markDuplicateIDs(devices)
+	markP2PPeers(devices)
+	return devices, nil
+}
+
+// getMemoryTemperature reads the memory temperature through NVML field values,
+// since it is not available as a temperature sensor value
+func getMemoryTemperature(handle uintptr) (int, nvmlReturn) {
+	value, ret := getFieldValue(handle, nvmlFieldMemoryTemp)
+	return int(value), ret
+}
+
+// getFieldValue reads a single NVML field (one of the nvmlField* IDs) of a device
+func getFieldValue(handle uintptr, fieldID uint32) (int64, nvmlReturn) {
+	values := []nvmlFieldValue{{FieldId: fieldID}}
+	if ret := nvmlCall("nvmlDeviceGetFieldValues", handle, uintptr(len(values)), uintptr(unsafe.Pointer(&values[0]))); ret != nvmlSuccess {
+		return 0, ret
+	}
+	if ret := nvmlReturn(values[0].NvmlReturn); ret != nvmlSuccess {
+		return 0, ret
+	}
+	return fieldValueToInt64(values[0]), nvmlSuccess
 }
 
-// GetGPUMetrics retrieves current metrics for a GPU device
-func GetGPUMetrics(device GPUDevice) (GPUMetrics, error) {
-	return GPUMetrics{}, errors.New("NVML is not supported on Windows build. Please use Linux build for production")
+// getNvLinkDataKiB reads the cumulative NVLink TX+RX data counters summed across all links
+func getNvLinkDataKiB(handle uintptr) (uint64, nvmlReturn) {
+	values := []nvmlFieldValue{
+		{FieldId: nvmlFieldNvLinkThroughputDataTx, ScopeId: nvmlFieldScopeAllLinks},
+		{FieldId: nvmlFieldNvLinkThroughputDataRx, ScopeId: nvmlFieldScopeAllLinks},
+	}
+	if ret := nvmlCall("nvmlDeviceGetFieldValues", handle, uintptr(len(values)), uintptr(unsafe.Pointer(&values[0]))); ret != nvmlSuccess {
+		return 0, ret
+	}
+
+	var total uint64
+	for _, value := range values {
+		if ret := nvmlReturn(value.NvmlReturn); ret != nvmlSuccess {
+			return 0, ret
+		}
+		total += uint64(fieldValueToInt64(value))
+	}
+	return total, nvmlSuccess
 }
 
-// GetDeviceID generates a unique device identifier for MQTT topics
-func GetDeviceID(device GPUDevice) string {
-	return "mock_device_id"
+// fieldValueToInt64 decodes the value of an NVML field according to its value type
+func fieldValueToInt64(value nvmlFieldValue) int64 {
+	ptr := unsafe.Pointer(&value.Value[0])
+	switch value.ValueType {
+	case nvmlValueTypeDouble:
+		return int64(*(*float64)(ptr))
+	case nvmlValueTypeUnsignedInt, nvmlValueTypeUnsignedLong: // unsigned long is 32-bit on Windows
+		return int64(*(*uint32)(ptr))
+	case nvmlValueTypeUnsignedLongLong:
+		return int64(*(*uint64)(ptr))
+	case nvmlValueTypeSignedLongLong:
+		return *(*int64)(ptr)
+	case nvmlValueTypeSignedInt:
+		return int64(*(*int32)(ptr))
+	case nvmlValueTypeUnsignedShort:
+		return int64(*(*uint16)(ptr))
+	default:
+		return 0
+	}
 }
 
-// GetShortPCIBusID formats PCI Bus ID from 00000000:04:00.0 to 00:04:00.0 (Windows stub)
-func GetShortPCIBusID(pciBusID string) string {
-	return pciBusID
+// getGPUMetricsInternal performs the actual NVML calls with mutex protection
+func getGPUMetricsInternal(device GPUDevice) (GPUMetrics, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	metrics := GPUMetrics{Timestamp: time.Now()}
+
+	// A failed read only drops the affected metrics, the others are still published
+	var errs []error
+
+	// Get power draw
+	var power uint32
+	ret := nvmlCall("nvmlDeviceGetPowerUsage", device.Handle, uintptr(unsafe.Pointer(&power)))
+	if ret == nvmlSuccess {
+		metrics.PowerDraw = float64(power) / 1000.0 // Convert mW to W
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get power usage: %s", errorString(ret)))
+		metrics.markFailed("power_draw")
+	}
+
+	// Get performance state
+	var perfState int32
+	metrics.PerformanceState = -1
+	ret = nvmlCall("nvmlDeviceGetPerformanceState", device.Handle, uintptr(unsafe.Pointer(&perfState)))
+	if ret == nvmlSuccess && perfState == nvmlPStateUnknown {
+		// Not one of the P0-P15 options of the enum sensor, so the previous state is kept
+		metrics.markFailed("performance_level", "performance_state_num")
+	} else if ret == nvmlSuccess {
+		metrics.PerformanceLevel = fmt.Sprintf("P%d", perfState)
+		metrics.PerformanceState = int(perfState)
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get performance state: %s", errorString(ret)))
+		metrics.markFailed("performance_level", "performance_state_num")
+	}
+
+	// Get memory usage
+	memInfo, ret := getMemoryInfo(device)
+	if ret == nvmlSuccess {
+		metrics.MemoryUsage = float64(memInfo.Used) / float64(memInfo.Total) * 100.0
+		metrics.MemoryUsed = memInfo.Used
+		metrics.MemoryTotal = memInfo.Total
+		metrics.MemoryReserved = memInfo.Reserved
+	} else if isLost(ret) {
+		return GPUMetrics{}, fmt.Errorf("failed to get memory info: %s: %w", errorString(ret), ErrGPULost)
+	} else {
+		errs = append(errs, fmt.Errorf("failed to get memory info: %s", errorString(ret)))
+		metrics.markFailed("memory_usage", "memory_reserved")
+	}
+
+	// Get BAR1 memory usage
+	if device.HasBAR1 {
+		var bar1Info nvmlBAR1Memory
+		ret := nvmlCall("nvmlDeviceGetBAR1MemoryInfo", device.Handle, uintptr(unsafe.Pointer(&bar1Info)))
+		if ret == nvmlSuccess {
+			metrics.Bar1Used = bar1Info.Bar1Used
+			metrics.Bar1Total = bar1Info.Bar1Total
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get BAR1 memory info: %s", errorString(ret)))
+			metrics.markFailed("bar1_usage")
+		}
+	}
+
+	// Get utilization rates
+	var utilization nvmlUtilization
+	ret = nvmlCall("nvmlDeviceGetUtilizationRates", device.Handle, uintptr(unsafe.Pointer(&utilization)))
+	if ret == nvmlSuccess {
+		metrics.GPUUtilization = int(utilization.Gpu)
+		metrics.MemoryUtilization = int(utilization.Memory)
+		// Without new samples the instantaneous value is kept
+		if sampled, ok := sampledUtilization(device); ok {
+			metrics.GPUUtilization = sampled
+		}
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get utilization rates: %s", errorString(ret)))
+		metrics.markFailed("gpu_utilization", "memory_bandwidth_util")
+	}
+
+	// GPU performance monitoring is read on Linux only, so the memory bandwidth
+	// utilization is always the memory controller utilization
+	metrics.MemoryBandwidthUtil = float64(metrics.MemoryUtilization)
+
+	// Get temperature
+	var temperature uint32
+	ret = nvmlCall("nvmlDeviceGetTemperature", device.Handle, nvmlTemperatureGPU, uintptr(unsafe.Pointer(&temperature)))
+	if ret == nvmlSuccess {
+		metrics.Temperature = int(temperature)
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get temperature: %s", errorString(ret)))
+		metrics.markFailed("temperature")
+	}
+
+	// Get memory temperature
+	if device.HasMemoryTemperature {
+		memoryTemperature, ret := getMemoryTemperature(device.Handle)
+		if ret == nvmlSuccess {
+			metrics.MemoryTemperature = memoryTemperature
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get memory temperature: %s", errorString(ret)))
+			metrics.markFailed("memory_temperature")
+		}
+	}
+
+	// Get clock VF offsets
+	if device.HasClockOffsets {
+		var coreOffset int32
+		ret := nvmlCall("nvmlDeviceGetGpcClkVfOffset", device.Handle, uintptr(unsafe.Pointer(&coreOffset)))
+		if ret == nvmlSuccess {
+			metrics.CoreClockOffset = int(coreOffset)
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get core clock offset: %s", errorString(ret)))
+			metrics.markFailed("clock_offset_core")
+		}
+
+		var memoryOffset int32
+		ret = nvmlCall("nvmlDeviceGetMemClkVfOffset", device.Handle, uintptr(unsafe.Pointer(&memoryOffset)))
+		if ret == nvmlSuccess {
+			metrics.MemoryClockOffset = int(memoryOffset)
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get memory clock offset: %s", errorString(ret)))
+			metrics.markFailed("clock_offset_memory")
+		}
+	}
+
+	// Get current, maximum and applications SM clocks
+	var graphicsClock uint32
+	ret = nvmlCall("nvmlDeviceGetClockInfo", device.Handle, nvmlClockSM, uintptr(unsafe.Pointer(&graphicsClock)))
+	if ret == nvmlSuccess {
+		metrics.GraphicsClock = int(graphicsClock)
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get graphics clock: %s", errorString(ret)))
+		metrics.markFailed("graphics_clock")
+	}
+
+	var maxGraphicsClock uint32
+	ret = nvmlCall("nvmlDeviceGetMaxClockInfo", device.Handle, nvmlClockSM, uintptr(unsafe.Pointer(&maxGraphicsClock)))
+	if ret == nvmlSuccess {
+		metrics.MaxGraphicsClock = int(maxGraphicsClock)
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get max graphics clock: %s", errorString(ret)))
+		metrics.markFailed("max_graphics_clock")
+	}
+
+	var applicationsClock uint32
+	ret = nvmlCall("nvmlDeviceGetApplicationsClock", device.Handle, nvmlClockSM, uintptr(unsafe.Pointer(&applicationsClock)))
+	if ret == nvmlSuccess {
+		metrics.ApplicationsClock = int(applicationsClock)
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get applications clock: %s", errorString(ret)))
+		metrics.markFailed("applications_clock")
+	}
+
+	// Get the video encoder/decoder clock
+	var videoClock uint32
+	ret = nvmlCall("nvmlDeviceGetClockInfo", device.Handle, nvmlClockVideo, uintptr(unsafe.Pointer(&videoClock)))
+	if ret == nvmlSuccess {
+		metrics.VideoClock = int(videoClock)
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get video clock: %s", errorString(ret)))
+		metrics.markFailed("video_clock")
+	}
+
+	// Get current and maximum PCIe link generation and width
+	for _, link := range []struct {
+		key    string
+		name   string
+		symbol string
+		value  *int
+	}{
+		{"pcie_link_gen", "PCIe link generation", "nvmlDeviceGetCurrPcieLinkGeneration", &metrics.PCIeLinkGen},
+		{"max_pcie_link_gen", "max PCIe link generation", "nvmlDeviceGetMaxPcieLinkGeneration", &metrics.MaxPCIeLinkGen},
+		{"pcie_link_width", "PCIe link width", "nvmlDeviceGetCurrPcieLinkWidth", &metrics.PCIeLinkWidth},
+		{"max_pcie_link_width", "max PCIe link width", "nvmlDeviceGetMaxPcieLinkWidth", &metrics.MaxPCIeLinkWidth},
+	} {
+		var value uint32
+		ret = nvmlCall(link.symbol, device.Handle, uintptr(unsafe.Pointer(&value)))
+		if ret == nvmlSuccess {
+			*link.value = int(value)
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get %s: %s", link.name, errorString(ret)))
+			metrics.markFailed(link.key)
+		}
+	}
+
+	// Get NVENC encoder sessions
+	if device.HasEncoderStats {
+		var sessions, averageFPS, averageLatency uint32
+		ret := nvmlCall("nvmlDeviceGetEncoderStats", device.Handle, uintptr(unsafe.Pointer(&sessions)), uintptr(unsafe.Pointer(&averageFPS)), uintptr(unsafe.Pointer(&averageLatency)))
+		if ret == nvmlSuccess {
+			metrics.EncoderSessions = int(sessions)
+			metrics.EncoderFPS = int(averageFPS)
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get encoder stats: %s", errorString(ret)))
+			metrics.markFailed("encoder_sessions", "encoder_fps")
+		}
+	}
+
+	// Get compute and persistence mode
+	if device.HasComputeMode {
+		var computeMode uint32
+		ret := nvmlCall("nvmlDeviceGetComputeMode", device.Handle, uintptr(unsafe.Pointer(&computeMode)))
+		if ret == nvmlSuccess {
+			metrics.ComputeMode = computeModeName(int(computeMode))
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get compute mode: %s", errorString(ret)))
+			metrics.markFailed("compute_mode")
+		}
+	}
+	if device.HasPersistenceMode {
+		var persistenceMode uint32
+		ret := nvmlCall("nvmlDeviceGetPersistenceMode", device.Handle, uintptr(unsafe.Pointer(&persistenceMode)))
+		if ret == nvmlSuccess {
+			metrics.PersistenceMode = persistenceMode == nvmlFeatureEnabled
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get persistence mode: %s", errorString(ret)))
+			metrics.markFailed("persistence_mode")
+		}
+	}
+
+	// Get NVLink throughput, link state and errors
+	if len(device.NvLinks) > 0 {
+		totalKiB, ret := getNvLinkDataKiB(device.Handle)
+		if ret == nvmlSuccess {
+			metrics.NvLinkThroughput = nvlinkThroughput(device.UUID, totalKiB, metrics.Timestamp)
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get NVLink throughput: %s", errorString(ret)))
+			metrics.markFailed("nvlink_throughput")
+		}
+
+		for _, link := range device.NvLinks {
+			var state uint32
+			ret := nvmlCall("nvmlDeviceGetNvLinkState", device.Handle, uintptr(link), uintptr(unsafe.Pointer(&state)))
+			if ret == nvmlSuccess {
+				if state == nvmlFeatureEnabled {
+					metrics.NvLinkActiveLinks++
+				}
+			} else if ret != nvmlErrorNotSupported {
+				errs = append(errs, fmt.Errorf("failed to get NVLink %d state: %s", link, errorString(ret)))
+				metrics.markFailed("nvlink_state")
+			}
+
+			for counter := 0; counter < nvmlNvLinkErrorCounterCount; counter++ {
+				var errors uint64
+				ret := nvmlCall("nvmlDeviceGetNvLinkErrorCounter", device.Handle, uintptr(link), uintptr(counter), uintptr(unsafe.Pointer(&errors)))
+				if ret == nvmlSuccess {
+					metrics.NvLinkErrors += errors
+				} else if ret != nvmlErrorNotSupported {
+					errs = append(errs, fmt.Errorf("failed to get NVLink %d error counter: %s", link, errorString(ret)))
+					metrics.markFailed("nvlink_errors")
+				}
+			}
+		}
+	}
+
+	// Get clock throttle reasons
+	var throttleReasons uint64
+	ret = nvmlCall("nvmlDeviceGetCurrentClocksThrottleReasons", device.Handle, uintptr(unsafe.Pointer(&throttleReasons)))
+	if ret == nvmlSuccess {
+		metrics.ThrottleReasons = throttleReasons
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get clock throttle reasons: %s", errorString(ret)))
+		metrics.markFailed("throttle_reasons", "throttle_thermal", "throttle_power")
+	}
+
+	// Get reliability policy violations
+	if device.HasReliabilityViolations {
+		var violation nvmlViolationTime
+		ret = nvmlCall("nvmlDeviceGetViolationStatus", device.Handle, nvmlPerfPolicyReliability, uintptr(unsafe.Pointer(&violation)))
+		if ret == nvmlSuccess {
+			metrics.ReliabilityThrottled = reliabilityThrottled(device.UUID, violation.ViolationTime)
+		} else if ret != nvmlErrorNotSupported {
+			errs = append(errs, fmt.Errorf("failed to get reliability violations: %s", errorString(ret)))
+			metrics.markFailed("throttle_reliability")
+		}
+	}
+
+	// Get total energy consumption
+	var energy uint64
+	ret = nvmlCall("nvmlDeviceGetTotalEnergyConsumption", device.Handle, uintptr(unsafe.Pointer(&energy)))
+	if ret == nvmlSuccess {
+		metrics.TotalEnergyJoules = float64(energy) / 1000.0 // Convert mJ to J
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get total energy consumption: %s", errorString(ret)))
+		metrics.markFailed("energy_consumption")
+	}
+
+	return metrics, metricsError(metrics, errs)
 }
 
-// GetDeviceDisplayName generates a display name in the format: {HOSTNAME} {PCI ID} - NVIDIA {MODEL} {VRAM}
-func GetDeviceDisplayName(device GPUDevice, hostname string) string {
-	return fmt.Sprintf("%s 00:01:00.0 - NVIDIA Mock GPU 0GB", hostname)
+// getQuickMetricsInternal reads the metrics returned by GetQuickMetrics with mutex protection
+func getQuickMetricsInternal(device GPUDevice) (GPUMetrics, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	metrics := GPUMetrics{Timestamp: time.Now()}
+	var errs []error
+
+	var utilization nvmlUtilization
+	ret := nvmlCall("nvmlDeviceGetUtilizationRates", device.Handle, uintptr(unsafe.Pointer(&utilization)))
+	if ret == nvmlSuccess {
+		metrics.GPUUtilization = int(utilization.Gpu)
+	} else if isLost(ret) {
+		return GPUMetrics{}, fmt.Errorf("failed to get utilization rates: %s: %w", errorString(ret), ErrGPULost)
+	} else {
+		errs = append(errs, fmt.Errorf("failed to get utilization rates: %s", errorString(ret)))
+		metrics.markFailed("gpu_utilization")
+	}
+
+	var temperature uint32
+	ret = nvmlCall("nvmlDeviceGetTemperature", device.Handle, nvmlTemperatureGPU, uintptr(unsafe.Pointer(&temperature)))
+	if ret == nvmlSuccess {
+		metrics.Temperature = int(temperature)
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get temperature: %s", errorString(ret)))
+		metrics.markFailed("temperature")
+	}
+
+	var power uint32
+	ret = nvmlCall("nvmlDeviceGetPowerUsage", device.Handle, uintptr(unsafe.Pointer(&power)))
+	if ret == nvmlSuccess {
+		metrics.PowerDraw = float64(power) / 1000.0 // Convert mW to W
+	} else if ret != nvmlErrorNotSupported {
+		errs = append(errs, fmt.Errorf("failed to get power usage: %s", errorString(ret)))
+		metrics.markFailed("power_draw")
+	}
+
+	return metrics, metricsError(metrics, errs)
 }
 
-// GetNVMLVersion returns the NVML version information (Windows stub)
+// GetNVMLVersion returns the NVML version information
 func GetNVMLVersion() (string, error) {
-	return "", errors.New("NVML is not supported on Windows build. Please use Linux build for production")
+	requestMutex.RLock()
+	defer requestMutex.RUnlock()
+
+	version, ret := getSystemString("nvmlSystemGetNVMLVersion")
+	if ret != nvmlSuccess {
+		return "", fmt.Errorf("failed to get NVML version: %s", errorString(ret))
+	}
+	return version, nil
 }
 
-// GetDriverVersion returns the NVIDIA driver version (Windows stub)
+// GetDriverVersion returns the NVIDIA driver version
 func GetDriverVersion() (string, error) {
-	return "", errors.New("NVML is not supported on Windows build. Please use Linux build for production")
+	requestMutex.RLock()
+	defer requestMutex.RUnlock()
+
+	version, ret := getSystemString("nvmlSystemGetDriverVersion")
+	if ret != nvmlSuccess {
+		return "", fmt.Errorf("failed to get driver version: %s", errorString(ret))
+	}
+	return version, nil
 }
 
-// IsDeviceAvailable checks if a GPU device is still available and responsive (Windows stub)
+// GetP2PStatus returns the peer-to-peer link type from device to peer: P2PLinkNVLink,
+// P2PLinkPCIe or P2PLinkNone
+func GetP2PStatus(device, peer GPUDevice) (string, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+	return p2pLink(device, peer)
+}
+
+// p2pLink reads the peer-to-peer link type from device to peer, preferring NVLink
+func p2pLink(device, peer GPUDevice) (string, error) {
+	var status uint32
+	ret := nvmlCall("nvmlDeviceGetP2PStatus", device.Handle, peer.Handle, nvmlP2PCapsIndexNVLink, uintptr(unsafe.Pointer(&status)))
+	if ret == nvmlSuccess && status == nvmlP2PStatusOK {
+		return P2PLinkNVLink, nil
+	}
+
+	ret = nvmlCall("nvmlDeviceGetP2PStatus", device.Handle, peer.Handle, nvmlP2PCapsIndexRead, uintptr(unsafe.Pointer(&status)))
+	if ret != nvmlSuccess {
+		return "", fmt.Errorf("failed to get P2P status to GPU %d: %s", peer.Index, errorString(ret))
+	}
+	if status == nvmlP2PStatusOK {
+		return P2PLinkPCIe, nil
+	}
+	return P2PLinkNone, nil
+}
+
+// ClearEccErrors resets the volatile ECC error counters of a GPU device
+func ClearEccErrors(device GPUDevice) error {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	ret := nvmlCall("nvmlDeviceClearEccErrorCounts", device.Handle, nvmlVolatileECC)
+	if ret == nvmlErrorNoPermission {
+		return fmt.Errorf("no permission to clear ECC error counts for device %s (administrator required)", device.Name)
+	} else if ret != nvmlSuccess {
+		return fmt.Errorf("failed to clear ECC error counts: %s", errorString(ret))
+	}
+	return nil
+}
+
+// GetFanSpeed returns the current speed of a fan in percent
+func GetFanSpeed(device GPUDevice, fan int) (int, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	var speed uint32
+	ret := nvmlCall("nvmlDeviceGetFanSpeed_v2", device.Handle, uintptr(fan), uintptr(unsafe.Pointer(&speed)))
+	if ret == nvmlErrorNotSupported {
+		return 0, fmt.Errorf("fan %d speed: %w", fan, ErrNotSupported)
+	} else if ret != nvmlSuccess {
+		return 0, fmt.Errorf("failed to get fan %d speed: %s", fan, errorString(ret))
+	}
+	return int(speed), nil
+}
+
+// SetFanSpeed switches a fan to manual control at the given speed in percent
+func SetFanSpeed(device GPUDevice, fan int, percent int) error {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	ret := nvmlCall("nvmlDeviceSetFanSpeed_v2", device.Handle, uintptr(fan), uintptr(percent))
+	if ret == nvmlErrorNoPermission {
+		return fmt.Errorf("setting fan %d speed for device %s (administrator required): %w", fan, device.Name, ErrNoPermission)
+	} else if ret == nvmlErrorNotSupported {
+		return fmt.Errorf("manual fan control for device %s: %w", device.Name, ErrNotSupported)
+	} else if ret != nvmlSuccess {
+		return fmt.Errorf("failed to set fan %d speed: %s", fan, errorString(ret))
+	}
+	return nil
+}
+
+// SetDefaultFanSpeed restores the automatic fan control policy of a fan
+func SetDefaultFanSpeed(device GPUDevice, fan int) error {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	ret := nvmlCall("nvmlDeviceSetDefaultFanSpeed_v2", device.Handle, uintptr(fan))
+	if ret == nvmlErrorNoPermission {
+		return fmt.Errorf("restoring fan %d policy for device %s (administrator required): %w", fan, device.Name, ErrNoPermission)
+	} else if ret == nvmlErrorNotSupported {
+		return fmt.Errorf("fan control for device %s: %w", device.Name, ErrNotSupported)
+	} else if ret != nvmlSuccess {
+		return fmt.Errorf("failed to restore default fan %d speed: %s", fan, errorString(ret))
+	}
+	return nil
+}
+
+// sampledUtilization reads the GPU utilization of device since the previous read from the
+// configured utilization source. It returns false for the instant source or without new samples.
+func sampledUtilization(device GPUDevice) (int, bool) {
+	last := lastUtilizationTimestamp(device.UUID)
+
+	switch utilizationSource {
+	case UtilizationSourceSamples:
+		var valueType, count uint32
+		ret := nvmlCall("nvmlDeviceGetSamples", device.Handle, nvmlGPUUtilizationSamples, uintptr(last),
+			uintptr(unsafe.Pointer(&valueType)), uintptr(unsafe.Pointer(&count)), 0)
+		if ret != nvmlSuccess || count == 0 {
+			return 0, false
+		}
+		samples := make([]nvmlSample, count)
+		ret = nvmlCall("nvmlDeviceGetSamples", device.Handle, nvmlGPUUtilizationSamples, uintptr(last),
+			uintptr(unsafe.Pointer(&valueType)), uintptr(unsafe.Pointer(&count)), uintptr(unsafe.Pointer(&samples[0])))
+		if ret != nvmlSuccess || valueType != nvmlValueTypeUnsignedInt {
+			return 0, false
+		}
+		values := make([]utilizationSample, 0, count)
+		for _, sample := range samples[:count] {
+			values = append(values, utilizationSample{timestamp: sample.TimeStamp, value: *(*uint32)(unsafe.Pointer(&sample.SampleValue[0]))})
+		}
+		return averageUtilization(device.UUID, last, values)
+
+	case UtilizationSourceProcess:
+		var count uint32
+		ret := nvmlCall("nvmlDeviceGetProcessUtilization", device.Handle, 0, uintptr(unsafe.Pointer(&count)), uintptr(last))
+		if ret == nvmlErrorNotFound || (ret == nvmlErrorInsufficientSize && count == 0) {
+			// No process used the GPU since the previous read
+			return 0, true
+		} else if ret != nvmlErrorInsufficientSize {
+			return 0, false
+		}
+		samples := make([]nvmlProcessUtilizationSample, count)
+		ret = nvmlCall("nvmlDeviceGetProcessUtilization", device.Handle, uintptr(unsafe.Pointer(&samples[0])), uintptr(unsafe.Pointer(&count)), uintptr(last))
+		if ret != nvmlSuccess {
+			return 0, false
+		}
+		values := make([]utilizationSample, 0, count)
+		for _, sample := range samples[:count] {
+			values = append(values, utilizationSample{timestamp: sample.TimeStamp, value: sample.SmUtil})
+		}
+		return processUtilization(device.UUID, values), true
+	}
+	return 0, false
+}
+
+// getUnsupported probes the metrics read for every card once and returns the sensors
+// whose metric the device with handle does not support. Functions missing from an
+// older nvml.dll count as not supported as well.
+func getUnsupported(handle uintptr) map[string]bool {
+	unsupported := make(map[string]bool)
+	probe := func(ret nvmlReturn, keys ...string) {
+		if ret == nvmlErrorNotSupported || ret == nvmlErrorFunctionNotFound {
+			for _, key := range keys {
+				unsupported[key] = true
+			}
+		}
+	}
+
+	var value uint32
+	var utilization nvmlUtilization
+	var energy uint64
+	probe(nvmlCall("nvmlDeviceGetPowerUsage", handle, uintptr(unsafe.Pointer(&value))), "power_draw")
+	probe(nvmlCall("nvmlDeviceGetPerformanceState", handle, uintptr(unsafe.Pointer(&value))), "performance_level", "performance_state_num")
+	probe(nvmlCall("nvmlDeviceGetUtilizationRates", handle, uintptr(unsafe.Pointer(&utilization))), "gpu_utilization", "busy", "memory_bandwidth_util")
+	probe(nvmlCall("nvmlDeviceGetTemperature", handle, nvmlTemperatureGPU, uintptr(unsafe.Pointer(&value))), "temperature")
+	probe(nvmlCall("nvmlDeviceGetClockInfo", handle, nvmlClockSM, uintptr(unsafe.Pointer(&value))), "graphics_clock")
+	probe(nvmlCall("nvmlDeviceGetMaxClockInfo", handle, nvmlClockSM, uintptr(unsafe.Pointer(&value))), "max_graphics_clock")
+	probe(nvmlCall("nvmlDeviceGetApplicationsClock", handle, nvmlClockSM, uintptr(unsafe.Pointer(&value))), "applications_clock")
+	probe(nvmlCall("nvmlDeviceGetTotalEnergyConsumption", handle, uintptr(unsafe.Pointer(&energy))), "energy_consumption")
+	probe(nvmlCall("nvmlDeviceGetClockInfo", handle, nvmlClockVideo, uintptr(unsafe.Pointer(&value))), "video_clock")
+	probe(nvmlCall("nvmlDeviceGetCurrPcieLinkGeneration", handle, uintptr(unsafe.Pointer(&value))), "pcie_link_gen")
+	probe(nvmlCall("nvmlDeviceGetMaxPcieLinkGeneration", handle, uintptr(unsafe.Pointer(&value))), "max_pcie_link_gen")
+	probe(nvmlCall("nvmlDeviceGetCurrPcieLinkWidth", handle, uintptr(unsafe.Pointer(&value))), "pcie_link_width")
+	probe(nvmlCall("nvmlDeviceGetMaxPcieLinkWidth", handle, uintptr(unsafe.Pointer(&value))), "max_pcie_link_width")
+
+	return unsupported
+}
+
+// getDiagnostics reads the serial number and VBIOS version of the device with handle,
+// leaving out the ones the board does not report
+func getDiagnostics(handle uintptr) GPUDiagnostics {
+	var diagnostics GPUDiagnostics
+	if serial, ret := getDeviceString("nvmlDeviceGetSerial", handle); ret == nvmlSuccess {
+		diagnostics.Serial = serial
+	}
+	if version, ret := getDeviceString("nvmlDeviceGetVbiosVersion", handle); ret == nvmlSuccess {
+		diagnostics.VBIOSVersion = version
+	}
+	var mode uint32
+	if nvmlCall("nvmlDeviceGetVirtualizationMode", handle, uintptr(unsafe.Pointer(&mode))) == nvmlSuccess {
+		diagnostics.VirtualizationMode = virtualizationModeName(int(mode))
+	}
+	// NUMA nodes are left out, nvmlDeviceGetMemoryAffinity is only available on Linux
+	return diagnostics
+}
+
+// getMemoryInfo reads the memory info of device with the reserved VRAM if the driver supports
+// the v2 call, otherwise with the v1 call (Reserved is 0 and Used includes it)
+func getMemoryInfo(device GPUDevice) (nvmlMemoryV2, nvmlReturn) {
+	if device.HasMemoryInfoV2 {
+		memInfo := nvmlMemoryV2{Version: nvmlMemoryV2Version}
+		ret := nvmlCall("nvmlDeviceGetMemoryInfo_v2", device.Handle, uintptr(unsafe.Pointer(&memInfo)))
+		return memInfo, ret
+	}
+	var memInfo nvmlMemory
+	ret := nvmlCall("nvmlDeviceGetMemoryInfo", device.Handle, uintptr(unsafe.Pointer(&memInfo)))
+	return nvmlMemoryV2{Total: memInfo.Total, Free: memInfo.Free, Used: memInfo.Used}, ret
+}
+
+// isLost reports whether ret means the GPU is no longer usable until it is reset
+func isLost(ret nvmlReturn) bool {
+	return ret == nvmlErrorGPUIsLost || ret == nvmlErrorUnknown
+}
+
+// reacquireHandle replaces the handle of device by a fresh one looked up by PCI bus ID
+func reacquireHandle(device GPUDevice) (GPUDevice, error) {
+	unlock := lockDevice(device)
+	defer unlock()
+
+	busID := append([]byte(device.PCIBusID), 0)
+	var handle uintptr
+	ret := nvmlCall("nvmlDeviceGetHandleByPciBusId_v2", uintptr(unsafe.Pointer(&busID[0])), uintptr(unsafe.Pointer(&handle)))
+	if ret != nvmlSuccess {
+		return device, fmt.Errorf("failed to get device handle for %s: %s", device.PCIBusID, errorString(ret))
+	}
+
+	// A GPU that is still lost hands out a handle that cannot be read
+	uuid, ret := getDeviceString("nvmlDeviceGetUUID", handle)
+	if ret != nvmlSuccess {
+		return device, fmt.Errorf("failed to get device UUID: %s", errorString(ret))
+	}
+	if uuid != device.UUID {
+		log.Printf("Warning: GPU at %s changed its UUID from %s to %s, keeping the old one for its entities", device.PCIBusID, device.UUID, uuid)
+	}
+
+	device.Handle = handle
+	return device, nil
+}
+
+// IsDeviceAvailable checks if a GPU device is still available and responsive
 func IsDeviceAvailable(device GPUDevice) bool {
-	return false
+	unlock := lockDevice(device)
+	defer unlock()
+
+	// Try to get device name as a simple health check
+	_, ret := getDeviceString("nvmlDeviceGetName", device.Handle)
+	return ret == nvmlSuccess
 }
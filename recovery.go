@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+var (
+	unavailableMutex sync.Mutex
+	unavailableGPUs  = make(map[string]bool) // device IDs of GPUs marked unavailable after repeated failures
+)
+
+// readGPUMetrics reads the metrics of gpu. The handle of a lost GPU is re-acquired,
+// which replaces *gpu once the GPU is back.
+func readGPUMetrics(gpu *nvidia.GPUDevice) (nvidia.GPUMetrics, error) {
+	timeout := time.Duration(cfg().NVMLTimeout) * time.Second
+
+	metrics, err := nvidia.GetGPUMetrics(*gpu, timeout)
+	if errors.Is(err, nvidia.ErrGPULost) {
+		// The handle may change when the GPU is reset, so a fresh one is looked up
+		recovered, reacquireErr := nvidia.ReacquireDevice(*gpu, timeout)
+		if reacquireErr != nil {
+			log.Printf("GPU %s (%s) is still lost: %v", gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID), reacquireErr)
+			return metrics, err
+		}
+		log.Printf("Re-acquired GPU %s (%s), reading its metrics again", gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID))
+		*gpu = recovered
+		if haManager := haManagerRef.Load(); haManager != nil {
+			haManager.UpdateDevice(recovered)
+		}
+		metrics, err = nvidia.GetGPUMetrics(*gpu, timeout)
+	}
+	return metrics, err
+}
+
+// updateGPUAvailability marks gpu unavailable in Home Assistant once it failed
+// unavailable_after_failures consecutive cycles and available again after a successful
+// cycle, publishing its availability when that changes. A single failed read does not
+// flip the entities to unavailable.
+func updateGPUAvailability(gpu nvidia.GPUDevice, failures int) {
+	deviceID := nvidia.GetDeviceID(gpu)
+	unavailable := failures >= cfg().UnavailableAfterFailures
+
+	unavailableMutex.Lock()
+	changed := unavailableGPUs[deviceID] != unavailable
+	if unavailable {
+		unavailableGPUs[deviceID] = true
+	} else {
+		delete(unavailableGPUs, deviceID)
+	}
+	unavailableMutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if unavailable {
+		log.Printf("GPU %s (%s) failed %d consecutive cycle(s), marking it unavailable until it recovers",
+			gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID), failures)
+	} else {
+		log.Printf("GPU %s (%s) recovered, marking it available", gpu.Name, nvidia.GetShortPCIBusID(gpu.PCIBusID))
+	}
+
+	if haManager := haManagerRef.Load(); haManager != nil {
+		if err := haManager.PublishGPUAvailability(gpu, !unavailable); err != nil {
+			log.Printf("Failed to publish availability of GPU %s: %v", gpu.Name, err)
+		}
+	}
+	if restPublisher != nil {
+		if err := restPublisher.PublishGPUAvailability(gpu, !unavailable); err != nil {
+			log.Printf("Failed to publish availability of GPU %s: %v", gpu.Name, err)
+		}
+	}
+}
+
+// refreshAvailability publishes the availability of the service and of every GPU again.
+// Without availability_retain Home Assistant loses it on restart, so every cycle refreshes it.
+func refreshAvailability(gpus []nvidia.GPUDevice) {
+	haManager := haManagerRef.Load()
+	if haManager == nil {
+		return
+	}
+
+	if err := haManager.PublishAvailability(true); err != nil {
+		log.Printf("Failed to publish availability: %v", err)
+	}
+	for _, gpu := range gpus {
+		if err := haManager.PublishGPUAvailability(gpu, !isGPUUnavailable(gpu)); err != nil {
+			log.Printf("Failed to publish availability of GPU %s: %v", gpu.Name, err)
+		}
+	}
+}
+
+// isGPUUnavailable reports whether gpu is currently marked unavailable
+func isGPUUnavailable(gpu nvidia.GPUDevice) bool {
+	unavailableMutex.Lock()
+	defer unavailableMutex.Unlock()
+	return unavailableGPUs[nvidia.GetDeviceID(gpu)]
+}
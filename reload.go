@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/homeassistant"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+	"github.com/spf13/cobra"
+)
+
+// liveReloadKeys are the config keys applied on SIGHUP without a restart
+var liveReloadKeys = map[string]bool{
+	"polling_period":       true,
+	"mqtt_retain":          true,
+	"mqtt_lwt_enable":      true,
+	"nvml_timeout_seconds": true,
+	"busy_threshold":       true,
+	"busy_off_threshold":   true,
+	"max_concurrent_polls": true,
+
+	"mqtt_publish_timeout_seconds": true,
+	"discovery_retain":             true,
+	"unavailable_after_failures":   true,
+	"state_retain":                 true,
+	"availability_retain":          true,
+	"discovery_qos":                true,
+	"state_qos":                    true,
+}
+
+// reloadConfig reloads the configuration and applies the settings that can change
+// while running. Other changes are logged as requiring a restart.
+func reloadConfig(cmd *cobra.Command, ticker *time.Ticker, haManager *homeassistant.Manager, gpus []nvidia.GPUDevice) {
+	log.Println("Received SIGHUP, reloading configuration...")
+
+	newCfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		log.Printf("Failed to reload configuration, keeping the current one: %v", err)
+		return
+	}
+	resolveHostname(newCfg)
+
+	current := cfg()
+	oldValue := reflect.ValueOf(current).Elem()
+	newValue := reflect.ValueOf(newCfg).Elem()
+	t := oldValue.Type()
+
+	changed := 0
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if key == "" || reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		changed++
+
+		if !liveReloadKeys[key] {
+			log.Printf("Config %s changed, requires restart to take effect", key)
+			continue
+		}
+		log.Printf("Config %s changed: %v -> %v", key, oldValue.Field(i).Interface(), newValue.Field(i).Interface())
+	}
+
+	if changed == 0 {
+		log.Println("Configuration reloaded, no changes")
+		return
+	}
+
+	lwtChanged := current.MQTTLWTEnable != newCfg.MQTTLWTEnable
+	availabilityRetainChanged := current.RetainAvailability() != newCfg.RetainAvailability()
+
+	// The watchdog, the MQTT handlers and pending publishes read the configuration on
+	// other goroutines, so the live settings are applied to a copy that replaces it as a whole
+	live := *current
+	live.PollingPeriod = newCfg.PollingPeriod
+	live.MQTTRetain = newCfg.MQTTRetain
+	live.DiscoveryRetain = newCfg.DiscoveryRetain
+	live.StateRetain = newCfg.StateRetain
+	live.AvailabilityRetain = newCfg.AvailabilityRetain
+	live.DiscoveryQoS = newCfg.DiscoveryQoS
+	live.StateQoS = newCfg.StateQoS
+	live.MQTTLWTEnable = newCfg.MQTTLWTEnable
+	live.NVMLTimeout = newCfg.NVMLTimeout
+	live.BusyThreshold = newCfg.BusyThreshold
+	live.BusyOffThreshold = newCfg.BusyOffThreshold
+	live.MaxConcurrentPolls = newCfg.MaxConcurrentPolls
+	live.UnavailableAfterFailures = newCfg.UnavailableAfterFailures
+	live.MQTTPublishTimeout = newCfg.MQTTPublishTimeout
+
+	configRef.Store(&live)
+	if haManager != nil {
+		haManager.SetConfig(&live)
+	}
+	if restPublisher != nil {
+		restPublisher.SetConfig(&live)
+	}
+	if current.PollingPeriod != live.PollingPeriod {
+		ticker.Reset(time.Duration(live.PollingPeriod) * time.Second)
+	}
+
+	// Discovery configs carry the availability topic, so they are republished
+	if lwtChanged && haManager != nil {
+		log.Println("Republishing discovery configs for the availability change (the Last Will itself is updated on restart)")
+		registerDiscovery(haManager, gpus)
+		if err := haManager.PublishAvailability(true); err != nil {
+			log.Printf("Failed to publish availability: %v", err)
+		}
+	} else if availabilityRetainChanged {
+		log.Println("Republishing availability for the retain change (the Last Will itself is updated on restart)")
+		refreshAvailability(gpus)
+	}
+
+	log.Println("Configuration reloaded")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+// serviceMetrics holds internal counters about the monitor itself.
+// Atomics are used so scrapes never block on a running monitoring cycle.
+type serviceMetrics struct {
+	cyclesTotal          atomic.Uint64
+	skippedCyclesTotal   atomic.Uint64
+	publishFailuresTotal atomic.Uint64
+	nvmlErrorsTotal      atomic.Uint64
+	unchangedTotal       atomic.Uint64
+	lastCycleDuration    atomic.Int64 // nanoseconds
+}
+
+var stats serviceMetrics
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (s *serviceMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "nvml_gpu_ha_cycles_total", "counter", "Completed GPU monitoring cycles.", float64(s.cyclesTotal.Load()))
+	writeMetric(w, "nvml_gpu_ha_skipped_cycles_total", "counter", "Monitoring cycles skipped because the previous one was still running or too recent.", float64(s.skippedCyclesTotal.Load()))
+	writeMetric(w, "nvml_gpu_ha_publish_failures_total", "counter", "Failed MQTT state publishes.", float64(s.publishFailuresTotal.Load()))
+	writeMetric(w, "nvml_gpu_ha_nvml_errors_total", "counter", "Failed NVML metric reads.", float64(s.nvmlErrorsTotal.Load()))
+	writeMetric(w, "nvml_gpu_ha_unchanged_skipped_total", "counter", "State publishes skipped because the value did not change (publish_on_change).", float64(s.unchangedTotal.Load()))
+	writeMetric(w, "nvml_gpu_ha_last_cycle_duration_seconds", "gauge", "Duration of the last completed monitoring cycle.", time.Duration(s.lastCycleDuration.Load()).Seconds())
+	writeMetric(w, "nvml_gpu_ha_hung_requests", "gauge", "GPUs with a timed-out NVML request that has not returned yet.", float64(nvidia.HungRequests()))
+}
+
+func writeMetric(w http.ResponseWriter, name, metricType, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, metricType, name, value)
+}
+
+// startMetricsServer serves the service metrics on /metrics in the background
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &stats)
+
+	go func() {
+		log.Printf("Serving service metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
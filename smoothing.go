@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+// sampleWindow is a fixed-size ring buffer of recent samples
+type sampleWindow struct {
+	samples []float64
+	next    int
+	full    bool
+}
+
+func newSampleWindow(size int) *sampleWindow {
+	return &sampleWindow{samples: make([]float64, size)}
+}
+
+// add records a sample and returns the average of the samples in the window
+func (w *sampleWindow) add(value float64) float64 {
+	w.samples[w.next] = value
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+
+	count := w.next
+	if w.full {
+		count = len(w.samples)
+	}
+
+	sum := 0.0
+	for _, sample := range w.samples[:count] {
+		sum += sample
+	}
+	return sum / float64(count)
+}
+
+// metricsSmoother averages utilization (and optionally temperature) over the last N samples per GPU
+type metricsSmoother struct {
+	mutex       sync.Mutex
+	size        int
+	temperature bool
+	windows     map[string]*sampleWindow
+}
+
+func newMetricsSmoother(size int, temperature bool) *metricsSmoother {
+	return &metricsSmoother{
+		size:        size,
+		temperature: temperature,
+		windows:     make(map[string]*sampleWindow),
+	}
+}
+
+// smooth replaces the instantaneous values in metrics with their moving averages
+func (s *metricsSmoother) smooth(gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) nvidia.GPUMetrics {
+	if s.size <= 1 {
+		return metrics
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deviceID := nvidia.GetDeviceID(gpu)
+	// Failed reads are not samples, they would drag the average towards zero
+	if !metrics.Failed["gpu_utilization"] {
+		metrics.GPUUtilization = int(math.Round(s.window(deviceID + "_gpu_utilization").add(float64(metrics.GPUUtilization))))
+	}
+	if s.temperature && !metrics.Failed["temperature"] {
+		metrics.Temperature = int(math.Round(s.window(deviceID + "_temperature").add(float64(metrics.Temperature))))
+	}
+
+	return metrics
+}
+
+// window returns the sample window for key, creating it on first use
+func (s *metricsSmoother) window(key string) *sampleWindow {
+	window, ok := s.windows[key]
+	if !ok {
+		window = newSampleWindow(s.size)
+		s.windows[key] = window
+	}
+	return window
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+// testMQTTTimeout bounds every step of the connectivity test
+const testMQTTTimeout = 10 * time.Second
+
+var testMQTTCmd = &cobra.Command{
+	Use:   "test-mqtt",
+	Short: "Test the connection to the MQTT broker and exit",
+	Long: "Connect to the configured MQTT broker with the configured credentials, publish a test message " +
+		"and read it back with a subscription. Exits with a non-zero code if any step fails.",
+	Run: runTestMQTT,
+}
+
+func init() {
+	testMQTTCmd.Flags().String("topic", "homeassistant/sensor/nvml-gpu-ha/test", "Topic prefix for the test message (the client ID is appended)")
+	rootCmd.AddCommand(testMQTTCmd)
+}
+
+func runTestMQTT(cmd *cobra.Command, args []string) {
+	testCfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	resolveHostname(testCfg)
+
+	// Always use a random suffix, a fixed client ID would disconnect a running service
+	clientID := mqttClientID(testCfg.MQTTClientID, true)
+	username := testCfg.Username()
+	if username == "" {
+		username = "(none)"
+	}
+	fmt.Printf("Broker(s): %s\n", strings.Join(testCfg.MQTTBrokers(), ", "))
+	fmt.Printf("Username:  %s\n", username)
+	fmt.Printf("Client ID: %s\n", clientID)
+
+	opts := mqttClientOptions(testCfg, clientID)
+	opts.SetConnectTimeout(testMQTTTimeout)
+
+	// The test message is read back through the default handler of the subscription
+	received := make(chan []byte, 1)
+	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		select {
+		case received <- msg.Payload():
+		default:
+		}
+	})
+
+	client := mqtt.NewClient(opts)
+	if !testMQTTStep("Connecting", client.Connect()) {
+		exitCode = 1
+		return
+	}
+	defer client.Disconnect(250)
+	fmt.Printf("Connected using %s\n", mqttProtocolName(client))
+
+	prefix, _ := cmd.Flags().GetString("topic")
+	topic := strings.TrimSuffix(prefix, "/") + "/" + clientID
+	payload := fmt.Sprintf("nvml-gpu-ha test %s", time.Now().Format(time.RFC3339Nano))
+
+	if !testMQTTStep("Subscribing to "+topic, client.Subscribe(topic, 1, nil)) {
+		exitCode = 1
+		return
+	}
+	// Not retained, so the test leaves nothing behind on the broker
+	if !testMQTTStep("Publishing to "+topic, client.Publish(topic, 1, false, payload)) {
+		exitCode = 1
+		return
+	}
+
+	fmt.Print("Reading back the test message... ")
+	select {
+	case message := <-received:
+		if string(message) != payload {
+			fmt.Printf("FAILED: received %q, expected %q\n", message, payload)
+			exitCode = 1
+			return
+		}
+		fmt.Println("OK")
+	case <-time.After(testMQTTTimeout):
+		fmt.Printf("FAILED: no message within %v (check the ACLs of the user for reading %s)\n", testMQTTTimeout, topic)
+		exitCode = 1
+		return
+	}
+
+	fmt.Println("MQTT connectivity test passed")
+}
+
+// testMQTTStep waits for token and prints the outcome of the step, returning whether it succeeded
+func testMQTTStep(step string, token mqtt.Token) bool {
+	fmt.Printf("%s... ", step)
+	if !token.WaitTimeout(testMQTTTimeout) {
+		fmt.Printf("FAILED: timeout after %v\n", testMQTTTimeout)
+		return false
+	}
+	if err := token.Error(); err != nil {
+		fmt.Printf("FAILED: %v\n", err)
+		return false
+	}
+
+	// A broker denying a subscription answers with the failure return code 0x80
+	if subscribe, ok := token.(*mqtt.SubscribeToken); ok {
+		for topic, code := range subscribe.Result() {
+			if code == 0x80 {
+				fmt.Printf("FAILED: subscription to %s refused by the broker\n", topic)
+				return false
+			}
+		}
+	}
+	fmt.Println("OK")
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/config"
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+	"github.com/spf13/cobra"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Show the metrics of all GPUs in a refreshing table",
+	Long: "Enumerate NVIDIA GPUs and read their metrics every polling period without connecting to MQTT, " +
+		"redrawing a table of temperature, utilization, memory, power and clocks until interrupted with Ctrl+C, " +
+		"e.g. to check the readings before setting up Home Assistant.",
+	Run: runWatch,
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+}
+
+// clearScreen moves the cursor home and clears the terminal (ANSI escape sequences)
+const clearScreen = "\033[H\033[2J"
+
+func runWatch(cmd *cobra.Command, args []string) {
+	watchCfg, err := config.LoadConfig(cmd)
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	resolveHostname(watchCfg)
+	nvidia.SetDeviceIDStrategy(watchCfg.DeviceIDStrategy)
+	nvidia.SetUtilizationSource(watchCfg.UtilizationSource)
+
+	if err := nvidia.Init(); err != nil {
+		log.Fatal("Failed to initialize NVIDIA management library:", err)
+	}
+	defer nvidia.Shutdown()
+
+	gpus, err := nvidia.GetGPUDevices()
+	if err != nil {
+		log.Fatal("Failed to get GPU devices:", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(time.Duration(watchCfg.PollingPeriod) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		fmt.Print(clearScreen + renderWatch(watchCfg, gpus))
+
+		select {
+		case <-sigChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renderWatch reads the metrics of all GPUs and renders them as an aligned table.
+// Metrics that could not be read are shown as "-".
+func renderWatch(watchCfg *config.Config, gpus []nvidia.GPUDevice) string {
+	timeout := time.Duration(watchCfg.NVMLTimeout) * time.Second
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s  %s  every %ds, Ctrl+C to exit\n\n",
+		watchCfg.Hostname, time.Now().Format("2006-01-02 15:04:05"), watchCfg.PollingPeriod)
+
+	w := tabwriter.NewWriter(&out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tNAME\tTEMP\tUTIL\tVRAM\tVRAM USED\tPOWER\tSM CLOCK\tVIDEO CLOCK\tPSTATE")
+	for _, gpu := range gpus {
+		// A partial read still shows every metric that could be read
+		metrics, err := nvidia.GetGPUMetrics(gpu, timeout)
+		var partial *nvidia.PartialMetricsError
+		if err != nil && !errors.As(err, &partial) {
+			fmt.Fprintf(w, "%d\t%s\terror: %v\n", gpu.Index, gpu.Name, err)
+			continue
+		}
+
+		field := func(key, format string, value interface{}) string {
+			if metrics.Failed[key] || !gpu.Supports(key) {
+				return "-"
+			}
+			return fmt.Sprintf(format, value)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			gpu.Index,
+			gpu.Name,
+			field("temperature", "%.0f"+watchCfg.TemperatureUnitSymbol(), watchCfg.ConvertTemperature(metrics.Temperature)),
+			field("gpu_utilization", "%d%%", metrics.GPUUtilization),
+			field("memory_usage", "%.0f%%", metrics.MemoryUsage),
+			field("memory_usage", "%.1fGB", float64(metrics.MemoryUsed)/(1024*1024*1024)),
+			field("power_draw", "%.1fW", metrics.PowerDraw),
+			field("graphics_clock", "%dMHz", metrics.GraphicsClock),
+			field("video_clock", "%dMHz", metrics.VideoClock),
+			field("performance_level", "%s", metrics.PerformanceLevel))
+	}
+	w.Flush()
+	return out.String()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// lastCycleEnd is when the last monitoring cycle finished, in Unix nanoseconds. It is kept
+// outside monitoringMutex, which a stalled cycle holds forever.
+var lastCycleEnd atomic.Int64
+
+// startWatchdog exits the process with a non-zero code once no monitoring cycle finished
+// for watchdog_periods polling periods, so that systemd or Docker restarts the service.
+// A stalled cycle blocks the main loop, so starting another cycle could not help.
+func startWatchdog() {
+	lastCycleEnd.Store(time.Now().UnixNano())
+
+	go func() {
+		for {
+			period := time.Duration(cfg().PollingPeriod) * time.Second
+			time.Sleep(period)
+
+			threshold := time.Duration(cfg().WatchdogPeriods) * period
+			stalled := time.Since(time.Unix(0, lastCycleEnd.Load()))
+			if stalled < threshold {
+				continue
+			}
+
+			log.Printf("WATCHDOG: no monitoring cycle finished for %v (%d polling periods), a GPU request is probably hung. Exiting so the service gets restarted.",
+				stalled.Round(time.Second), cfg().WatchdogPeriods)
+			os.Exit(1)
+		}
+	}()
+}
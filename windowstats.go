@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/nvml-gpu-ha/pkg/nvidia"
+)
+
+// windowSample is a reading kept for the min/max/avg statistics
+type windowSample struct {
+	timestamp time.Time
+	value     float64
+}
+
+// windowAggregate is the minimum, maximum and average of the samples in a window
+type windowAggregate struct {
+	min, max, avg float64
+}
+
+// windowStats tracks the minimum, maximum and average temperature and power draw per GPU,
+// either over a rolling window or since local midnight
+type windowStats struct {
+	mutex sync.Mutex
+	// window is the rolling window length, 0 resets the statistics daily at midnight
+	window  time.Duration
+	samples map[string][]windowSample
+}
+
+func newWindowStats(window time.Duration) *windowStats {
+	return &windowStats{
+		window:  window,
+		samples: make(map[string][]windowSample),
+	}
+}
+
+// add records the temperature and power draw of metrics. Failed reads are not samples.
+func (s *windowStats) add(gpu nvidia.GPUDevice, metrics nvidia.GPUMetrics) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deviceID := nvidia.GetDeviceID(gpu)
+	if !metrics.Failed["temperature"] {
+		s.record(deviceID+"_temperature", metrics.Timestamp, float64(metrics.Temperature))
+	}
+	if !metrics.Failed["power_draw"] {
+		s.record(deviceID+"_power_draw", metrics.Timestamp, metrics.PowerDraw)
+	}
+}
+
+// record appends a sample and drops the samples that left the window
+func (s *windowStats) record(key string, timestamp time.Time, value float64) {
+	cutoff := s.cutoff(timestamp)
+	samples := s.samples[key]
+
+	first := 0
+	for first < len(samples) && samples[first].timestamp.Before(cutoff) {
+		first++
+	}
+	s.samples[key] = append(samples[first:], windowSample{timestamp: timestamp, value: value})
+}
+
+// cutoff returns the oldest timestamp still in the window at now
+func (s *windowStats) cutoff(now time.Time) time.Time {
+	if s.window > 0 {
+		return now.Add(-s.window)
+	}
+	year, month, day := now.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+}
+
+// aggregates returns the statistics of gpu by metric ("temperature", "power_draw"),
+// leaving out metrics without samples in the window
+func (s *windowStats) aggregates(gpu nvidia.GPUDevice) map[string]windowAggregate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	deviceID := nvidia.GetDeviceID(gpu)
+	cutoff := s.cutoff(time.Now())
+
+	aggregates := make(map[string]windowAggregate)
+	for _, metric := range []string{"temperature", "power_draw"} {
+		aggregate := windowAggregate{min: math.Inf(1), max: math.Inf(-1)}
+		count := 0
+		for _, sample := range s.samples[deviceID+"_"+metric] {
+			if sample.timestamp.Before(cutoff) {
+				continue
+			}
+			aggregate.min = math.Min(aggregate.min, sample.value)
+			aggregate.max = math.Max(aggregate.max, sample.value)
+			aggregate.avg += sample.value
+			count++
+		}
+		if count > 0 {
+			aggregate.avg /= float64(count)
+			aggregates[metric] = aggregate
+		}
+	}
+	return aggregates
+}